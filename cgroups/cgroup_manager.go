@@ -1,6 +1,7 @@
 package cgroups
 
 import (
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/xianlubird/mydocker/cgroups/subsystems"
 )
@@ -10,6 +11,8 @@ type CgroupManager struct {
 	Path string // 新建的cgroup目录名
 	// 资源配置
 	Resource *subsystems.ResourceConfig
+	// rootless 模式下只使用委派给当前用户的 cgroup v2 子树
+	Rootless bool
 }
 
 func NewCgroupManager(path string) *CgroupManager {
@@ -18,24 +21,37 @@ func NewCgroupManager(path string) *CgroupManager {
 	}
 }
 
-// 将进程pid加入到这个cgroup中
+// 将进程pid加入到这个cgroup中，任何一个 subsystem 失败都返回错误
 func (c *CgroupManager) Apply(pid int) error {
+	if c.Rootless {
+		return c.applyRootless(pid)
+	}
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Apply(c.Path, pid)
+		if err := subSysIns.Apply(c.Path, pid); err != nil {
+			return fmt.Errorf("apply cgroup %s error %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
-// 设置cgroup资源限制
+// 设置cgroup资源限制，返回第一个失败的 subsystem 的错误，不能在限制没有生效时继续运行容器
 func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
+	if c.Rootless {
+		return c.setRootless(res)
+	}
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Set(c.Path, res)
+		if err := subSysIns.Set(c.Path, res); err != nil {
+			return fmt.Errorf("set cgroup %s error %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
 //释放cgroup
 func (c *CgroupManager) Destroy() error {
+	if c.Rootless {
+		return c.destroyRootless()
+	}
 	for _, subSysIns := range subsystems.SubsystemsIns {
 		if err := subSysIns.Remove(c.Path); err != nil {
 			logrus.Warnf("remove cgroup fail %v", err)
@@ -0,0 +1,113 @@
+package cgroups
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// /proc/<pid>/cgroup 中的一行: hierarchy-ID:controller-list:cgroup-path
+// cgroup v2 的 controller-list 为空
+type procCgroup struct {
+	Controllers string
+	Path        string
+}
+
+// 把进程 pid 加入容器 init 进程所在的所有 cgroup
+// 不只是 CgroupManager 管理的几个 subsystem，容器所在的每个 hierarchy 都要加入，exec 的进程才不会逃出容器的资源限制
+func JoinContainerCgroups(containerPid string, pid int) error {
+	f, err := os.Open(fmt.Sprintf("/proc/%s/cgroup", containerPid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cgroups, err := parseProcCgroups(f)
+	if err != nil {
+		return err
+	}
+
+	// 已经在同一个 cgroup 中的 hierarchy 不需要再加入，例如 rootless 模式下容器在 cgroup v1 中和 mydocker 的位置相同
+	current := map[string]string{}
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid)); err == nil {
+		own, _ := parseProcCgroups(f)
+		f.Close()
+		for _, cg := range own {
+			current[cg.Controllers] = cg.Path
+		}
+	}
+
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	for _, cg := range cgroups {
+		if p, ok := current[cg.Controllers]; ok && p == cg.Path {
+			continue
+		}
+		mountpoint, root := findCgroupMount(string(mountinfo), cg.Controllers)
+		if mountpoint == "" {
+			// 宿主机上没有挂载这个 hierarchy，也就没有办法设置
+			continue
+		}
+		// 挂载的可能是 hierarchy 中的子目录，需要去掉挂载的根路径
+		rel := cg.Path
+		if root != "/" {
+			rel = strings.TrimPrefix(rel, root)
+		}
+		procs := path.Join(mountpoint, rel, "cgroup.procs")
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("join cgroup %s error %v", procs, err)
+		}
+	}
+	return nil
+}
+
+func parseProcCgroups(r io.Reader) ([]procCgroup, error) {
+	var cgroups []procCgroup
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		cgroups = append(cgroups, procCgroup{Controllers: fields[1], Path: fields[2]})
+	}
+	return cgroups, scanner.Err()
+}
+
+// 查找 hierarchy 的挂载点和挂载的根路径，controllers 为空时查找 cgroup v2 的挂载点
+// mountinfo 的格式: 36 35 98:0 /root /mnt rw,noatime master:1 - cgroup cgroup rw,memory
+func findCgroupMount(mountinfo string, controllers string) (string, string) {
+	names := strings.Split(controllers, ",")
+	for _, line := range strings.Split(mountinfo, "\n") {
+		parts := strings.SplitN(line, " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		super := strings.Fields(parts[1])
+		if len(fields) < 5 || len(super) < 3 {
+			continue
+		}
+		if controllers == "" {
+			if super[0] == "cgroup2" {
+				return fields[4], fields[3]
+			}
+			continue
+		}
+		if super[0] != "cgroup" {
+			continue
+		}
+		for _, opt := range strings.Split(super[2], ",") {
+			if opt == names[0] {
+				return fields[4], fields[3]
+			}
+		}
+	}
+	return "", ""
+}
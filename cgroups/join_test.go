@@ -0,0 +1,42 @@
+package cgroups
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMountinfo = `25 20 0:22 / /sys/fs/cgroup ro,nosuid - tmpfs tmpfs ro,mode=755
+26 25 0:23 / /sys/fs/cgroup/unified rw,nosuid - cgroup2 cgroup2 rw
+27 25 0:24 / /sys/fs/cgroup/systemd rw,nosuid shared:9 - cgroup cgroup rw,xattr,name=systemd
+28 25 0:25 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid - cgroup cgroup rw,cpu,cpuacct
+29 25 0:26 /kube/pod1 /sys/fs/cgroup/memory rw,nosuid - cgroup cgroup rw,memory`
+
+func TestParseProcCgroups(t *testing.T) {
+	cgroups, err := parseProcCgroups(strings.NewReader("4:memory:/kube/pod1/123\n2:cpu,cpuacct:/123\n0::/123\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgroups) != 3 || cgroups[1].Controllers != "cpu,cpuacct" || cgroups[2].Controllers != "" || cgroups[2].Path != "/123" {
+		t.Fatalf("unexpected cgroups %+v", cgroups)
+	}
+}
+
+func TestFindCgroupMount(t *testing.T) {
+	tests := []struct {
+		controllers string
+		mountpoint  string
+		root        string
+	}{
+		{"cpu,cpuacct", "/sys/fs/cgroup/cpu,cpuacct", "/"},
+		{"name=systemd", "/sys/fs/cgroup/systemd", "/"},
+		{"memory", "/sys/fs/cgroup/memory", "/kube/pod1"},
+		{"", "/sys/fs/cgroup/unified", "/"},
+		{"pids", "", ""},
+	}
+	for _, test := range tests {
+		mountpoint, root := findCgroupMount(testMountinfo, test.controllers)
+		if mountpoint != test.mountpoint || root != test.root {
+			t.Errorf("findCgroupMount %q got %s %s", test.controllers, mountpoint, root)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package cgroups
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/xianlubird/mydocker/cgroups/subsystems"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+// rootless 模式下容器的 cgroup 创建在委派给当前用户的 cgroup v2 子树中: <委派的目录>/mydocker/<容器ID>
+const rootlessCgroupParent = "mydocker"
+
+// 需要在子树中启用的 controller，内核或者委派不支持的会被忽略
+var rootlessControllers = []string{"cpu", "cpuset", "memory", "pids"}
+
+// 查找委派给当前用户的 cgroup v2 目录: 从当前进程所在的 cgroup 向上，属主是当前用户的最上层目录
+func findDelegatedCgroup() (string, error) {
+	mountpoint := subsystems.FindCgroup2Mountpoint()
+	if mountpoint == "" {
+		return "", fmt.Errorf("cgroup v2 is not mounted")
+	}
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cgroups, err := parseProcCgroups(f)
+	if err != nil {
+		return "", err
+	}
+	for _, cg := range cgroups {
+		if cg.Controllers != "" {
+			continue
+		}
+		if dir := delegatedCgroup(mountpoint, cg.Path, os.Geteuid(), cgroupOwner); dir != "" {
+			return dir, nil
+		}
+		break
+	}
+	return "", fmt.Errorf("no cgroup v2 subtree is delegated to uid %d", os.Geteuid())
+}
+
+func delegatedCgroup(mountpoint, cgroupPath string, uid int, owner func(string) (int, error)) string {
+	result := ""
+	for p := path.Clean("/" + cgroupPath); ; p = path.Dir(p) {
+		dir := path.Join(mountpoint, p)
+		if o, err := owner(dir); err != nil || o != uid {
+			break
+		}
+		result = dir
+		if p == "/" {
+			break
+		}
+	}
+	return result
+}
+
+func cgroupOwner(dir string) (int, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Sys().(*syscall.Stat_t).Uid), nil
+}
+
+// cpu.shares（2-262144，默认 1024）换算为 cgroup v2 的 cpu.weight（1-10000，默认 100）
+func cpuSharesToWeight(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func (c *CgroupManager) rootlessPath() (string, error) {
+	delegated, err := findDelegatedCgroup()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(delegated, rootlessCgroupParent, c.Path), nil
+}
+
+// 创建容器的 cgroup 并写入限制，没有委派的 cgroup 时资源限制不生效
+func (c *CgroupManager) setRootless(res *subsystems.ResourceConfig) error {
+	cgroupPath, err := c.rootlessPath()
+	if err != nil {
+		if res.MemoryLimit != "" || res.CpuShare != "" || res.CpuSet != "" {
+			logrus.Warnf("resource limits are ignored in rootless mode: %v", err)
+		}
+		return nil
+	}
+	parent := path.Dir(cgroupPath)
+	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+		return fmt.Errorf("create cgroup %s error %v", cgroupPath, err)
+	}
+	// controller 需要从委派的目录开始逐级启用，才能在容器的 cgroup 中使用
+	enableControllers(path.Dir(parent))
+	enableControllers(parent)
+
+	if res.MemoryLimit != "" {
+		if err := ioutil.WriteFile(path.Join(cgroupPath, "memory.max"), []byte(res.MemoryLimit), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory fail %v", err)
+		}
+	}
+	if res.CpuShare != "" {
+		shares, err := strconv.ParseUint(res.CpuShare, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cpushare %s", res.CpuShare)
+		}
+		weight := strconv.FormatUint(cpuSharesToWeight(shares), 10)
+		if err := ioutil.WriteFile(path.Join(cgroupPath, "cpu.weight"), []byte(weight), 0644); err != nil {
+			return fmt.Errorf("set cgroup cpu weight fail %v", err)
+		}
+	}
+	if res.CpuSet != "" {
+		if err := ioutil.WriteFile(path.Join(cgroupPath, "cpuset.cpus"), []byte(res.CpuSet), 0644); err != nil {
+			return fmt.Errorf("set cgroup cpuset fail %v", err)
+		}
+	}
+	return nil
+}
+
+func enableControllers(dir string) {
+	for _, controller := range rootlessControllers {
+		if err := ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+			logrus.Debugf("enable controller %s in %s error %v", controller, dir, err)
+		}
+	}
+}
+
+func (c *CgroupManager) applyRootless(pid int) error {
+	cgroupPath, err := c.rootlessPath()
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(cgroupPath); err != nil {
+		return nil
+	}
+	if err := ioutil.WriteFile(path.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("set cgroup proc fail %v", err)
+	}
+	return nil
+}
+
+func (c *CgroupManager) destroyRootless() error {
+	cgroupPath, err := c.rootlessPath()
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(cgroupPath); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("remove cgroup fail %v", err)
+	}
+	return nil
+}
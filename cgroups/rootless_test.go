@@ -0,0 +1,58 @@
+package cgroups
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDelegatedCgroup(t *testing.T) {
+	owners := map[string]int{
+		"/sys/fs/cgroup":                                                                0,
+		"/sys/fs/cgroup/user.slice":                                                     0,
+		"/sys/fs/cgroup/user.slice/user-1000.slice":                                     0,
+		"/sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service":                   1000,
+		"/sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service/app.slice":         1000,
+		"/sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service/app.slice/a.scope": 1000,
+		"/sys/fs/cgroup/user.slice/user-1000.slice/session-1.scope":                     0,
+	}
+	owner := func(dir string) (int, error) {
+		if uid, ok := owners[dir]; ok {
+			return uid, nil
+		}
+		return 0, fmt.Errorf("%s not found", dir)
+	}
+	tests := []struct {
+		cgroupPath string
+		uid        int
+		expect     string
+	}{
+		{"/user.slice/user-1000.slice/user@1000.service/app.slice/a.scope", 1000, "/sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service"},
+		{"/user.slice/user-1000.slice/user@1000.service", 1000, "/sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service"},
+		{"/user.slice/user-1000.slice/session-1.scope", 1000, ""},
+		{"/user.slice/user-1000.slice/user@1000.service/app.slice/a.scope", 1001, ""},
+		{"/", 0, "/sys/fs/cgroup"},
+		{"/missing", 1000, ""},
+	}
+	for _, test := range tests {
+		if got := delegatedCgroup("/sys/fs/cgroup", test.cgroupPath, test.uid, owner); got != test.expect {
+			t.Errorf("delegated cgroup of %s for %d got %q, expect %q", test.cgroupPath, test.uid, got, test.expect)
+		}
+	}
+}
+
+func TestCpuSharesToWeight(t *testing.T) {
+	tests := []struct {
+		shares, weight uint64
+	}{
+		{0, 1},
+		{2, 1},
+		{1024, 39},
+		{262144, 10000},
+		{1000000, 10000},
+	}
+	for _, test := range tests {
+		if got := cpuSharesToWeight(test.shares); got != test.weight {
+			t.Errorf("cpu shares %d got weight %d, expect %d", test.shares, got, test.weight)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package subsystems
 
 import(
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"path"
@@ -14,6 +15,9 @@ type CpusetSubSystem struct {
 
 func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if err := initCpuset(subsysCgroupPath); err != nil {
+			return err
+		}
 		if res.CpuSet != "" {
 			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpuset.cpus"), []byte(res.CpuSet), 0644); err != nil {
 				return fmt.Errorf("set cgroup cpuset fail %v", err)
@@ -25,6 +29,28 @@ func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	}
 }
 
+// cgroup v1 新建的 cpuset 中 cpuset.cpus 和 cpuset.mems 为空，这时加入进程会返回 ENOSPC
+// 为空时从父 cgroup 复制，和 runc 的做法相同
+func initCpuset(subsysCgroupPath string) error {
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		current, err := ioutil.ReadFile(path.Join(subsysCgroupPath, file))
+		if err != nil {
+			return fmt.Errorf("read cgroup %s fail %v", file, err)
+		}
+		if len(bytes.TrimSpace(current)) > 0 {
+			continue
+		}
+		parent, err := ioutil.ReadFile(path.Join(path.Dir(subsysCgroupPath), file))
+		if err != nil {
+			return fmt.Errorf("read parent cgroup %s fail %v", file, err)
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, file), parent, 0644); err != nil {
+			return fmt.Errorf("init cgroup %s fail %v", file, err)
+		}
+	}
+	return nil
+}
+
 func (s *CpusetSubSystem) Remove(cgroupPath string) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		return os.RemoveAll(subsysCgroupPath)
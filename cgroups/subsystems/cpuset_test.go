@@ -0,0 +1,27 @@
+package subsystems
+
+import(
+	"testing"
+	"os"
+)
+
+func TestCpusetCgroup(t *testing.T) {
+	cpusetSubSys := CpusetSubSystem{}
+	testCgroup := "testcpuset"
+
+	// 没有设置 --cpuset 时也要能加入进程
+	if err := cpusetSubSys.Set(testCgroup, &ResourceConfig{}); err != nil {
+		t.Fatalf("cgroup fail %v", err)
+	}
+	if err := cpusetSubSys.Apply(testCgroup, os.Getpid()); err != nil {
+		t.Fatalf("cgroup Apply %v", err)
+	}
+	//将进程移回到根Cgroup节点
+	if err := cpusetSubSys.Apply("", os.Getpid()); err != nil {
+		t.Fatalf("cgroup Apply %v", err)
+	}
+
+	if err := cpusetSubSys.Remove(testCgroup); err != nil {
+		t.Fatalf("cgroup remove %v", err)
+	}
+}
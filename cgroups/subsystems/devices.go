@@ -0,0 +1,223 @@
+package subsystems
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 设备访问规则，格式和 devices.allow 相同: <type> <major>:<minor> <access>
+type DeviceRule struct {
+	Type   byte   // a 表示所有设备，c 为字符设备，b 为块设备
+	Major  int64  // -1 表示 *
+	Minor  int64  // -1 表示 *
+	Access string // r、w、m 的组合
+}
+
+// 容器默认允许访问的设备，和 docker 相同
+var DefaultDeviceRules = []DeviceRule{
+	{Type: 'c', Major: -1, Minor: -1, Access: "m"}, // 允许 mknod 任意设备，但不能读写
+	{Type: 'b', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},    // /dev/null
+	{Type: 'c', Major: 1, Minor: 5, Access: "rwm"},    // /dev/zero
+	{Type: 'c', Major: 1, Minor: 7, Access: "rwm"},    // /dev/full
+	{Type: 'c', Major: 1, Minor: 8, Access: "rwm"},    // /dev/random
+	{Type: 'c', Major: 1, Minor: 9, Access: "rwm"},    // /dev/urandom
+	{Type: 'c', Major: 5, Minor: 0, Access: "rwm"},    // /dev/tty
+	{Type: 'c', Major: 5, Minor: 1, Access: "rwm"},    // /dev/console
+	{Type: 'c', Major: 5, Minor: 2, Access: "rwm"},    // /dev/pts/ptmx
+	{Type: 'c', Major: 136, Minor: -1, Access: "rwm"}, // /dev/pts/*
+}
+
+// 解析设备规则，例如 c 1:3 rwm、b 8:* r、a *:* rwm
+func ParseDeviceRule(value string) (DeviceRule, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return DeviceRule{}, fmt.Errorf("invalid device rule %q, expect <type> <major>:<minor> <access>", value)
+	}
+	rule := DeviceRule{}
+	if len(fields[0]) != 1 || !strings.Contains("acb", fields[0]) {
+		return DeviceRule{}, fmt.Errorf("invalid device type %q in device rule %q", fields[0], value)
+	}
+	rule.Type = fields[0][0]
+
+	numbers := strings.Split(fields[1], ":")
+	if len(numbers) != 2 {
+		return DeviceRule{}, fmt.Errorf("invalid device number %q in device rule %q", fields[1], value)
+	}
+	var err error
+	if rule.Major, err = parseDeviceNumber(numbers[0]); err != nil {
+		return DeviceRule{}, fmt.Errorf("invalid major number %q in device rule %q", numbers[0], value)
+	}
+	if rule.Minor, err = parseDeviceNumber(numbers[1]); err != nil {
+		return DeviceRule{}, fmt.Errorf("invalid minor number %q in device rule %q", numbers[1], value)
+	}
+
+	if !ValidDeviceAccess(fields[2]) {
+		return DeviceRule{}, fmt.Errorf("invalid access %q in device rule %q", fields[2], value)
+	}
+	rule.Access = fields[2]
+	return rule, nil
+}
+
+func parseDeviceNumber(s string) (int64, error) {
+	if s == "*" {
+		return -1, nil
+	}
+	return strconv.ParseInt(s, 10, 32)
+}
+
+// 检查访问权限是否为 r、w、m 不重复的组合
+func ValidDeviceAccess(access string) bool {
+	if access == "" || len(access) > 3 {
+		return false
+	}
+	for i, c := range access {
+		if !strings.ContainsRune("rwm", c) || strings.ContainsRune(access[i+1:], c) {
+			return false
+		}
+	}
+	return true
+}
+
+// 转换为 devices.allow 中的格式
+func (r DeviceRule) String() string {
+	number := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, number(r.Major), number(r.Minor), r.Access)
+}
+
+// 设备访问控制
+// cgroup v1 通过 devices.deny、devices.allow 设置，cgroup v2 没有 devices 控制器，需要在 cgroup 上挂载 BPF 程序
+type DevicesSubSystem struct {
+}
+
+// 没有指定设备规则时不做限制
+func (s *DevicesSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		return s.setV2(cgroupPath, res)
+	}
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if res.DeviceRules == nil {
+			return nil
+		}
+		// 先禁止所有设备，再逐条允许
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "devices.deny"), []byte("a"), 0644); err != nil {
+			return fmt.Errorf("set cgroup devices fail %v", err)
+		}
+		for _, rule := range res.DeviceRules {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "devices.allow"), []byte(rule.String()), 0644); err != nil {
+				return fmt.Errorf("set cgroup devices rule %s fail %v", rule, err)
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (s *DevicesSubSystem) setV2(cgroupPath string, res *ResourceConfig) error {
+	if res.DeviceRules == nil {
+		return nil
+	}
+	subsysCgroupPath, err := getCgroup2Path(cgroupPath, true)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(subsysCgroupPath)
+	if err != nil {
+		return fmt.Errorf("open cgroup %s error %v", subsysCgroupPath, err)
+	}
+	defer dir.Close()
+	if err := attachDeviceFilter(int(dir.Fd()), res.DeviceRules); err != nil {
+		return fmt.Errorf("set cgroup devices fail %v", err)
+	}
+	return nil
+}
+
+func (s *DevicesSubSystem) Remove(cgroupPath string) error {
+	var subsysCgroupPath string
+	var err error
+	if FindCgroupMountpoint(s.Name()) == "" {
+		subsysCgroupPath, err = getCgroup2Path(cgroupPath, false)
+	} else {
+		subsysCgroupPath, err = GetCgroupPath(s.Name(), cgroupPath, false)
+	}
+	if err != nil {
+		return err
+	}
+	// cgroup 目录中的文件不能删除，只能直接删除目录
+	return os.Remove(subsysCgroupPath)
+}
+
+func (s *DevicesSubSystem) Apply(cgroupPath string, pid int) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		subsysCgroupPath, err := getCgroup2Path(cgroupPath, false)
+		if err != nil {
+			return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	}
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+func (s *DevicesSubSystem) Name() string {
+	return "devices"
+}
+
+// 查找 cgroup v2 的挂载点，没有挂载时返回空
+func FindCgroup2Mountpoint() string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if fields := strings.Fields(parts[1]); len(fields) > 0 && fields[0] == "cgroup2" {
+			return strings.Fields(parts[0])[4]
+		}
+	}
+	return ""
+}
+
+func getCgroup2Path(cgroupPath string, autoCreate bool) (string, error) {
+	cgroupRoot := FindCgroup2Mountpoint()
+	if cgroupRoot == "" {
+		return "", fmt.Errorf("devices cgroup not found")
+	}
+	p := path.Join(cgroupRoot, cgroupPath)
+	if _, err := os.Stat(p); err == nil || (autoCreate && os.IsNotExist(err)) {
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(p, 0755); err != nil {
+				return "", fmt.Errorf("error create cgroup %v", err)
+			}
+		}
+		return p, nil
+	} else {
+		return "", fmt.Errorf("cgroup path error %v", err)
+	}
+}
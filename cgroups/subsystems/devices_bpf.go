@@ -0,0 +1,183 @@
+package subsystems
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// cgroup v2 的设备访问控制: 生成一个 BPF_PROG_TYPE_CGROUP_DEVICE 类型的 eBPF 程序挂载到容器的 cgroup 上
+// 进程访问设备时内核调用这个程序，返回 1 允许，返回 0 拒绝
+// 常量取值见 /usr/include/linux/bpf.h
+
+const (
+	bpfProgLoad   = 5
+	bpfProgAttach = 8
+
+	bpfProgTypeCgroupDevice = 15
+	bpfCgroupDevice         = 6 // attach type
+	bpfFAllowMulti          = 2
+
+	// struct bpf_cgroup_dev_ctx 中 access_type 的低 16 位为设备类型，高 16 位为访问类型
+	bpfDevcgDevBlock = 1
+	bpfDevcgDevChar  = 2
+	bpfDevcgAccMknod = 1
+	bpfDevcgAccRead  = 2
+	bpfDevcgAccWrite = 4
+)
+
+// eBPF 指令的操作码
+const (
+	bpfLdxMemW  = 0x61 // dst = *(u32 *)(src + off)
+	bpfAnd64K   = 0x57 // dst &= imm
+	bpfRsh64K   = 0x77 // dst >>= imm
+	bpfMov64K   = 0xb7 // dst = imm
+	bpfMov64X   = 0xbf // dst = src
+	bpfJneK     = 0x55 // if dst != imm goto pc + off
+	bpfExitInsn = 0x95
+)
+
+// struct bpf_insn
+type bpfInsn struct {
+	Code uint8
+	Regs uint8 // 低 4 位为 dst，高 4 位为 src
+	Off  int16
+	Imm  int32
+}
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{Code: code, Regs: dst | src<<4, Off: off, Imm: imm}
+}
+
+// 根据设备规则生成 eBPF 程序，所有规则都是允许规则，没有匹配的规则时拒绝
+// 程序开始时 r1 指向 struct bpf_cgroup_dev_ctx { u32 access_type; u32 major; u32 minor; }
+func buildDeviceFilter(rules []DeviceRule) []bpfInsn {
+	prog := []bpfInsn{
+		insn(bpfLdxMemW, 2, 1, 0, 0), // r2 = 设备类型
+		insn(bpfAnd64K, 2, 0, 0, 0xffff),
+		insn(bpfLdxMemW, 3, 1, 0, 0), // r3 = 访问类型
+		insn(bpfRsh64K, 3, 0, 0, 16),
+		insn(bpfLdxMemW, 4, 1, 4, 0), // r4 = major
+		insn(bpfLdxMemW, 5, 1, 8, 0), // r5 = minor
+	}
+	for _, rule := range rules {
+		prog = append(prog, deviceRuleBlock(rule)...)
+	}
+	// 没有匹配的规则，拒绝访问
+	return append(prog, insn(bpfMov64K, 0, 0, 0, 0), insn(bpfExitInsn, 0, 0, 0, 0))
+}
+
+// 一条规则对应的指令，条件不满足时跳到下一条规则，全部满足时返回 1
+func deviceRuleBlock(rule DeviceRule) []bpfInsn {
+	// 跳转的偏移量在最后计算，先记录跳转指令的位置
+	var block []bpfInsn
+	var jumps []int
+	jumpNext := func(dst uint8, imm int32) {
+		jumps = append(jumps, len(block))
+		block = append(block, insn(bpfJneK, dst, 0, 0, imm))
+	}
+
+	switch rule.Type {
+	case 'c':
+		jumpNext(2, bpfDevcgDevChar)
+	case 'b':
+		jumpNext(2, bpfDevcgDevBlock)
+	}
+	var access int32
+	for _, c := range rule.Access {
+		switch c {
+		case 'm':
+			access |= bpfDevcgAccMknod
+		case 'r':
+			access |= bpfDevcgAccRead
+		case 'w':
+			access |= bpfDevcgAccWrite
+		}
+	}
+	// 请求的访问类型必须全部在规则允许的范围内: (r3 & ^access) == 0
+	if access != bpfDevcgAccMknod|bpfDevcgAccRead|bpfDevcgAccWrite {
+		block = append(block,
+			insn(bpfMov64X, 1, 3, 0, 0),
+			insn(bpfAnd64K, 1, 0, 0, ^access&0x7),
+		)
+		jumpNext(1, 0)
+	}
+	if rule.Major >= 0 {
+		jumpNext(4, int32(rule.Major))
+	}
+	if rule.Minor >= 0 {
+		jumpNext(5, int32(rule.Minor))
+	}
+	block = append(block, insn(bpfMov64K, 0, 0, 0, 1), insn(bpfExitInsn, 0, 0, 0, 0))
+
+	for _, i := range jumps {
+		block[i].Off = int16(len(block) - i - 1)
+	}
+	return block
+}
+
+// union bpf_attr 中 BPF_PROG_LOAD 使用的部分
+type bpfProgLoadAttr struct {
+	ProgType    uint32
+	InsnCnt     uint32
+	Insns       uint64
+	License     uint64
+	LogLevel    uint32
+	LogSize     uint32
+	LogBuf      uint64
+	KernVersion uint32
+	ProgFlags   uint32
+}
+
+// union bpf_attr 中 BPF_PROG_ATTACH 使用的部分
+type bpfProgAttachAttr struct {
+	TargetFd    uint32
+	AttachBpfFd uint32
+	AttachType  uint32
+	AttachFlags uint32
+}
+
+// 加载设备访问控制程序并挂载到 cgroup 目录 cgroupFd 上
+func attachDeviceFilter(cgroupFd int, rules []DeviceRule) error {
+	prog := buildDeviceFilter(rules)
+	license := []byte("Apache\x00")
+	logBuf := make([]byte, 64*1024)
+	loadAttr := bpfProgLoadAttr{
+		ProgType: bpfProgTypeCgroupDevice,
+		InsnCnt:  uint32(len(prog)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		LogLevel: 1,
+		LogSize:  uint32(len(logBuf)),
+		LogBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	progFd, _, errno := syscall.Syscall(sysBPF, bpfProgLoad, uintptr(unsafe.Pointer(&loadAttr)), unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		return fmt.Errorf("load bpf device filter error %v: %s", errno, cString(logBuf))
+	}
+	// 挂载到 cgroup 之后由内核持有程序的引用
+	defer syscall.Close(int(progFd))
+
+	attachAttr := bpfProgAttachAttr{
+		TargetFd:    uint32(cgroupFd),
+		AttachBpfFd: uint32(progFd),
+		AttachType:  bpfCgroupDevice,
+		AttachFlags: bpfFAllowMulti,
+	}
+	if _, _, errno := syscall.Syscall(sysBPF, bpfProgAttach, uintptr(unsafe.Pointer(&attachAttr)), unsafe.Sizeof(attachAttr)); errno != 0 {
+		return fmt.Errorf("attach bpf device filter error %v", errno)
+	}
+	return nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,4 @@
+package subsystems
+
+// bpf 系统调用号，syscall 包中 amd64 没有定义
+const sysBPF = 321
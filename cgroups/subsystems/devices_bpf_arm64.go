@@ -0,0 +1,5 @@
+package subsystems
+
+import "syscall"
+
+const sysBPF = syscall.SYS_BPF
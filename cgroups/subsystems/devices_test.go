@@ -0,0 +1,92 @@
+package subsystems
+
+import (
+	"testing"
+)
+
+func TestParseDeviceRule(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect DeviceRule
+	}{
+		{"c 1:3 rwm", DeviceRule{Type: 'c', Major: 1, Minor: 3, Access: "rwm"}},
+		{"b 8:* r", DeviceRule{Type: 'b', Major: 8, Minor: -1, Access: "r"}},
+		{"a *:* mw", DeviceRule{Type: 'a', Major: -1, Minor: -1, Access: "mw"}},
+	}
+	for _, test := range tests {
+		rule, err := ParseDeviceRule(test.value)
+		if err != nil {
+			t.Fatalf("parse device rule %s error %v", test.value, err)
+		}
+		if rule != test.expect {
+			t.Errorf("parse device rule %s got %+v, expect %+v", test.value, rule, test.expect)
+		}
+		if rule.String() != test.value {
+			t.Errorf("device rule %+v string got %s, expect %s", rule, rule.String(), test.value)
+		}
+	}
+
+	for _, value := range []string{"", "c 1:3", "x 1:3 rwm", "c 1 rwm", "c a:3 rwm", "c 1:3 rwx", "c 1:3 rr", "c 1:3 rwmr"} {
+		if _, err := ParseDeviceRule(value); err == nil {
+			t.Errorf("parse device rule %q should fail", value)
+		}
+	}
+}
+
+// 在生成的程序上模拟执行，检查设备访问的结果
+func TestBuildDeviceFilter(t *testing.T) {
+	prog := buildDeviceFilter([]DeviceRule{
+		{Type: 'c', Major: -1, Minor: -1, Access: "m"},
+		{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},
+		{Type: 'b', Major: 8, Minor: -1, Access: "r"},
+	})
+	tests := []struct {
+		devType, access, major, minor uint32
+		allow                         bool
+	}{
+		{bpfDevcgDevChar, bpfDevcgAccRead | bpfDevcgAccWrite, 1, 3, true},
+		{bpfDevcgDevChar, bpfDevcgAccMknod, 10, 229, true},
+		{bpfDevcgDevChar, bpfDevcgAccRead, 10, 229, false},
+		{bpfDevcgDevBlock, bpfDevcgAccRead, 8, 1, true},
+		{bpfDevcgDevBlock, bpfDevcgAccWrite, 8, 1, false},
+		{bpfDevcgDevBlock, bpfDevcgAccMknod, 8, 1, false},
+		{bpfDevcgDevBlock, bpfDevcgAccRead, 1, 3, false},
+	}
+	for _, test := range tests {
+		ctx := [3]uint32{test.access<<16 | test.devType, test.major, test.minor}
+		if allow := runDeviceFilter(t, prog, ctx); allow != test.allow {
+			t.Errorf("device %d %d:%d access %d got allow %v, expect %v", test.devType, test.major, test.minor, test.access, allow, test.allow)
+		}
+	}
+}
+
+// 只实现了 buildDeviceFilter 用到的指令
+func runDeviceFilter(t *testing.T, prog []bpfInsn, ctx [3]uint32) bool {
+	var regs [11]uint64
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		dst, src := in.Regs&0xf, in.Regs>>4
+		switch in.Code {
+		case bpfLdxMemW:
+			regs[dst] = uint64(ctx[in.Off/4])
+		case bpfAnd64K:
+			regs[dst] &= uint64(int64(in.Imm))
+		case bpfRsh64K:
+			regs[dst] >>= uint(in.Imm)
+		case bpfMov64K:
+			regs[dst] = uint64(int64(in.Imm))
+		case bpfMov64X:
+			regs[dst] = regs[src]
+		case bpfJneK:
+			if regs[dst] != uint64(int64(in.Imm)) {
+				pc += int(in.Off)
+			}
+		case bpfExitInsn:
+			return regs[0] == 1
+		default:
+			t.Fatalf("unknown instruction %+v", in)
+		}
+	}
+	t.Fatalf("program does not exit")
+	return false
+}
@@ -4,6 +4,7 @@ type ResourceConfig struct {
 	MemoryLimit string
 	CpuShare    string
 	CpuSet      string
+	DeviceRules []DeviceRule // 允许访问的设备，为 nil 时不限制
 }
 
 type Subsystem interface {
@@ -18,5 +19,6 @@ var (
 		&CpusetSubSystem{},
 		&MemorySubSystem{},
 		&CpuSubSystem{},
+		&DevicesSubSystem{},
 	}
 )
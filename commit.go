@@ -4,18 +4,83 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/xianlubird/mydocker/container"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 )
 
 // 通过容器构建新镜像
 func commitContainer(containerName, imageName string) {
-	mntURL := fmt.Sprintf(container.MntUrl, containerName)
-	mntURL += "/"
-
 	imageTar := container.RootUrl + "/" + imageName + ".tar"
 
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		log.Errorf("Get container %s info error %v", containerName, err)
+		return
+	}
+	mntURL := container.ContainerMntUrl(containerName, containerInfo.UidMaps, containerInfo.GidMaps)
+	mntURL += "/"
+	// rootless 模式下挂载点只在容器的 mount 命名空间中可见，通过容器 init 进程的根目录打包
+	// 只有在 user 命名空间外、命名空间的属主才能访问容器进程的根目录，所以 commit 不在 rootless 的 user 命名空间中执行
+	if container.Rootless() {
+		if containerInfo.Status != container.RUNNING {
+			log.Errorf("Container %s is not running, only running containers can be committed in rootless mode", containerName)
+			return
+		}
+		mntURL = fmt.Sprintf("/proc/%s/root/", containerInfo.Pid)
+	}
+
 	// 直接将挂载点目录进行打包，就成了新镜像（docker的镜像是分层(layer)的）
-	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
+	args := []string{"-czf", imageTar, "-C", mntURL}
+	// 容器根目录下的 /proc、/sys、/dev 等挂载不打包
+	oneFileSystem := container.Rootless()
+	if oneFileSystem {
+		args = append(args, "--one-file-system")
+	}
+	// 使用 user 命名空间的容器，文件属主是宿主机上映射后的 ID，打包时还原为容器内的 ID
+	if len(containerInfo.UidMaps) > 0 {
+		mapArgs, cleanup, err := tarIDMapArgs(mntURL, containerInfo, oneFileSystem)
+		if err != nil {
+			log.Errorf("Create tar id maps for %s error %v", mntURL, err)
+			return
+		}
+		defer cleanup()
+		args = append(args, mapArgs...)
+	}
+	if _, err := exec.Command("tar", append(args, ".")...).CombinedOutput(); err != nil {
 		log.Errorf("Tar folder %s error %v", mntURL, err)
+		return
+	}
+
+	// 容器实际使用的配置（指令、环境变量、工作目录等）作为新镜像的配置
+	if containerInfo.Config != nil {
+		if err := container.SaveImageConfig(imageName, containerInfo.Config); err != nil {
+			log.Errorf("Save image %s config error %v", imageName, err)
+		}
+	}
+}
+
+// 生成 tar 的 --owner-map、--group-map 参数，映射文件放在临时目录中，用完后调用 cleanup 删除
+func tarIDMapArgs(dir string, containerInfo *container.ContainerInfo, oneFileSystem bool) ([]string, func(), error) {
+	owners, groups, err := container.TarIDMaps(dir, containerInfo.UidMaps, containerInfo.GidMaps, oneFileSystem)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpDir, err := ioutil.TempDir("", "mydocker-commit")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	ownerMap := filepath.Join(tmpDir, "owner-map")
+	groupMap := filepath.Join(tmpDir, "group-map")
+	if err := ioutil.WriteFile(ownerMap, owners, 0600); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(groupMap, groups, 0600); err != nil {
+		cleanup()
+		return nil, nil, err
 	}
+	return []string{"--owner-map=" + ownerMap, "--group-map=" + groupMap}, cleanup, nil
 }
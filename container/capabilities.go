@@ -0,0 +1,249 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// 能力名和编号，取值见 /usr/include/linux/capability.h
+var capabilityNumbers = map[string]uint{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// 容器默认拥有的能力，和 docker 相同
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// --cap-add、--cap-drop 中表示所有能力
+const AllCapabilities = "ALL"
+
+// 所有已知的能力，按编号排序
+func ListCapabilities() []string {
+	var caps []string
+	for name := range capabilityNumbers {
+		caps = append(caps, name)
+	}
+	sort.Slice(caps, func(i, j int) bool { return capabilityNumbers[caps[i]] < capabilityNumbers[caps[j]] })
+	return caps
+}
+
+// 能力名统一为大写并带 CAP_ 前缀，net_admin、NET_ADMIN、CAP_NET_ADMIN 都可以
+func normalizeCapability(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if name == AllCapabilities {
+		return name, nil
+	}
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	if _, ok := capabilityNumbers[name]; !ok {
+		return "", fmt.Errorf("unknown capability %q", name)
+	}
+	return name, nil
+}
+
+// 在 base 的基础上添加、去掉能力
+// drop 包含 ALL 时从空集开始，add 包含 ALL 时为所有能力；同一个能力同时在 add 和 drop 中时以 add 为准
+func TweakCapabilities(base, add, drop []string) ([]string, error) {
+	addSet := map[string]bool{}
+	for _, name := range add {
+		c, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		addSet[c] = true
+	}
+	dropSet := map[string]bool{}
+	for _, name := range drop {
+		c, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		dropSet[c] = true
+	}
+	if addSet[AllCapabilities] {
+		return ListCapabilities(), nil
+	}
+
+	caps := []string{}
+	seen := map[string]bool{}
+	if !dropSet[AllCapabilities] {
+		for _, c := range base {
+			if !dropSet[c] || addSet[c] {
+				caps = append(caps, c)
+				seen[c] = true
+			}
+		}
+	}
+	for _, c := range ListCapabilities() {
+		if addSet[c] && !seen[c] {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
+
+// prctl 参数，syscall 包中没有定义 ambient 相关的
+const (
+	prCapAmbient         = 47
+	prCapAmbientRaise    = 2
+	prCapAmbientClearAll = 4
+	linuxCapabilityV3    = 0x20080522
+)
+
+type capHeader struct {
+	Version uint32
+	Pid     int32
+}
+
+type capData struct {
+	Effective   uint32
+	Permitted   uint32
+	Inheritable uint32
+}
+
+// 宿主机内核支持的最大能力编号
+func lastCapability() uint {
+	content, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return capabilityNumbers["CAP_AUDIT_READ"]
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return capabilityNumbers["CAP_AUDIT_READ"]
+	}
+	return uint(last)
+}
+
+// 切换用户并把进程的能力限制为 caps（bounding、effective、permitted、inheritable、ambient）
+// 能力是线程级别的，调用后当前 goroutine 固定在这个线程上，之后的 exec、fork 都从这个线程发起
+// 切换到非 root 用户时内核会清空能力，所以先设置 keepcaps，切换用户后再设置能力
+func setUserAndCapabilities(u *execUser, caps []string) error {
+	runtime.LockOSThread()
+	if caps == nil {
+		// 没有记录能力的旧容器，保持原来的行为
+		return setUser(u)
+	}
+
+	// 只能保留当前拥有的能力，mydocker 自己运行在受限的环境中时（例如嵌套在其他容器中）可能没有所有能力
+	header := capHeader{Version: linuxCapabilityV3}
+	data := [2]capData{}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget error %v", errno)
+	}
+	last := lastCapability()
+	keep := map[uint]bool{}
+	var mask [2]uint32
+	for _, name := range caps {
+		n, ok := capabilityNumbers[name]
+		if !ok || n > last || data[n/32].Permitted&(1<<(n%32)) == 0 {
+			continue
+		}
+		keep[n] = true
+		mask[n/32] |= 1 << (n % 32)
+	}
+
+	for n := uint(0); n <= last; n++ {
+		if keep[n] {
+			continue
+		}
+		if err := prctl(syscall.PR_CAPBSET_DROP, uintptr(n), 0); err != nil {
+			return fmt.Errorf("drop bounding capability %d error %v", n, err)
+		}
+	}
+
+	if err := prctl(syscall.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("set keepcaps error %v", err)
+	}
+	if err := setUser(u); err != nil {
+		return err
+	}
+	if err := prctl(syscall.PR_SET_KEEPCAPS, 0, 0); err != nil {
+		return fmt.Errorf("clear keepcaps error %v", err)
+	}
+
+	for i := range data {
+		data[i] = capData{Effective: mask[i], Permitted: mask[i], Inheritable: mask[i]}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset error %v", errno)
+	}
+
+	// ambient 能力让非 root 用户 exec 之后依然拥有这些能力
+	if err := prctl(prCapAmbient, prCapAmbientClearAll, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities error %v", err)
+	}
+	for n := range keep {
+		if err := prctl(prCapAmbient, prCapAmbientRaise, uintptr(n)); err != nil {
+			return fmt.Errorf("raise ambient capability %d error %v", n, err)
+		}
+	}
+	return nil
+}
+
+func prctl(option int, arg2, arg3 uintptr) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, uintptr(option), arg2, arg3); errno != 0 {
+		return errno
+	}
+	return nil
+}
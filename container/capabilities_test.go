@@ -0,0 +1,41 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTweakCapabilities(t *testing.T) {
+	base := []string{"CAP_CHOWN", "CAP_KILL", "CAP_NET_RAW"}
+	tests := []struct {
+		add, drop []string
+		expect    []string
+	}{
+		{nil, nil, base},
+		{[]string{"net_admin"}, []string{"NET_RAW"}, []string{"CAP_CHOWN", "CAP_KILL", "CAP_NET_ADMIN"}},
+		{[]string{"CAP_KILL"}, []string{"kill"}, base},
+		{[]string{"SYS_ADMIN", "sys_admin"}, []string{"ALL"}, []string{"CAP_SYS_ADMIN"}},
+		{nil, []string{"all"}, []string{}},
+	}
+	for _, test := range tests {
+		caps, err := TweakCapabilities(base, test.add, test.drop)
+		if err != nil {
+			t.Fatalf("tweak capabilities add %v drop %v error %v", test.add, test.drop, err)
+		}
+		if !reflect.DeepEqual(caps, test.expect) {
+			t.Errorf("tweak capabilities add %v drop %v got %v, expect %v", test.add, test.drop, caps, test.expect)
+		}
+	}
+
+	caps, err := TweakCapabilities(base, []string{"ALL"}, nil)
+	if err != nil {
+		t.Fatalf("tweak capabilities error %v", err)
+	}
+	if len(caps) != len(capabilityNumbers) || caps[0] != "CAP_CHOWN" {
+		t.Errorf("add ALL got %v", caps)
+	}
+
+	if _, err := TweakCapabilities(base, []string{"NET_FOO"}, nil); err == nil {
+		t.Errorf("unknown capability should fail")
+	}
+}
@@ -2,7 +2,7 @@ package container
 
 import (
 	"fmt"
-	log "github.com/Sirupsen/logrus"
+	"net"
 	"os"
 	"os/exec"
 	"syscall"
@@ -12,9 +12,12 @@ var (
 	RUNNING             string = "running"
 	STOP                string = "stopped"
 	Exit                string = "exited"
-	DefaultInfoLocation string = "/var/run/mydocker/%s/" // 容器信息存放目录
-	ConfigName          string = "config.json"           // 容器基本信息文件
-	ContainerLogFile    string = "container.log"         // 容器日志文件
+	DefaultInfoLocation string = "/var/run/mydocker/%s/"     // 容器信息存放目录
+	ConfigName          string = "config.json"               // 容器基本信息文件
+	ContainerLogFile    string = "container.log"             // 容器日志文件
+	ExecDirName         string = "exec"                      // exec 会话信息存放目录，在容器信息目录下
+	DefaultPodLocation  string = "/var/run/mydocker/pod/%s/" // pod 信息存放目录
+	Created             string = "created"
 	RootUrl             string = "/root"
 	MntUrl              string = "/root/mnt/%s"        // 挂载点 （cd /mnt/name就可以进入被挂载的目录）
 	WriteLayerUrl       string = "/root/writeLayer/%s" // 容器可写层存放目录
@@ -22,39 +25,108 @@ var (
 
 // 容器基本信息
 type ContainerInfo struct {
-	Pid         string   `json:"pid"`         //容器的init进程在宿主机上的 PID
-	Id          string   `json:"id"`          //容器Id
-	Name        string   `json:"name"`        //容器名
-	Command     string   `json:"command"`     //容器内init运行命令
-	CreatedTime string   `json:"createTime"`  //创建时间
-	Status      string   `json:"status"`      //容器的状态
-	Volume      string   `json:"volume"`      //容器的数据卷
-	PortMapping []string `json:"portmapping"` //端口映射
+	Pid               string            `json:"pid"`               //容器的init进程在宿主机上的 PID
+	Id                string            `json:"id"`                //容器Id
+	Name              string            `json:"name"`              //容器名
+	Command           string            `json:"command"`           //容器内init运行命令
+	CreatedTime       string            `json:"createTime"`        //创建时间
+	Status            string            `json:"status"`            //容器的状态
+	Volume            string            `json:"volume"`            //容器的数据卷
+	PortMapping       []string          `json:"portmapping"`       //端口映射
+	Network           string            `json:"network"`           //连接的网络，为空时没有连接网络
+	IPAddress         net.IP            `json:"ip"`                //连接到网络时分配的 IP，删除容器时释放
+	Image             string            `json:"image"`             //镜像名
+	Labels            map[string]string `json:"labels"`            //容器标签
+	LogConfig         *LogConfig        `json:"logConfig"`         //日志驱动配置，为空时只写日志文件
+	Config            *ImageConfig      `json:"config"`            //容器实际使用的配置，commit 时作为新镜像的配置
+	Env               []string          `json:"env"`               //容器进程的全部环境变量，exec 时复用
+	Rlimits           []Rlimit          `json:"rlimits"`           //--ulimit 资源限制，exec 的进程同样使用
+	Hostname          string            `json:"hostname"`          //主机名
+	Domainname        string            `json:"domainname"`        //NIS 域名
+	Dns               []string          `json:"dns"`               //--dns
+	DnsSearch         []string          `json:"dnsSearch"`         //--dns-search
+	DnsOptions        []string          `json:"dnsOptions"`        //--dns-option
+	ExtraHosts        []string          `json:"extraHosts"`        //--add-host
+	ShmSize           int64             `json:"shmSize"`           ///dev/shm 的大小（字节）
+	SecurityOpt       []string          `json:"securityOpt"`       //--security-opt
+	MaskedPaths       []string          `json:"maskedPaths"`       //容器内屏蔽的路径
+	ReadonlyPaths     []string          `json:"readonlyPaths"`     //容器内只读的路径
+	ReadonlyRootfs    bool              `json:"readonlyRootfs"`    //--read-only，根目录只读
+	Tmpfs             []string          `json:"tmpfs"`             //--tmpfs 挂载，<容器内路径>[:<参数>]
+	Devices           []Device          `json:"devices"`           //--device 添加的设备
+	DeviceCgroupRules []string          `json:"deviceCgroupRules"` //--device-cgroup-rule
+	Capabilities      []string          `json:"capabilities"`      //容器进程的能力，exec 的进程同样使用
+	Privileged        bool              `json:"privileged"`        //--privileged
+	Seccomp           *SeccompProfile   `json:"seccomp"`           //容器使用的 seccomp 配置，exec 的进程同样使用
+	Userns            string            `json:"userns"`            //--userns
+	UidMaps           []IDMap           `json:"uidMaps"`           //user 命名空间的 uid 映射，为空时不使用 user 命名空间
+	GidMaps           []IDMap           `json:"gidMaps"`           //user 命名空间的 gid 映射
+	NoNewPrivileges   bool              `json:"noNewPrivileges"`   //no-new-privileges，exec 的进程同样使用
+	Namespaces        *Namespaces       `json:"namespaces"`        //各个命名空间的模式
+	Pod               string            `json:"pod"`               //所属的 pod，为空时不在 pod 中
+	Secrets           []SecretReference `json:"secrets"`           //--secret 挂载的 secret，不包含内容
+}
+
+// exec 会话信息，保存在 /var/run/mydocker/<容器名>/exec/<ID>.json
+type ExecInfo struct {
+	ID         string   `json:"id"`         //exec 会话 ID
+	Container  string   `json:"container"`  //容器名
+	Args       []string `json:"args"`       //执行的指令
+	Env        []string `json:"env"`        //环境变量
+	Cwd        string   `json:"cwd"`        //工作目录
+	User       string   `json:"user"`       //运行用户
+	Tty        bool     `json:"tty"`        //是否分配了伪终端
+	Detach     bool     `json:"detach"`     //是否后台运行
+	Pid        int      `json:"pid"`        //用户进程在宿主机上的 PID
+	Status     string   `json:"status"`     //created/running/exited
+	ExitCode   int      `json:"exitCode"`   //退出码，启动失败时为 125/126/127
+	StartedAt  string   `json:"startedAt"`  //开始时间
+	FinishedAt string   `json:"finishedAt"` //结束时间
+}
+
+// 日志驱动配置
+type LogConfig struct {
+	Type   string            `json:"type"`   //日志驱动名 syslog/gelf/fluentd
+	Config map[string]string `json:"config"` //--log-opt 指定的驱动参数
 }
 
 // 创建容器进程
-func NewParentProcess(tty bool, containerName, volume, imageName string, envSlice []string) (*exec.Cmd, *os.File) {
+// 返回的 writePipe 用于发送 init 配置，syncPipe 用于读取 init 初始化过程中的错误
+// namespaces 决定创建哪些新的命名空间，uidMaps、gidMaps 不为空时容器进程在新的 user 命名空间中
+func NewParentProcess(tty bool, containerName, volume, imageName string, namespaces *Namespaces, uidMaps, gidMaps []IDMap) (*exec.Cmd, *os.File, *os.File, error) {
 	// 创建管道
 	readPipe, writePipe, err := NewPipe()
 	if err != nil {
-		log.Errorf("New pipe error %v", err)
-		return nil, nil
+		return nil, nil, nil, fmt.Errorf("New pipe error %v", err)
+	}
+	// 同步管道，init 出错时写入错误，exec 用户进程成功后自动关闭
+	syncPipe, childSyncPipe, err := NewPipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("New sync pipe error %v", err)
 	}
 
 	// 获取自身进程
 	//1.这里的/proc/self/exe 调用，其中/proc/self指的是当前运行进程自己的环境，exec其实就是自己调用了自己，我们使用这种方式实现对创建出来的进程进行初始化
 	initCmd, err := os.Readlink("/proc/self/exe") // 代表当前程序
 	if err != nil {
-		log.Errorf("get init process error %v", err)
-		return nil, nil
+		return nil, nil, nil, fmt.Errorf("get init process error %v", err)
 	}
 
 	//2.后面args是参数，其中 init 是传递给本进程的第一个参数，这在本例子中，其实就是会去调用我们的 initCommand 去初始化进程的一些环境和资源
 	cmd := exec.Command(initCmd, "init") // 这是容器进程的init
 	//3. 下面的clone 参数就是去 fork 出来的一个新进程，并且使用了namespace隔离新创建的进程和外部的环境。
+	// 默认创建新的 UTS、PID、MNT、NET、IPC 命名空间，使用宿主机或者加入其它容器的命名空间时不创建
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+		Cloneflags: namespaces.CloneFlags(),
+	}
+	// 同时创建的其它命名空间都属于新的 user 命名空间，容器内的 root 只在这些命名空间中有特权
+	// 切换为容器内的 root 后再 exec，否则 exec 之后就没有能力了
+	if len(uidMaps) > 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = SysProcIDMaps(uidMaps)
+		cmd.SysProcAttr.GidMappings = SysProcIDMaps(gidMaps)
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
 	}
 
 	if tty {
@@ -64,26 +136,32 @@ func NewParentProcess(tty bool, containerName, volume, imageName string, envSlic
 		cmd.Stderr = os.Stderr
 	} else {
 		dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
-		// 创建目录
-		if err := os.MkdirAll(dirURL, 0622); err != nil {
-			log.Errorf("NewParentProcess mkdir %s error %v", dirURL, err)
-			return nil, nil
+		// 创建目录，rootless 模式下普通用户需要能进入这个目录
+		if err := os.MkdirAll(dirURL, 0700); err != nil {
+			return nil, nil, nil, fmt.Errorf("NewParentProcess mkdir %s error %v", dirURL, err)
 		}
 
 		stdLogFilePath := dirURL + ContainerLogFile  // 容器日志文件路径
 		stdLogFile, err := os.Create(stdLogFilePath) // 创建文件
 		if err != nil {
-			log.Errorf("NewParentProcess create file %s error %v", stdLogFilePath, err)
-			return nil, nil
+			return nil, nil, nil, fmt.Errorf("NewParentProcess create file %s error %v", stdLogFilePath, err)
 		}
 		cmd.Stdout = stdLogFile // 重定向标准输入到日志文件
 	}
 
-	cmd.ExtraFiles = []*os.File{readPipe}          // 设置读管道
-	cmd.Env = append(os.Environ(), envSlice...)    // 给新进程设置环境变量
-	NewWorkSpace(volume, imageName, containerName) // 为当前容器创建 AUFS文件系统，挂载目录
-	cmd.Dir = fmt.Sprintf(MntUrl, containerName)   // 挂载点路径
-	return cmd, writePipe
+	// init 进程不继承宿主机的环境变量，用户进程的环境变量完全由 init 配置指定
+	cmd.Env = []string{}
+	// fd 3 为 init 配置管道，fd 4 为同步管道
+	cmd.ExtraFiles = []*os.File{readPipe, childSyncPipe}
+	// 为当前容器创建 AUFS文件系统，挂载目录，失败时 NewWorkSpace 已经删除了创建的目录
+	if err := NewWorkSpace(volume, imageName, containerName, uidMaps, gidMaps); err != nil {
+		for _, f := range []*os.File{readPipe, writePipe, syncPipe, childSyncPipe} {
+			f.Close()
+		}
+		return nil, nil, nil, err
+	}
+	cmd.Dir = ContainerMntUrl(containerName, uidMaps, gidMaps) // 挂载点路径
+	return cmd, writePipe, syncPipe, nil
 }
 
 // 管道参考： https://blog.schwarzeni.com/2020/07/05/Golang-%E4%B8%AD%E7%9A%84-Pipe-%E4%BD%BF%E7%94%A8/
@@ -0,0 +1,348 @@
+package container
+
+import (
+	"fmt"
+	"github.com/xianlubird/mydocker/cgroups/subsystems"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// /dev/shm 的默认大小，和 docker 相同
+const DefaultShmSize int64 = 64 * 1024 * 1024
+
+// 容器中的设备文件
+type Device struct {
+	Path        string `json:"path"`     // 容器内的路径
+	HostPath    string `json:"hostPath"` // --device 指定的宿主机上的设备
+	Type        uint32 `json:"type"`     // syscall.S_IFCHR 或 syscall.S_IFBLK
+	Major       int64  `json:"major"`
+	Minor       int64  `json:"minor"`
+	Mode        uint32 `json:"mode"` // 文件权限
+	Uid         uint32 `json:"uid"`
+	Gid         uint32 `json:"gid"`
+	Permissions string `json:"permissions"` // devices cgroup 中允许的访问，r、w、m 的组合
+}
+
+// 容器中默认创建的设备文件
+var DefaultDevices = []Device{
+	{Path: "/dev/null", Type: syscall.S_IFCHR, Major: 1, Minor: 3, Mode: 0666},
+	{Path: "/dev/zero", Type: syscall.S_IFCHR, Major: 1, Minor: 5, Mode: 0666},
+	{Path: "/dev/full", Type: syscall.S_IFCHR, Major: 1, Minor: 7, Mode: 0666},
+	{Path: "/dev/random", Type: syscall.S_IFCHR, Major: 1, Minor: 8, Mode: 0666},
+	{Path: "/dev/urandom", Type: syscall.S_IFCHR, Major: 1, Minor: 9, Mode: 0666},
+	{Path: "/dev/tty", Type: syscall.S_IFCHR, Major: 5, Minor: 0, Mode: 0666},
+}
+
+// /dev 下指向 /proc 的符号链接
+var devSymlinks = [][2]string{
+	{"/proc/self/fd", "/dev/fd"},
+	{"/proc/self/fd/0", "/dev/stdin"},
+	{"/proc/self/fd/1", "/dev/stdout"},
+	{"/proc/self/fd/2", "/dev/stderr"},
+	{"pts/ptmx", "/dev/ptmx"},
+}
+
+// 初始化容器的 /dev，在 pivot_root 之前调用，这样在 user 命名空间中还可以 bind mount 宿主机的设备
+// 1. /dev 为 tmpfs，创建默认的设备文件和符号链接
+// 2. /dev/pts 使用独立的 devpts 实例（newinstance），容器内打开 /dev/ptmx 分配的伪终端和宿主机互不可见
+// 3. /dev/shm 为指定大小的 tmpfs，/dev/mqueue 为 POSIX 消息队列
+// 4. 创建 --device 指定的设备文件
+func setupDev(rootfs string, shmSize int64, devices []Device) error {
+	dev, err := resolveInRoot(rootfs, "/dev")
+	if err != nil {
+		return fmt.Errorf("resolve /dev error %v", err)
+	}
+	if err := mountAt("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return err
+	}
+
+	// user 命名空间中不能 mknod，只能 bind mount 宿主机上的设备文件
+	create := createDevice
+	userns := runningInUserNS()
+	if userns {
+		create = bindDevice
+	}
+
+	// 设备文件的权限不受 umask 影响
+	oldMask := syscall.Umask(0)
+	defer syscall.Umask(oldMask)
+	for _, d := range DefaultDevices {
+		path, err := devicePath(rootfs, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := create(d, path); err != nil {
+			return err
+		}
+	}
+
+	// rootless 模式下只映射了当前用户时 tty 组（gid 5）在命名空间中不存在，不能指定为伪终端的属组
+	ptsData := "newinstance,ptmxmode=0666,mode=0620,gid=5"
+	if userns {
+		if _, ok := HostID(5, procIDMaps("/proc/self/gid_map")); !ok {
+			ptsData = "newinstance,ptmxmode=0666,mode=0620"
+		}
+	}
+	if err := mountAt("devpts", filepath.Join(dev, "pts"), "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, ptsData); err != nil {
+		return err
+	}
+	for _, link := range devSymlinks {
+		path, err := devicePath(rootfs, link[1])
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link[0], path); err != nil {
+			return fmt.Errorf("create symlink %s error %v", link[1], err)
+		}
+	}
+
+	if shmSize <= 0 {
+		shmSize = DefaultShmSize
+	}
+	if err := mountAt("shm", filepath.Join(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, fmt.Sprintf("mode=1777,size=%d", shmSize)); err != nil {
+		return err
+	}
+	if err := mountAt("mqueue", filepath.Join(dev, "mqueue"), "mqueue", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		path, err := devicePath(rootfs, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("create dir for device %s error %v", d.Path, err)
+		}
+		// 和默认设备同名时替换掉默认的，bind mount 的设备需要先卸载
+		if userns {
+			syscall.Unmount(path, syscall.MNT_DETACH)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s error %v", d.Path, err)
+		}
+		if err := create(d, path); err != nil {
+			return err
+		}
+		// bind mount 的设备修改属主会修改宿主机上的设备文件
+		if userns {
+			continue
+		}
+		if err := os.Chown(path, int(d.Uid), int(d.Gid)); err != nil {
+			return fmt.Errorf("chown device %s error %v", d.Path, err)
+		}
+	}
+	return nil
+}
+
+// 设备文件在宿主机上的路径，父目录按 rootfs 解析符号链接，设备文件本身是符号链接时直接替换掉，不跟随
+func devicePath(rootfs, path string) (string, error) {
+	dir, err := resolveInRoot(rootfs, filepath.Dir(path))
+	if err != nil {
+		return "", fmt.Errorf("resolve device path %s error %v", path, err)
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// 创建目录作为挂载点，挂载点是符号链接时报错，避免挂载到 rootfs 之外
+func createMountDir(target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("create mount point %s error %v", target, err)
+	}
+	info, err := os.Lstat(target)
+	if err != nil {
+		return fmt.Errorf("create mount point %s error %v", target, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("mount point %s is a symbolic link", target)
+	}
+	return nil
+}
+
+// 创建挂载点并挂载，出错时返回带挂载点的错误
+func mountAt(source, target, fstype string, flags uintptr, data string) error {
+	if err := createMountDir(target); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("mount %s on %s error %v", fstype, target, err)
+	}
+	return nil
+}
+
+// 只读 bind mount 宿主机的 /sys，remount 时需要保留宿主机上 /sys 锁定的 nosuid、nodev、noexec
+func bindSysfs(target string, flags uintptr) error {
+	if err := createMountDir(target); err != nil {
+		return err
+	}
+	if err := syscall.Mount("/sys", target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount /sys on %s error %v", target, err)
+	}
+	if err := syscall.Mount(target, target, "", flags|syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount %s read-only error %v", target, err)
+	}
+	return nil
+}
+
+func createDevice(d Device, path string) error {
+	dev := int(((d.Major & 0xfff) << 8) | ((d.Major &^ 0xfff) << 32) | (d.Minor & 0xff) | ((d.Minor &^ 0xff) << 12))
+	if err := syscall.Mknod(path, d.Type|d.Mode, dev); err != nil {
+		return fmt.Errorf("mknod %s error %v", d.Path, err)
+	}
+	return nil
+}
+
+// 创建空文件作为挂载点，把宿主机上的设备 bind mount 过来
+func bindDevice(d Device, path string) error {
+	source := d.HostPath
+	if source == "" {
+		source = d.Path
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("create mount point for device %s error %v", d.Path, err)
+	}
+	f.Close()
+	if err := syscall.Mount(source, path, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount device %s error %v", d.Path, err)
+	}
+	return nil
+}
+
+// 解析 --device，格式为 <宿主机路径>[:<容器内路径>][:<权限>]，权限默认为 rwm
+// 宿主机路径为目录时（例如 /dev/snd）添加目录下的所有设备
+func ParseDevice(value string) ([]Device, error) {
+	parts := strings.Split(value, ":")
+	hostPath, containerPath, permissions := parts[0], parts[0], "rwm"
+	switch len(parts) {
+	case 1:
+	case 2:
+		// 第二部分是合法的权限时作为权限，否则作为容器内路径
+		if subsystems.ValidDeviceAccess(parts[1]) {
+			permissions = parts[1]
+		} else {
+			containerPath = parts[1]
+		}
+	case 3:
+		containerPath, permissions = parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid device %q", value)
+	}
+	if !filepath.IsAbs(hostPath) || !filepath.IsAbs(containerPath) {
+		return nil, fmt.Errorf("invalid device %q, device path must be absolute", value)
+	}
+	if !subsystems.ValidDeviceAccess(permissions) {
+		return nil, fmt.Errorf("invalid device %q, invalid permissions %q", value, permissions)
+	}
+
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return nil, fmt.Errorf("error gathering device information while adding device %q: %v", hostPath, err)
+	}
+	if !info.IsDir() {
+		d, err := deviceFromFile(hostPath, info)
+		if err != nil {
+			return nil, err
+		}
+		d.Path = filepath.Clean(containerPath)
+		d.Permissions = permissions
+		return []Device{d}, nil
+	}
+
+	var devices []Device
+	err = filepath.Walk(hostPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeDevice == 0 {
+			return err
+		}
+		d, err := deviceFromFile(path, info)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(hostPath, path)
+		d.Path = filepath.Join(containerPath, rel)
+		d.Permissions = permissions
+		devices = append(devices, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no device found in %q", hostPath)
+	}
+	return devices, nil
+}
+
+// 宿主机 /dev 下的所有设备，--privileged 时全部添加到容器中
+// /dev/pts、/dev/shm、/dev/mqueue 在容器中有自己的挂载，跳过
+func HostDevices() ([]Device, error) {
+	var devices []Device
+	err := filepath.Walk("/dev", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (path == "/dev/pts" || path == "/dev/shm" || path == "/dev/mqueue") {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeDevice == 0 {
+			return nil
+		}
+		d, err := deviceFromFile(path, info)
+		if err != nil {
+			return err
+		}
+		d.Path = path
+		d.Permissions = "rwm"
+		devices = append(devices, d)
+		return nil
+	})
+	return devices, err
+}
+
+func deviceFromFile(path string, info os.FileInfo) (Device, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 {
+		return Device{}, fmt.Errorf("%q is not a device node", path)
+	}
+	d := Device{
+		HostPath: path,
+		Type:     syscall.S_IFBLK,
+		Major:    int64(((stat.Rdev >> 8) & 0xfff) | ((stat.Rdev >> 32) &^ 0xfff)),
+		Minor:    int64((stat.Rdev & 0xff) | ((stat.Rdev >> 12) &^ 0xff)),
+		Mode:     uint32(info.Mode().Perm()),
+		Uid:      stat.Uid,
+		Gid:      stat.Gid,
+	}
+	if info.Mode()&os.ModeCharDevice != 0 {
+		d.Type = syscall.S_IFCHR
+	}
+	return d, nil
+}
+
+// 解析 --shm-size 等大小参数，支持 b、k、m、g 单位（1024 进制），没有单位时为字节
+func ParseSize(value string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "b")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,35 @@
+package container
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect int64
+	}{
+		{"1024", 1024},
+		{"100b", 100},
+		{"64k", 64 << 10},
+		{"128m", 128 << 20},
+		{"128M", 128 << 20},
+		{"1g", 1 << 30},
+		{"2gb", 2 << 30},
+	}
+	for _, test := range tests {
+		size, err := ParseSize(test.value)
+		if err != nil {
+			t.Fatalf("parse size %s error %v", test.value, err)
+		}
+		if size != test.expect {
+			t.Errorf("parse size %s got %d, expect %d", test.value, size, test.expect)
+		}
+	}
+
+	for _, value := range []string{"", "m", "abc", "-1m", "1.5g", "10t"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("parse size %s should fail", value)
+		}
+	}
+}
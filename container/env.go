@@ -0,0 +1,68 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 容器的默认环境变量，不继承宿主机的任何环境变量
+// hostname 为空时不设置 HOSTNAME，tty 时设置 TERM
+func DefaultEnv(hostname string, tty bool) []string {
+	env := []string{"PATH=" + DefaultPathEnv}
+	if hostname != "" {
+		env = append(env, "HOSTNAME="+hostname)
+	}
+	if tty {
+		env = append(env, "TERM=xterm")
+	}
+	return env
+}
+
+// 解析 -e 参数，KEY=VALUE 原样使用，只有 KEY 时使用宿主机上同名变量的值，宿主机上没有时忽略
+func ParseEnv(values []string, lookup func(string) (string, bool)) ([]string, error) {
+	var env []string
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		name := kv[0]
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid environment variable %q", value)
+		}
+		if len(kv) == 2 {
+			env = append(env, value)
+			continue
+		}
+		if v, ok := lookup(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env, nil
+}
+
+// 读取 --env-file，每行一个 KEY=VALUE 或 KEY，忽略空行和 # 开头的注释
+func ReadEnvFile(path string, lookup func(string) (string, bool)) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var values []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 只去掉行首的空白，值中的空白原样保留
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	env, err := ParseEnv(values, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return env, nil
+}
@@ -0,0 +1,61 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func testLookup(name string) (string, bool) {
+	if name == "HOST_VAR" {
+		return "from host", true
+	}
+	return "", false
+}
+
+func TestDefaultEnv(t *testing.T) {
+	env := DefaultEnv("abc", true)
+	expect := []string{"PATH=" + DefaultPathEnv, "HOSTNAME=abc", "TERM=xterm"}
+	if !reflect.DeepEqual(env, expect) {
+		t.Fatalf("expect %v, got %v", expect, env)
+	}
+	if env := DefaultEnv("", false); !reflect.DeepEqual(env, []string{"PATH=" + DefaultPathEnv}) {
+		t.Fatalf("unexpected env %v", env)
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	env, err := ParseEnv([]string{"A=1", "B=", "HOST_VAR", "MISSING", "C=x=y"}, testLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"A=1", "B=", "HOST_VAR=from host", "C=x=y"}
+	if !reflect.DeepEqual(env, expect) {
+		t.Fatalf("expect %v, got %v", expect, env)
+	}
+	for _, value := range []string{"=1", "A B=1"} {
+		if _, err := ParseEnv([]string{value}, testLookup); err == nil {
+			t.Errorf("parse env %q should fail", value)
+		}
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "envfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\nA=1\n  B=two words \nHOST_VAR\nMISSING\n")
+	f.Close()
+
+	env, err := ReadEnvFile(f.Name(), testLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"A=1", "B=two words ", "HOST_VAR=from host"}
+	if !reflect.DeepEqual(env, expect) {
+		t.Fatalf("expect %v, got %v", expect, env)
+	}
+}
@@ -0,0 +1,57 @@
+package container
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// mydocker exec 在容器中执行指令
+// nsenter 的 cgo 代码已经在 go runtime 启动前加入了容器的命名空间，这里从管道读取要执行的指令，然后 exec 替换自己
+// 成功时不会返回，失败时把错误通过同步管道报告给 mydocker exec
+func RunContainerExecProcess() error {
+	syncPipe := openSyncPipe()
+	defer syncPipe.Close()
+	err := execInContainer()
+	WriteInitError(syncPipe, err)
+	return err
+}
+
+func execInContainer() error {
+	spec, err := readInitSpec()
+	if err != nil {
+		return err
+	}
+
+	if err := setRlimits(spec.Rlimits); err != nil {
+		return err
+	}
+
+	// 和 init 不同，exec 不会创建不存在的工作目录
+	cwd := spec.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	if err := syscall.Chdir(cwd); err != nil {
+		return fmt.Errorf("chdir to working dir %s error %v", cwd, err)
+	}
+
+	user, err := lookupUser(spec.User)
+	if err != nil {
+		return err
+	}
+	spec.Env = withHomeEnv(spec.Env, user.Home)
+
+	path, err := lookPath(spec.Args[0], spec.Env)
+	if err != nil {
+		return err
+	}
+
+	if err := applySecurity(user, spec); err != nil {
+		return err
+	}
+
+	if err := syscall.Exec(path, spec.Args, spec.Env); err != nil {
+		return execError(spec.Args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package container
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// 解析路径时最多跟随的符号链接数，和内核的 MAXSYMLINKS 相同
+	maxSymlinks = 40
+	// PAX 扩展头中保存 xattr 的 key 前缀
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// 压缩格式的文件头，和 tar -xf 一样根据文件头自动识别，commit 生成的镜像是 gzip 压缩的
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// 在进程内把镜像 tar 包解压到 dest，uidMaps、gidMaps 不为空时把属主映射为宿主机上对应的 ID
+// 所有路径都限制在 dest 之内: 包含 .. 越界的条目直接报错，路径中的符号链接以 dest 为根解析，写文件时不跟随符号链接
+// 先解压到 dest 旁边的临时目录，完整解压后再改名，解压失败时删除临时目录，不会留下解压了一半的目录
+func ExtractImage(tarPath, dest string, uidMaps, gidMaps []IDMap) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("open image %s error %v", tarPath, err)
+	}
+	defer f.Close()
+
+	dest = filepath.Clean(dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("mkdir %s error %v", filepath.Dir(dest), err)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest)+"-")
+	if err != nil {
+		return fmt.Errorf("create temp dir for %s error %v", dest, err)
+	}
+	e := &tarExtractor{root: tmpDir, uidMaps: uidMaps, gidMaps: gidMaps, inUserNS: runningInUserNS()}
+	r, err := decompress(f)
+	if err == nil {
+		err = e.extract(r)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("extract image %s error %v", tarPath, err)
+	}
+	if err := os.Rename(tmpDir, dest); err != nil {
+		os.RemoveAll(tmpDir)
+		// 同时启动的容器已经解压好了同一个镜像
+		if exist, _ := PathExists(dest); exist {
+			return nil
+		}
+		return fmt.Errorf("rename %s to %s error %v", tmpDir, dest, err)
+	}
+	return nil
+}
+
+// 镜像文件是压缩过的 tar 包时返回解压后的内容，否则原样返回
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, bzip2Magic):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(head, xzMagic):
+		return xz.NewReader(br)
+	}
+	return br, nil
+}
+
+type tarExtractor struct {
+	root     string
+	uidMaps  []IDMap
+	gidMaps  []IDMap
+	inUserNS bool        // 在 user 命名空间中时，没有映射的 ID 无法 chown
+	dirs     []tarDirent // 目录的权限和时间在所有条目解压完后再设置，避免只读目录中无法创建文件
+}
+
+type tarDirent struct {
+	path   string
+	header *tar.Header
+}
+
+func (e *tarExtractor) extract(r io.Reader) error {
+	// tar 包中没有根目录的条目时，根目录和 tar 一样为 0755，属主为容器内的 root
+	if err := e.chown(e.root, 0, 0); err != nil {
+		return err
+	}
+	if err := os.Chmod(e.root, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := e.extractEntry(tr, hdr); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+	for _, dir := range e.dirs {
+		if err := e.setMetadata(dir.path, dir.header); err != nil {
+			return fmt.Errorf("%s: %v", dir.header.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *tarExtractor) extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	switch hdr.Typeflag {
+	case tar.TypeXGlobalHeader:
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		// 镜像中的设备文件不解压，容器的 /dev 由 init 创建，只包含允许的设备
+		log.Warnf("Skip device file %s in image", hdr.Name)
+		return nil
+	}
+
+	path, err := e.resolve(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if err := e.prepare(path, hdr.Typeflag == tar.TypeDir); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		e.dirs = append(e.dirs, tarDirent{path: path, header: hdr})
+		return nil
+	case tar.TypeReg:
+		// O_EXCL | O_NOFOLLOW: prepare 已经删除了原来的文件，这里不会通过符号链接写到其它地方
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// 链接的目标原样保存，解压时解析路径会把它限制在根目录中
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := e.resolve(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(target)
+		if err != nil {
+			return fmt.Errorf("hard link target %s error %v", hdr.Linkname, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("hard link target %s is a directory", hdr.Linkname)
+		}
+		// 硬链接和目标是同一个 inode，不需要再设置属性
+		return os.Link(target, path)
+	case tar.TypeFifo:
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+	return e.setMetadata(path, hdr)
+}
+
+// 条目在根目录中的路径: 条目名中的 .. 不能超出根目录，父目录中的符号链接以根目录为根解析，最后一级不解析
+func (e *tarExtractor) resolve(name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path %s escapes the image root", name)
+	}
+	if rel == "." {
+		return e.root, nil
+	}
+	dir, err := resolveInRoot(e.root, filepath.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(rel)), nil
+}
+
+// 把 root 为根目录的路径解析为宿主机上的路径，结果一定在 root 之内
+// 逐级解析，遇到符号链接时把链接目标和剩下的部分重新解析，绝对路径的目标从根目录开始，.. 最多回到根目录
+// 解压镜像和 init 在 pivot_root 之前挂载时都用它处理镜像中的符号链接
+func resolveInRoot(root, dir string) (string, error) {
+	current := ""
+	pending := strings.Split(dir, "/")
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if current = filepath.Dir(current); current == "." {
+				current = ""
+			}
+			continue
+		}
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			current = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", dir)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = ""
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, current), nil
+}
+
+// 创建条目的父目录，删除路径上已有的文件，已有的目录只有在新条目也是目录时保留
+func (e *tarExtractor) prepare(path string, isDir bool) error {
+	if path == e.root {
+		if !isDir {
+			return fmt.Errorf("image root must be a directory")
+		}
+		return nil
+	}
+	if err := e.mkdirParents(filepath.Dir(path)); err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isDir && info.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// tar 包中没有的父目录和 tar 一样创建为 0755，属主为容器内的 root
+// dir 已经由 resolve 解析过，其中已存在的部分都是目录而不是符号链接
+func (e *tarExtractor) mkdirParents(dir string) error {
+	rel, err := filepath.Rel(e.root, dir)
+	if err != nil {
+		return err
+	}
+	current := e.root
+	for _, part := range strings.Split(rel, "/") {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", current)
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Mkdir(current, 0755); err != nil {
+			return err
+		}
+		if err := e.chown(current, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 设置属主、权限、xattr 和修改时间
+// 顺序不能变: chown 会清除 setuid、setgid 位和 security.capability，所以 chmod 和设置 xattr 都在 chown 之后
+func (e *tarExtractor) setMetadata(path string, hdr *tar.Header) error {
+	if err := e.chown(path, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := syscall.Chmod(path, uint32(hdr.Mode&07777)); err != nil {
+			return err
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := lsetxattr(path, attr, []byte(value)); err != nil {
+			if err == syscall.EPERM || err == syscall.ENOTSUP {
+				log.Warnf("Set xattr %s on %s error %v", attr, hdr.Name, err)
+				continue
+			}
+			return fmt.Errorf("set xattr %s error %v", attr, err)
+		}
+	}
+	// 符号链接的时间不设置，os.Chtimes 会跟随链接
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return os.Chtimes(path, atime, hdr.ModTime)
+}
+
+// 按映射修改属主，没有映射的 ID 保持不变
+// rootless 模式的 user 命名空间中通常只映射了当前用户，镜像中其它 ID 的文件无法 chown，这时保留为容器内的 root
+func (e *tarExtractor) chown(path string, uid, gid int) error {
+	if hostUID, ok := HostID(uid, e.uidMaps); ok {
+		uid = hostUID
+	}
+	if hostGID, ok := HostID(gid, e.gidMaps); ok {
+		gid = hostGID
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		if perr, ok := err.(*os.PathError); ok && e.inUserNS && (perr.Err == syscall.EINVAL || perr.Err == syscall.EPERM) {
+			log.Debugf("Chown %s to %d:%d error %v, keep the current owner", path, uid, gid, perr.Err)
+			return nil
+		}
+		return fmt.Errorf("chown error %v", err)
+	}
+	return nil
+}
+
+// syscall 包中没有 lsetxattr，符号链接上的 xattr 需要不跟随链接设置
+func lsetxattr(path, attr string, value []byte) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrPtr, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(attrPtr)),
+		uintptr(valuePtr), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// 测试用的 tar 条目，Typeflag 为 0 时是普通文件
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+	mode     int64
+}
+
+func writeTestTar(t *testing.T, dir string, entries []testEntry) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     entry.mode,
+			Size:     int64(len(entry.content)),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte(entry.content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tarPath := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(tarPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tarPath
+}
+
+func TestExtractImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mydocker-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tarPath := writeTestTar(t, dir, []testEntry{
+		{name: "./", typeflag: tar.TypeDir, mode: 0755},
+		{name: "bin/", typeflag: tar.TypeDir, mode: 0555},
+		{name: "bin/sh", content: "#!", mode: 04755},
+		{name: "bin/bash", typeflag: tar.TypeLink, linkname: "bin/sh"},
+		{name: "usr/lib/libc.so", content: "elf"},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "/usr/lib"},
+		{name: "lib/libm.so", content: "libm"},
+		{name: "dev/null", typeflag: tar.TypeChar},
+		{name: "run/fifo", typeflag: tar.TypeFifo},
+	})
+	dest := filepath.Join(dir, "image")
+	if err := ExtractImage(tarPath, dest, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dest, "bin")); err != nil || info.Mode().Perm() != 0555 {
+		t.Errorf("bin dir %v %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "bin/sh")); err != nil || info.Mode()&os.ModeSetuid == 0 || info.Mode().Perm() != 0755 {
+		t.Errorf("bin/sh %v %v", info, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dest, "bin/bash")); err != nil || string(content) != "#!" {
+		t.Errorf("hard link bin/bash got %q %v", content, err)
+	}
+	// 符号链接的目标原样保存，通过它写入的文件在根目录中
+	if target, err := os.Readlink(filepath.Join(dest, "lib")); err != nil || target != "/usr/lib" {
+		t.Errorf("symlink lib got %q %v", target, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dest, "usr/lib/libm.so")); err != nil || string(content) != "libm" {
+		t.Errorf("file through symlink got %q %v", content, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "dev/null")); !os.IsNotExist(err) {
+		t.Errorf("device file should be skipped, got %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "run/fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo %v %v", info, err)
+	}
+}
+
+func TestExtractImageConfined(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mydocker-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := ioutil.WriteFile(outside, []byte("host"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		entries []testEntry
+		err     bool
+		escaped string // 解压后应该在根目录中的文件
+	}{
+		{[]testEntry{{name: "../outside", content: "evil"}}, true, ""},
+		{[]testEntry{{name: "etc/../../outside", content: "evil"}}, true, ""},
+		{[]testEntry{{name: "link", typeflag: tar.TypeLink, linkname: "../outside"}}, true, ""},
+		{[]testEntry{{name: "up", typeflag: tar.TypeSymlink, linkname: "../../.."}, {name: "up/outside", content: "evil"}}, false, "outside"},
+		{[]testEntry{{name: "abs", typeflag: tar.TypeSymlink, linkname: dir}, {name: "abs/outside", content: "evil"}}, false, dir + "/outside"},
+		// 已有的符号链接会被替换，不会通过它写到目标文件
+		{[]testEntry{{name: "f", typeflag: tar.TypeSymlink, linkname: outside}, {name: "f", content: "evil"}}, false, "f"},
+		{[]testEntry{{name: "/outside", content: "evil"}}, false, "outside"},
+		{[]testEntry{{name: "dir", typeflag: tar.TypeDir, mode: 0755}, {name: "hl", typeflag: tar.TypeLink, linkname: "dir"}}, true, ""},
+		{[]testEntry{{name: ".", content: "evil"}}, true, ""},
+	}
+	for i, test := range tests {
+		tarPath := writeTestTar(t, dir, test.entries)
+		dest := filepath.Join(dir, "image")
+		err := ExtractImage(tarPath, dest, nil, nil)
+		if (err != nil) != test.err {
+			t.Errorf("test %d extract error %v, expect error %v", i, err, test.err)
+		}
+		if content, _ := ioutil.ReadFile(outside); string(content) != "host" {
+			t.Fatalf("test %d overwrote file outside root: %q", i, content)
+		}
+		if test.err {
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("test %d left extracted dir after error", i)
+			}
+		} else if content, err := ioutil.ReadFile(filepath.Join(dest, test.escaped)); err != nil || string(content) != "evil" {
+			t.Errorf("test %d file %s in root got %q %v", i, test.escaped, content, err)
+		}
+		os.RemoveAll(dest)
+	}
+}
+
+func TestExtractImageMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mydocker-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tarPath := writeTestTar(t, dir, []testEntry{{name: "a", content: "aaaa"}, {name: "b", content: "bbbbbbbb"}})
+	content, err := ioutil.ReadFile(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 截断在第二个文件的内容中间，以及不是 tar 格式的文件
+	for i, broken := range [][]byte{content[:512*3+4], bytes.Repeat([]byte("x"), 1024)} {
+		if err := ioutil.WriteFile(tarPath, broken, 0600); err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(dir, "image")
+		if err := ExtractImage(tarPath, dest, nil, nil); err == nil {
+			t.Errorf("test %d extract malformed archive should fail", i)
+		}
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) != 1 {
+			t.Errorf("test %d left files after error: %d entries in %s", i, len(files), dir)
+		}
+	}
+}
+
+func TestExtractImageRemapped(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to chown")
+	}
+	dir, err := ioutil.TempDir("", "mydocker-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000})
+	tw.WriteHeader(&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+	tarPath := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(tarPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	maps := []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	dest := filepath.Join(dir, "image")
+	if err := ExtractImage(tarPath, dest, maps, maps); err != nil {
+		t.Fatal(err)
+	}
+	// 没有条目的父目录 etc 也属于容器内的 root
+	for path, uid := range map[string]int{".": 100000, "etc": 100000, "etc/passwd": 100000, "home": 101000} {
+		info, err := os.Lstat(filepath.Join(dest, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if int(st.Uid) != uid || int(st.Gid) != uid {
+			t.Errorf("owner of %s got %d:%d, expect %d", path, st.Uid, st.Gid, uid)
+		}
+	}
+}
+
+func TestExtractImageGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mydocker-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// commit 生成的镜像是 tar -czf 打包的
+	tarPath := writeTestTar(t, dir, []testEntry{{name: "etc/hostname", content: "web"}})
+	content, err := ioutil.ReadFile(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(content)
+	gw.Close()
+	if err := ioutil.WriteFile(tarPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "image")
+	if err := ExtractImage(tarPath, dest, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dest, "etc/hostname")); err != nil || string(content) != "web" {
+		t.Errorf("file in gzip image got %q %v", content, err)
+	}
+
+	// 截断的 gzip 同样不能留下解压了一半的目录
+	os.RemoveAll(dest)
+	if err := ioutil.WriteFile(tarPath, buf.Bytes()[:buf.Len()/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractImage(tarPath, dest, nil, nil); err == nil {
+		t.Errorf("extract truncated gzip image should fail")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("truncated gzip image left extracted dir")
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mydocker-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "rootfs")
+	os.MkdirAll(filepath.Join(root, "usr/lib"), 0755)
+	os.MkdirAll(filepath.Join(root, "var/run"), 0755)
+	os.Symlink("/tmp", filepath.Join(root, "etc"))
+	os.Symlink("../../../../tmp", filepath.Join(root, "run"))
+	os.Symlink("/var/run", filepath.Join(root, "usr/run"))
+	os.Symlink("/etc/hostname", filepath.Join(root, "usr/lib/hostname"))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/etc/hosts", "/tmp/hosts"},
+		{"/run/secrets", "/tmp/secrets"},
+		{"/../../var/run", "/var/run"},
+		{"/usr/run/lock", "/var/run/lock"},
+		{"/usr/lib/hostname", "/tmp/hostname"},
+		{"/usr/lib", "/usr/lib"},
+	}
+	for _, test := range tests {
+		got, err := resolveInRoot(root, test.path)
+		if err != nil {
+			t.Errorf("resolveInRoot(%s) error %v", test.path, err)
+			continue
+		}
+		if want := filepath.Join(root, test.want); got != want {
+			t.Errorf("resolveInRoot(%s) = %s, want %s", test.path, got, want)
+		}
+	}
+
+	os.Symlink("loop", filepath.Join(root, "loop"))
+	if _, err := resolveInRoot(root, "/loop/file"); err == nil {
+		t.Errorf("resolveInRoot should fail on symlink loop")
+	}
+}
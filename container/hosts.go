@@ -0,0 +1,149 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// 容器内由 mydocker 生成并 bind mount 的文件，生成的文件放在容器信息目录下
+var (
+	HostnameFile   = "hostname"
+	HostsFile      = "hosts"
+	ResolvConfFile = "resolv.conf"
+)
+
+// --add-host 中表示宿主机的特殊值，解析为容器所在网络的网关地址
+const HostGateway = "host-gateway"
+
+// 宿主机没有可用的 DNS 服务器时使用的默认值
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// 宿主机使用 systemd-resolved 时，/etc/resolv.conf 中是只能在宿主机上访问的 127.0.0.53
+const (
+	hostResolvConf     = "/etc/resolv.conf"
+	resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// 解析 --add-host name:ip，ip 可以是 host-gateway
+func ParseExtraHost(value string) (string, string, error) {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("invalid add-host %q, expect name:ip", value)
+	}
+	name, ip := kv[0], kv[1]
+	if ip != HostGateway && net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid IP address %q in add-host %q", ip, value)
+	}
+	return name, ip, nil
+}
+
+// 生成 /etc/hosts，ip 为空（没有连接网络）时不添加容器自己的记录
+// extraHosts 为 name:ip 格式，host-gateway 已经替换成了网关地址
+func BuildHosts(hostname, domainname string, ip net.IP, extraHosts []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("127.0.0.1\tlocalhost\n")
+	buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	buf.WriteString("fe00::0\tip6-localnet\n")
+	buf.WriteString("ff00::0\tip6-mcastprefix\n")
+	buf.WriteString("ff02::1\tip6-allnodes\n")
+	buf.WriteString("ff02::2\tip6-allrouters\n")
+	for _, host := range extraHosts {
+		kv := strings.SplitN(host, ":", 2)
+		if len(kv) == 2 {
+			fmt.Fprintf(&buf, "%s\t%s\n", kv[1], kv[0])
+		}
+	}
+	if ip != nil {
+		if domainname != "" {
+			fmt.Fprintf(&buf, "%s\t%s.%s %s\n", ip, hostname, domainname, hostname)
+		} else {
+			fmt.Fprintf(&buf, "%s\t%s\n", ip, hostname)
+		}
+	}
+	return buf.Bytes()
+}
+
+// 读取宿主机的 resolv.conf
+func ReadHostResolvConf() ([]byte, error) {
+	content, err := ioutil.ReadFile(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(content, []byte("nameserver 127.0.0.53")) {
+		if resolved, err := ioutil.ReadFile(resolvedResolvConf); err == nil {
+			return resolved, nil
+		}
+	}
+	return content, nil
+}
+
+// 根据宿主机的 resolv.conf 生成容器的 resolv.conf
+// 指定了 --dns、--dns-search、--dns-option 时分别替换宿主机的配置
+// 容器有自己的网络命名空间，宿主机上的本地地址（127.0.0.0/8、::1）在容器中无法访问，需要去掉
+func BuildResolvConf(hostConf []byte, dns, search, options []string) []byte {
+	var hostNameservers, hostSearch, hostOptions []string
+	scanner := bufio.NewScanner(bytes.NewReader(hostConf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+				hostNameservers = append(hostNameservers, fields[1])
+			}
+		case "search", "domain":
+			// 后出现的 search/domain 覆盖前面的
+			hostSearch = fields[1:]
+		case "options":
+			hostOptions = append(hostOptions, fields[1:]...)
+		}
+	}
+
+	nameservers := hostNameservers
+	if len(dns) > 0 {
+		nameservers = dns
+	}
+	if len(nameservers) == 0 {
+		nameservers = defaultNameservers
+	}
+	if len(search) > 0 {
+		// --dns-search . 表示不设置 search
+		hostSearch = nil
+		for _, s := range search {
+			if s != "." {
+				hostSearch = append(hostSearch, s)
+			}
+		}
+	}
+	if len(options) > 0 {
+		hostOptions = options
+	}
+
+	var buf bytes.Buffer
+	for _, ns := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if len(hostSearch) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(hostSearch, " "))
+	}
+	if len(hostOptions) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(hostOptions, " "))
+	}
+	return buf.Bytes()
+}
+
+// 写入生成的文件，并返回把它 bind mount 到容器中的挂载配置
+func WriteBindFile(dir, name, dest string, content []byte) (Mount, error) {
+	path := dir + name
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return Mount{}, fmt.Errorf("write %s error %v", path, err)
+	}
+	return Mount{Source: path, Destination: dest, Type: "bind", Flags: syscall.MS_BIND}, nil
+}
@@ -0,0 +1,66 @@
+package container
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseExtraHost(t *testing.T) {
+	tests := []struct {
+		value string
+		name  string
+		ip    string
+	}{
+		{"db:10.0.0.2", "db", "10.0.0.2"},
+		{"v6host:fe80::1", "v6host", "fe80::1"},
+		{"host.docker.internal:host-gateway", "host.docker.internal", HostGateway},
+	}
+	for _, test := range tests {
+		name, ip, err := ParseExtraHost(test.value)
+		if err != nil || name != test.name || ip != test.ip {
+			t.Errorf("parse add-host %s got %s %s %v", test.value, name, ip, err)
+		}
+	}
+	for _, value := range []string{"db", ":1.2.3.4", "db:not-an-ip"} {
+		if _, _, err := ParseExtraHost(value); err == nil {
+			t.Errorf("parse add-host %s should fail", value)
+		}
+	}
+}
+
+func TestBuildHosts(t *testing.T) {
+	hosts := string(BuildHosts("abc", "example.com", net.ParseIP("192.168.0.2"), []string{"db:10.0.0.2"}))
+	expect := "127.0.0.1\tlocalhost\n" +
+		"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+		"fe00::0\tip6-localnet\n" +
+		"ff00::0\tip6-mcastprefix\n" +
+		"ff02::1\tip6-allnodes\n" +
+		"ff02::2\tip6-allrouters\n" +
+		"10.0.0.2\tdb\n" +
+		"192.168.0.2\tabc.example.com abc\n"
+	if hosts != expect {
+		t.Fatalf("unexpected hosts:\n%s", hosts)
+	}
+}
+
+func TestBuildResolvConf(t *testing.T) {
+	host := []byte("# generated\nnameserver 127.0.0.53\nnameserver 10.0.0.1\nsearch a.com b.com\noptions edns0\n")
+	tests := []struct {
+		host    []byte
+		dns     []string
+		search  []string
+		options []string
+		expect  string
+	}{
+		{host, nil, nil, nil, "nameserver 10.0.0.1\nsearch a.com b.com\noptions edns0\n"},
+		{host, []string{"1.1.1.1"}, []string{"c.com"}, []string{"ndots:2"}, "nameserver 1.1.1.1\nsearch c.com\noptions ndots:2\n"},
+		{host, nil, []string{"."}, nil, "nameserver 10.0.0.1\noptions edns0\n"},
+		// 宿主机只有本地 DNS 时使用默认值
+		{[]byte("nameserver 127.0.0.1\nnameserver ::1\n"), nil, nil, nil, "nameserver 8.8.8.8\nnameserver 8.8.4.4\n"},
+	}
+	for _, test := range tests {
+		if conf := string(BuildResolvConf(test.host, test.dns, test.search, test.options)); conf != test.expect {
+			t.Errorf("unexpected resolv.conf:\n%s\nexpect:\n%s", conf, test.expect)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// 镜像配置，保存在镜像文件旁边: /root/<image>.json
+// 镜像本身只是 rootfs 的 tar 包，默认执行的指令、环境变量、工作目录等都记录在这里
+type ImageConfig struct {
+	Entrypoint   []string            `json:"entrypoint,omitempty"`
+	Cmd          []string            `json:"cmd,omitempty"`
+	Env          []string            `json:"env,omitempty"`
+	WorkingDir   string              `json:"workingDir,omitempty"`
+	User         string              `json:"user,omitempty"`
+	ExposedPorts map[string]struct{} `json:"exposedPorts,omitempty"` // 例如 {"80/tcp": {}}
+	Volumes      map[string]struct{} `json:"volumes,omitempty"`      // 例如 {"/data": {}}
+	StopSignal   string              `json:"stopSignal,omitempty"`   // 例如 SIGQUIT
+}
+
+// 镜像配置文件路径
+func ImageConfigPath(imageName string) string {
+	return RootUrl + "/" + imageName + ".json"
+}
+
+// 读取镜像配置，没有配置文件的镜像返回空配置
+func LoadImageConfig(imageName string) (*ImageConfig, error) {
+	config := &ImageConfig{}
+	content, err := ioutil.ReadFile(ImageConfigPath(imageName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid image config %s: %v", ImageConfigPath(imageName), err)
+	}
+	return config, nil
+}
+
+// 保存镜像配置
+func SaveImageConfig(imageName string, config *ImageConfig) error {
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ImageConfigPath(imageName), content, 0644)
+}
+
+// 按 docker 的规则合并镜像配置和命令行参数，返回容器实际使用的配置
+// entrypoint 为 nil 表示没有指定 --entrypoint；指定了 --entrypoint 时不再使用镜像的 Cmd，为空字符串时清空镜像的 Entrypoint
+// 最终执行的指令为 Entrypoint + Cmd，args 不为空时替换镜像的 Cmd
+func MergeImageConfig(image *ImageConfig, entrypoint *string, args []string, workdir string) *ImageConfig {
+	config := *image
+	if entrypoint != nil {
+		config.Entrypoint = nil
+		config.Cmd = nil
+		if *entrypoint != "" {
+			config.Entrypoint = []string{*entrypoint}
+		}
+	}
+	if len(args) > 0 {
+		config.Cmd = args
+	}
+	if workdir != "" {
+		config.WorkingDir = workdir
+	}
+	return &config
+}
+
+// 容器最终执行的指令
+func (c *ImageConfig) Args() []string {
+	var args []string
+	args = append(args, c.Entrypoint...)
+	return append(args, c.Cmd...)
+}
+
+// 合并环境变量，overrides 中的同名变量覆盖 base 中的
+// getenv 只会返回第一个同名变量，所以不能简单地拼接
+func MergeEnv(base []string, overrides ...[]string) []string {
+	var result []string
+	index := map[string]int{}
+	add := func(kv string) {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if i, ok := index[name]; ok {
+			result[i] = kv
+			return
+		}
+		index[name] = len(result)
+		result = append(result, kv)
+	}
+	for _, kv := range base {
+		add(kv)
+	}
+	for _, envs := range overrides {
+		for _, kv := range envs {
+			add(kv)
+		}
+	}
+	return result
+}
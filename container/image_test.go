@@ -0,0 +1,64 @@
+package container
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestMergeImageConfig(t *testing.T) {
+	image := &ImageConfig{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		WorkingDir: "/app",
+	}
+	empty := ""
+	sh := "/bin/sh"
+	cases := []struct {
+		entrypoint *string
+		args       []string
+		workdir    string
+		expectArgs []string
+		expectDir  string
+	}{
+		// 使用镜像的 Entrypoint + Cmd
+		{nil, nil, "", []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"}, "/app"},
+		// 命令行参数替换 Cmd
+		{nil, []string{"nginx", "-t"}, "/tmp", []string{"/docker-entrypoint.sh", "nginx", "-t"}, "/tmp"},
+		// --entrypoint 会清空镜像的 Cmd
+		{&sh, nil, "", []string{"/bin/sh"}, "/app"},
+		{&sh, []string{"-c", "echo a b"}, "", []string{"/bin/sh", "-c", "echo a b"}, "/app"},
+		// --entrypoint "" 清空 Entrypoint
+		{&empty, []string{"ls"}, "", []string{"ls"}, "/app"},
+	}
+	for _, c := range cases {
+		config := MergeImageConfig(image, c.entrypoint, c.args, c.workdir)
+		if !reflect.DeepEqual(config.Args(), c.expectArgs) || config.WorkingDir != c.expectDir {
+			t.Fatalf("merge %v %v: got %q %s", c.entrypoint, c.args, config.Args(), config.WorkingDir)
+		}
+	}
+	// 不能修改镜像配置本身
+	if len(image.Cmd) != 3 || image.WorkingDir != "/app" {
+		t.Fatalf("image config modified: %+v", image)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	env := MergeEnv([]string{"PATH=/bin", "A=1"}, []string{"A=2", "B="}, []string{"PATH=/usr/bin"})
+	expect := []string{"PATH=/usr/bin", "A=2", "B="}
+	if !reflect.DeepEqual(env, expect) {
+		t.Fatalf("expect %v, got %v", expect, env)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, name := range []string{"SIGQUIT", "quit", "3"} {
+		sig, err := ParseSignal(name)
+		if err != nil || sig != syscall.SIGQUIT {
+			t.Fatalf("parse %s got %v %v", name, sig, err)
+		}
+	}
+	if _, err := ParseSignal("SIGNOPE"); err == nil {
+		t.Fatalf("expect error for invalid signal")
+	}
+}
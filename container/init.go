@@ -3,78 +3,287 @@ package container
 import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 )
 
 // 容器初始化
+// 初始化失败时把错误通过同步管道报告给父进程，由 mydocker run 输出错误并设置退出码
 func RunContainerInitProcess() error {
-	// 从管道读取执行指令
-	cmdArray := readUserCommand() // 例： ["/bin/sh"]  or ["ls", "-a"]  todo 验证
-	if cmdArray == nil || len(cmdArray) == 0 {
-		return fmt.Errorf("Run container get user command error, cmdArray is nil")
+	syncPipe := openSyncPipe()
+	defer syncPipe.Close()
+	err := initContainer(syncPipe)
+	log.Errorf("Init container error %v", err)
+	WriteInitError(syncPipe, err)
+	return err
+}
+
+// 完成容器初始化并执行用户指令，成功时不会返回
+func initContainer(syncPipe *os.File) error {
+	// 从管道读取 init 配置，包括执行指令、环境变量、工作目录等
+	spec, err := readInitSpec()
+	if err != nil {
+		return err
+	}
+
+	// 父进程发送 init 配置之前已经把容器进程加入了容器的 cgroup，这时创建的 cgroup 命名空间以容器的 cgroup 为根
+	// 命名空间是线程级别的，之后的 exec 需要在同一个线程中进行
+	if spec.CgroupNS {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil {
+			return fmt.Errorf("unshare cgroup namespace error %v", err)
+		}
+	}
+	// 容器的 time 命名空间由 init 自己创建，exec 之后用户进程才进入这个命名空间
+	if len(spec.TimeOffsets) > 0 {
+		if err := unshareTimeNamespace(spec.TimeOffsets); err != nil {
+			return err
+		}
+	}
+
+	if err := setUpMount(spec); err != nil {
+		return err
+	}
+
+	if spec.Hostname != "" {
+		if err := syscall.Sethostname([]byte(spec.Hostname)); err != nil {
+			return fmt.Errorf("set hostname %s error %v", spec.Hostname, err)
+		}
+	}
+	if spec.Domainname != "" {
+		if err := syscall.Setdomainname([]byte(spec.Domainname)); err != nil {
+			return fmt.Errorf("set domainname %s error %v", spec.Domainname, err)
+		}
+	}
+
+	if err := setRlimits(spec.Rlimits); err != nil {
+		return err
+	}
+
+	cwd := spec.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	// 工作目录不存在时在 rootfs 中创建
+	if err := os.MkdirAll(cwd, 0755); err != nil {
+		return fmt.Errorf("create working dir %s error %v", cwd, err)
+	}
+	if err := syscall.Chdir(cwd); err != nil {
+		return fmt.Errorf("chdir to working dir %s error %v", cwd, err)
+	}
+	// 工作目录等挂载点都创建好之后才能把根目录设为只读
+	if spec.ReadonlyRootfs {
+		if err := remountRootfsReadonly(); err != nil {
+			return err
+		}
 	}
 
-	setUpMount()
+	// 在容器 rootfs 中解析运行用户，没有设置 HOME 时使用用户的家目录
+	user, err := lookupUser(spec.User)
+	if err != nil {
+		return err
+	}
+	spec.Env = withHomeEnv(spec.Env, user.Home)
 
 	//第一个参数是可执行文件的路径，注意不会自动从PATH下面去搜索，所以：
 	//1.1 要么是显式的指定全路径：/path/to/executable
 	//1.2 要么是显式的指定相对路径: ./relpath/to/executable
-	//1.3 要么通过exec.LookPath从PATH里面搜索出来。
-	path, err := exec.LookPath(cmdArray[0]) // 在系统PATH中寻找命令的绝对路径，如果是不在系统path里的可执行文件呢？
+	//1.3 要么通过PATH搜索出来，这里使用的是用户进程的PATH，而不是init进程自己的
+	path, err := lookPath(spec.Args[0], spec.Env)
 	if err != nil {
-		log.Errorf("Exec loop path error %v", err)
 		return err
 	}
+
+	// 最后再切换用户和限制能力，之前的挂载、设置主机名等操作都需要 root 权限
+	if err := applySecurity(user, spec); err != nil {
+		return err
+	}
+
+	// 使用 --init 时 init 进程不 exec，而是作为 1 号进程 fork 用户进程并回收僵尸进程
+	if spec.Init {
+		return runTinyInit(path, spec, syncPipe)
+	}
+
 	// syscall.Exec参考： https://www.jianshu.com/p/e1de8fc52718
 	// 参考2： https://gobyexample-cn.github.io/execing-processes
-	// os.Environ() 环境变量
+	// 环境变量完全使用 init 配置中的，不继承 init 进程自己的环境变量
 	log.Infof("Find path %s", path)
-	if err := syscall.Exec(path, cmdArray[0:], os.Environ()); err != nil {
-		log.Errorf(err.Error())
+	if err := syscall.Exec(path, spec.Args, spec.Env); err != nil {
+		return execError(spec.Args[0], err)
 	}
 	return nil
 }
 
-// 获取管道进行读取
-func readUserCommand() []string {
-	// uintptr(3)就是指index为3的文件描述符，也就是传递进来的管道的一端
-	// 一个进程默认会有三个文件描述符 stdin stdout stderr（ ls /proc/self/fd 可以看到默认的文件描述符 ）
-	// cmd.ExtraFiles = []*os.File{readPipe} 设置后就成了第四个
-	pipe := os.NewFile(uintptr(3), "pipe")
-	defer pipe.Close()
-	msg, err := ioutil.ReadAll(pipe) // 会等待
+// 在用户进程的 PATH 中查找可执行文件
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		if err := findExecutable(file); err != nil {
+			return "", execError(file, err)
+		}
+		return file, nil
+	}
+	pathEnv := DefaultPathEnv
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			pathEnv = strings.TrimPrefix(kv, "PATH=")
+		}
+	}
+	var permErr error
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		err := findExecutable(path)
+		if err == nil {
+			return path, nil
+		}
+		if os.IsPermission(err) && permErr == nil {
+			permErr = err
+		}
+	}
+	// 找到了同名文件但不可执行时返回 126，否则返回 127
+	if permErr != nil {
+		return "", execError(file, permErr)
+	}
+	return "", newInitError(ExitCodeNotFound, "exec: %q: executable file not found in $PATH", file)
+}
+
+func findExecutable(file string) error {
+	d, err := os.Stat(file)
 	if err != nil {
-		log.Errorf("init read pipe error %v", err)
+		return err
+	}
+	if m := d.Mode(); !m.IsDir() && m&0111 != 0 {
 		return nil
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	return os.ErrPermission
+}
+
+// 设置资源限制
+func setRlimits(rlimits []Rlimit) error {
+	for _, r := range rlimits {
+		resource, ok := RlimitTypes[r.Type]
+		if !ok {
+			return fmt.Errorf("unknown rlimit type %s", r.Type)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: r.Soft, Max: r.Hard}); err != nil {
+			return fmt.Errorf("set rlimit %s error %v", r.Type, err)
+		}
+	}
+	return nil
 }
 
 /**
 Init 挂载点
 */
-func setUpMount() {
+func setUpMount(spec *InitSpec) error {
 	pwd, err := os.Getwd() // 获取当前路径，好像读的是cmd.Dir，挂载点路径 todo 验证
 	if err != nil {
 		log.Errorf("Get current location error %v", err)
-		return
+		return err
 	}
 	log.Infof("Current location is %s", pwd)
-	//挂载proc之前,先调用pivotRoot,把当前文件系统切换为pwd
-	pivotRoot(pwd)
 
-	//mount proc
+	// 把挂载传播类型设置为 private，避免容器内的挂载传播到宿主机
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("make / private error %v", err)
+	}
+
+	// proc、sysfs 在 pivot_root 之前挂载: user 命名空间中只有当前 mount 命名空间里已经有完整可见的 proc、sysfs 时才能挂载新的
+	// 挂载点按 rootfs 解析，镜像中的 /proc、/sys 是符号链接时不能挂载到宿主机上
+	procDir, err := resolveInRoot(pwd, "/proc")
+	if err != nil {
+		return fmt.Errorf("resolve /proc error %v", err)
+	}
+	sysDir, err := resolveInRoot(pwd, "/sys")
+	if err != nil {
+		return fmt.Errorf("resolve /sys error %v", err)
+	}
 	defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
-	// todo
-	syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), "")
-	// todo
-	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
+	if err := mountAt("proc", procDir, "proc", uintptr(defaultMountFlags), ""); err != nil {
+		return err
+	}
+	// sysfs 只读挂载，容器内不能通过 /sys 修改宿主机的内核和设备配置
+	if err := mountAt("sysfs", sysDir, "sysfs", uintptr(defaultMountFlags|syscall.MS_RDONLY), ""); err != nil {
+		// user 命名空间中只有拥有网络命名空间时才能挂载 sysfs，rootless 模式下使用宿主机网络时改为只读 bind mount 宿主机的 /sys
+		if !runningInUserNS() {
+			return err
+		}
+		if err := bindSysfs(sysDir, uintptr(defaultMountFlags)); err != nil {
+			return err
+		}
+	}
+	// 挂载 /dev，创建设备文件，user 命名空间中需要访问宿主机的设备，所以也在 pivot_root 之前
+	if err := setupDev(pwd, spec.ShmSize, spec.Devices); err != nil {
+		return err
+	}
+	// 宿主机上的路径在 pivot_root 之后就访问不到了，所以需要先挂载
+	for _, m := range spec.Mounts {
+		if err := mountInRootfs(pwd, m); err != nil {
+			return err
+		}
+	}
+
+	// 调用pivotRoot,把当前文件系统切换为pwd
+	if err := pivotRoot(pwd); err != nil {
+		return fmt.Errorf("pivot root %s error %v", pwd, err)
+	}
+
+	// 屏蔽时需要用到 /dev/null，所以在 /dev 之后
+	if err := maskPaths(spec.MaskedPaths); err != nil {
+		return err
+	}
+	return readonlyPaths(spec.ReadonlyPaths)
+}
+
+// 将挂载配置挂载到 rootfs 下对应的位置，挂载点不存在时自动创建
+// 这时还没有 pivot_root，挂载点按容器的根目录解析，镜像中的 /etc、/run 是指向宿主机路径的符号链接时也不会在宿主机上创建文件或者挂载
+func mountInRootfs(rootfs string, m Mount) error {
+	dest, err := resolveInRoot(rootfs, m.Destination)
+	if err != nil {
+		return fmt.Errorf("resolve mount point %s error %v", m.Destination, err)
+	}
+	if err := createMountPoint(m.Source, dest); err != nil {
+		return fmt.Errorf("create mount point %s error %v", m.Destination, err)
+	}
+	if err := syscall.Mount(m.Source, dest, m.Type, m.Flags, m.Data); err != nil {
+		return fmt.Errorf("mount %s to %s error %v", m.Source, m.Destination, err)
+	}
+	// bind mount 第一次挂载时会忽略只读等参数，需要再 remount 一次
+	if m.Flags&syscall.MS_BIND != 0 && m.Flags&^(syscall.MS_BIND|syscall.MS_REC) != 0 {
+		flags := m.Flags | syscall.MS_REMOUNT
+		if err := syscall.Mount("", dest, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s error %v", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// bind mount 文件时挂载点也要是文件，其他情况创建目录
+// dest 已经解析过符号链接，挂载点仍然是符号链接时说明 rootfs 在解析之后被修改了，直接报错
+func createMountPoint(source, dest string) error {
+	if info, err := os.Stat(source); err == nil && !info.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dest, os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	} else if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dest); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("mount point %s is a symbolic link", dest)
+	}
+	return nil
 }
 
 //这是一个系统调用,主要功能是改变当前的root文件系统,是吧整个系统切换到一个新的root中,移除对之前root的依赖
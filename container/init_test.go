@@ -0,0 +1,79 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLookPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "hello")
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "data"), []byte(""), 0644)
+
+	// 使用的是传入的 PATH，而不是当前进程的
+	path, err := lookPath("hello", []string{"A=B", "PATH=/nonexist:" + dir})
+	if err != nil || path != bin {
+		t.Fatalf("lookPath hello got %s %v", path, err)
+	}
+	// 找不到指令返回 127，不可执行返回 126
+	if _, err := lookPath("hello", []string{"PATH=/nonexist"}); exitCode(err) != ExitCodeNotFound {
+		t.Fatalf("expect not found error, got %v", err)
+	}
+	if _, err := lookPath(filepath.Join(dir, "data"), nil); exitCode(err) != ExitCodeNotExecutable {
+		t.Fatalf("expect not executable error, got %v", err)
+	}
+	if _, err := lookPath("data", []string{"PATH=" + dir}); exitCode(err) != ExitCodeNotExecutable {
+		t.Fatalf("expect not executable error, got %v", err)
+	}
+	if path, err := lookPath(bin, nil); err != nil || path != bin {
+		t.Fatalf("lookPath %s got %s %v", bin, path, err)
+	}
+}
+
+func exitCode(err error) int {
+	if e, ok := err.(*InitError); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestReadInitError(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	WriteInitError(w, fmt.Errorf("mount proc failed"))
+	w.Close()
+	err = ReadInitError(r)
+	if exitCode(err) != ExitCodeRuntime || err.Error() != "mount proc failed" {
+		t.Fatalf("unexpected init error %v", err)
+	}
+
+	// init exec 成功后管道直接关闭，没有错误
+	r, w, _ = os.Pipe()
+	w.Close()
+	if err := ReadInitError(r); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	// WaitStatus 低 7 位为结束进程的信号，正常退出时退出码在 8~15 位
+	if code := exitStatus(syscall.WaitStatus(3 << 8)); code != 3 {
+		t.Fatalf("expect exit code 3, got %d", code)
+	}
+	if code := exitStatus(syscall.WaitStatus(syscall.SIGKILL)); code != 137 {
+		t.Fatalf("expect exit code 137, got %d", code)
+	}
+}
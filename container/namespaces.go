@@ -0,0 +1,258 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 命名空间的模式，--pid、--ipc、--uts、--cgroupns 的取值
+const (
+	NamespaceHost            = "host"       // 使用宿主机的命名空间
+	NamespacePrivate         = "private"    // 创建新的命名空间
+	NamespaceShareable       = "shareable"  // 只用于 ipc，创建新的命名空间并允许其它容器加入
+	NamespaceContainerPrefix = "container:" // container:<name> 加入其它容器的命名空间
+	NamespacePodPrefix       = "pod:"       // pod:<name> 加入 pod 的命名空间，由 run --pod 设置
+
+	cloneNewTime = 0x80 // syscall 包中没有定义 CLONE_NEWTIME
+
+	// --ipc shareable 的容器和 pod 的 /dev/shm 在宿主机上挂载在信息目录下，加入它的 IPC 命名空间的容器 bind mount 同一个目录
+	shareableShmDir = "shm"
+)
+
+// 各个命名空间类型对应的 clone 参数，类型名和 /proc/<pid>/ns 下的文件名相同
+var namespaceFlags = map[string]uintptr{
+	"pid":    syscall.CLONE_NEWPID,
+	"ipc":    syscall.CLONE_NEWIPC,
+	"uts":    syscall.CLONE_NEWUTS,
+	"net":    syscall.CLONE_NEWNET,
+	"cgroup": syscall.CLONE_NEWCGROUP,
+	"time":   cloneNewTime,
+}
+
+// 容器各个命名空间的模式，mount 命名空间总是新建的
+// Pid、Ipc、Uts、Net 为空时创建新的命名空间，Cgroup 为空时使用宿主机的
+type Namespaces struct {
+	Pid         string       `json:"pid"`
+	Ipc         string       `json:"ipc"`
+	Uts         string       `json:"uts"`
+	Net         string       `json:"net"`         // host 或 private，由 --net 决定
+	Cgroup      string       `json:"cgroup"`      // host、private 或 container:<name>
+	TimeOffsets []TimeOffset `json:"timeOffsets"` // 不为空时创建新的 time 命名空间
+}
+
+// time 命名空间中时钟相对于宿主机的偏移
+type TimeOffset struct {
+	Clock  string        `json:"clock"` // monotonic 或 boottime
+	Offset time.Duration `json:"offset"`
+}
+
+// 需要加入的其它容器的命名空间
+type NamespaceJoin struct {
+	Type string // pid、ipc、uts、cgroup
+	Path string // /proc/<pid>/ns/<type>
+}
+
+// 校验 --pid、--ipc、--uts、--cgroupns 的取值，为空时返回默认值
+func ParseNamespaceMode(kind, value string) (string, error) {
+	switch {
+	case value == "" && kind == "cgroup":
+		return NamespaceHost, nil
+	case value == "":
+		return NamespacePrivate, nil
+	case value == NamespaceHost || value == NamespacePrivate:
+		return value, nil
+	case value == NamespaceShareable && kind == "ipc":
+		return value, nil
+	case NamespaceContainer(value) != "":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid %s mode %q", kind, value)
+}
+
+// container:<name> 模式中的容器名，其它模式返回空
+func NamespaceContainer(mode string) string {
+	if strings.HasPrefix(mode, NamespaceContainerPrefix) {
+		return strings.TrimPrefix(mode, NamespaceContainerPrefix)
+	}
+	return ""
+}
+
+// 模式为 private、shareable 或者没有指定时创建新的命名空间
+func newNamespace(mode string) bool {
+	return mode == "" || mode == NamespacePrivate || mode == NamespaceShareable
+}
+
+// 创建容器进程时的 clone 参数
+// cgroup 命名空间不在这里创建，init 在父进程把它加入容器的 cgroup 之后再创建，这样容器内看到的根 cgroup 就是容器自己的
+func (n *Namespaces) CloneFlags() uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS)
+	for _, ns := range []struct {
+		kind string
+		mode string
+	}{{"pid", n.Pid}, {"ipc", n.Ipc}, {"uts", n.Uts}, {"net", n.Net}} {
+		if newNamespace(ns.mode) {
+			flags |= namespaceFlags[ns.kind]
+		}
+	}
+	return flags
+}
+
+// 可以共享的 /dev/shm 在宿主机上的路径
+func ShareableShmPath(containerName string) string {
+	return filepath.Join(fmt.Sprintf(DefaultInfoLocation, containerName), shareableShmDir)
+}
+
+// 在宿主机上挂载可以共享的 /dev/shm，不同的 mount 命名空间之间不能 bind mount，容器从宿主机上的这个目录 bind mount
+func MountShm(shm string, size int64) error {
+	if size <= 0 {
+		size = DefaultShmSize
+	}
+	if err := os.MkdirAll(shm, 0700); err != nil {
+		return fmt.Errorf("create shm dir %s error %v", shm, err)
+	}
+	if err := syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, fmt.Sprintf("mode=1777,size=%d", size)); err != nil {
+		return fmt.Errorf("mount shm %s error %v", shm, err)
+	}
+	return nil
+}
+
+// 删除容器或 pod 的信息之前卸载可以共享的 /dev/shm，没有挂载时忽略
+func UnmountShm(shm string) {
+	unmountTmpfs(shm)
+}
+
+// 卸载宿主机上容器信息目录下挂载的 tmpfs，目录不存在或者没有挂载时忽略
+func unmountTmpfs(dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		log.Warnf("umount %s error %v", dir, err)
+	}
+}
+
+// 解析 --time-offset <clock>=<offset>，offset 为时长（例如 -1h、24h）或者秒数
+func ParseTimeOffset(value string) (TimeOffset, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || (parts[0] != "monotonic" && parts[0] != "boottime") {
+		return TimeOffset{}, fmt.Errorf("invalid time offset %q, should be monotonic=<offset> or boottime=<offset>", value)
+	}
+	if seconds, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+		return TimeOffset{Clock: parts[0], Offset: time.Duration(seconds) * time.Second}, nil
+	}
+	offset, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return TimeOffset{}, fmt.Errorf("invalid time offset %q: %v", value, err)
+	}
+	return TimeOffset{Clock: parts[0], Offset: offset}, nil
+}
+
+// /proc/<pid>/timens_offsets 的内容，每行为 <时钟> <秒> <纳秒>，纳秒不能为负数
+func timensOffsets(offsets []TimeOffset) []byte {
+	var buf bytes.Buffer
+	for _, o := range offsets {
+		sec := int64(o.Offset / time.Second)
+		nsec := int64(o.Offset % time.Second)
+		if nsec < 0 {
+			sec--
+			nsec += int64(time.Second)
+		}
+		fmt.Fprintf(&buf, "%s %d %d\n", o.Clock, sec, nsec)
+	}
+	return buf.Bytes()
+}
+
+// 启动容器进程，先在当前线程中加入 joins 中的命名空间，fork 出的容器进程继承这些命名空间
+// 加入 pid 命名空间只对之后创建的子进程生效，所以不能由容器进程自己加入
+// 在单独的 goroutine 中固定线程执行，启动后恢复线程原来的命名空间，恢复失败时线程随 goroutine 一起退出
+func StartInNamespaces(cmd *exec.Cmd, joins []NamespaceJoin) error {
+	if len(joins) == 0 {
+		return cmd.Start()
+	}
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		restored, err := startInNamespaces(cmd, joins)
+		if restored {
+			runtime.UnlockOSThread()
+		}
+		result <- err
+	}()
+	return <-result
+}
+
+func startInNamespaces(cmd *exec.Cmd, joins []NamespaceJoin) (bool, error) {
+	// 记录线程原来的命名空间
+	origins := map[string]*os.File{}
+	defer func() {
+		for _, f := range origins {
+			f.Close()
+		}
+	}()
+	for _, join := range joins {
+		f, err := os.Open("/proc/thread-self/ns/" + join.Type)
+		if err != nil {
+			return true, fmt.Errorf("open %s namespace error %v", join.Type, err)
+		}
+		origins[join.Type] = f
+	}
+
+	err := enterNamespaces(joins)
+	if err == nil {
+		err = cmd.Start()
+	}
+	for t, f := range origins {
+		if e := setns(f, t); e != nil {
+			if err == nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+			return false, fmt.Errorf("restore %s namespace error %v", t, e)
+		}
+	}
+	return true, err
+}
+
+func enterNamespaces(joins []NamespaceJoin) error {
+	for _, join := range joins {
+		f, err := os.Open(join.Path)
+		if err != nil {
+			return fmt.Errorf("open namespace %s error %v", join.Path, err)
+		}
+		err = setns(f, join.Type)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("join namespace %s error %v", join.Path, err)
+		}
+	}
+	return nil
+}
+
+// 创建新的 time 命名空间，当前进程之后 exec 或 fork 的进程才在这个命名空间中
+// 新的命名空间中还没有进程时才能设置偏移；/proc/self/timens_offsets 对应的是主线程，调用前需要把 goroutine 固定在主线程上
+func unshareTimeNamespace(offsets []TimeOffset) error {
+	if err := syscall.Unshare(cloneNewTime); err != nil {
+		return fmt.Errorf("unshare time namespace error %v", err)
+	}
+	if err := ioutil.WriteFile("/proc/self/timens_offsets", timensOffsets(offsets), 0644); err != nil {
+		return fmt.Errorf("set time namespace offsets error %v", err)
+	}
+	return nil
+}
+
+func setns(f *os.File, kind string) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), namespaceFlags[kind], 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
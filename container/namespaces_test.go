@@ -0,0 +1,75 @@
+package container
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseNamespaceMode(t *testing.T) {
+	tests := []struct {
+		kind, value string
+		expect      string
+		err         bool
+	}{
+		{"pid", "", NamespacePrivate, false},
+		{"cgroup", "", NamespaceHost, false},
+		{"uts", "host", NamespaceHost, false},
+		{"ipc", "shareable", NamespaceShareable, false},
+		{"pid", "shareable", "", true},
+		{"ipc", "container:web", "container:web", false},
+		{"pid", "container:", "", true},
+		{"uts", "none", "", true},
+	}
+	for _, test := range tests {
+		got, err := ParseNamespaceMode(test.kind, test.value)
+		if (err != nil) != test.err || got != test.expect {
+			t.Errorf("parse %s mode %q got %q %v, expect %q", test.kind, test.value, got, err, test.expect)
+		}
+	}
+	if got := NamespaceContainer("container:web"); got != "web" {
+		t.Errorf("namespace container got %q", got)
+	}
+}
+
+func TestCloneFlags(t *testing.T) {
+	tests := []struct {
+		namespaces Namespaces
+		expect     uintptr
+	}{
+		{Namespaces{}, syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET},
+		{Namespaces{Pid: "host", Ipc: "shareable", Uts: "container:web", Net: "host", Cgroup: "private"}, syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC},
+	}
+	for _, test := range tests {
+		if got := test.namespaces.CloneFlags(); got != test.expect {
+			t.Errorf("clone flags of %+v got %#x, expect %#x", test.namespaces, got, test.expect)
+		}
+	}
+}
+
+func TestParseTimeOffset(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect TimeOffset
+		err    bool
+	}{
+		{"monotonic=24h", TimeOffset{"monotonic", 24 * time.Hour}, false},
+		{"boottime=-90", TimeOffset{"boottime", -90 * time.Second}, false},
+		{"boottime=1.5s", TimeOffset{"boottime", 1500 * time.Millisecond}, false},
+		{"realtime=1h", TimeOffset{}, true},
+		{"monotonic", TimeOffset{}, true},
+		{"monotonic=abc", TimeOffset{}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseTimeOffset(test.value)
+		if (err != nil) != test.err || got != test.expect {
+			t.Errorf("parse time offset %q got %v %v, expect %v", test.value, got, err, test.expect)
+		}
+	}
+
+	offsets := []TimeOffset{{"monotonic", 24 * time.Hour}, {"boottime", -1500 * time.Millisecond}}
+	expect := "monotonic 86400 0\nboottime -2 500000000\n"
+	if got := string(timensOffsets(offsets)); got != expect {
+		t.Errorf("timens offsets got %q, expect %q", got, expect)
+	}
+}
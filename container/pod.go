@@ -0,0 +1,102 @@
+package container
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// pod 中的容器共享 infra 进程持有的网络、IPC、UTS 命名空间
+var podNamespaces = []string{"net", "ipc", "uts"}
+
+// pod 基本信息，保存在 /var/run/mydocker/pod/<pod名>/config.json
+type PodInfo struct {
+	Id           string   `json:"id"`           //pod ID
+	Name         string   `json:"name"`         //pod 名
+	Pid          string   `json:"pid"`          //infra 进程在宿主机上的 PID
+	CreatedTime  string   `json:"createTime"`   //创建时间
+	Hostname     string   `json:"hostname"`     //pod 中所有容器的主机名
+	Network      string   `json:"network"`      //网络，为空时只有 lo 网卡
+	IPAddress    net.IP   `json:"ip"`           //连接到网络时分配的 IP
+	Gateway      net.IP   `json:"gateway"`      //所在网络的网关
+	PortMapping  []string `json:"portmapping"`  //端口映射
+	ShmSize      int64    `json:"shmSize"`      //pod 中共享的 /dev/shm 的大小（字节）
+	CgroupParent string   `json:"cgroupParent"` //pod 的 cgroup，容器的 cgroup 创建在它下面
+}
+
+// pod 共享的 /dev/shm 在宿主机上的路径
+func PodShmPath(podName string) string {
+	return filepath.Join(fmt.Sprintf(DefaultPodLocation, podName), shareableShmDir)
+}
+
+// pod 中容器的 cgroup 路径
+func PodCgroupPath(pod *PodInfo, containerID string) string {
+	return filepath.Join(pod.CgroupParent, containerID)
+}
+
+// 加入 pod 的 infra 进程持有的命名空间
+func PodNamespaceJoins(pod *PodInfo) []NamespaceJoin {
+	var joins []NamespaceJoin
+	for _, kind := range podNamespaces {
+		joins = append(joins, NamespaceJoin{Type: kind, Path: fmt.Sprintf("/proc/%s/ns/%s", pod.Pid, kind)})
+	}
+	return joins
+}
+
+// 创建 pod 的 infra 进程，它只负责持有 pod 的命名空间，不需要 rootfs
+// 返回的 syncPipe 用于读取 infra 进程初始化过程中的错误，fd 3 为 infra 进程一端
+func NewPodInfraProcess(hostname string, hostNetwork bool) (*exec.Cmd, *os.File, error) {
+	syncPipe, childSyncPipe, err := NewPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("new sync pipe error %v", err)
+	}
+	cmd := exec.Command("/proc/self/exe", "pod-infra", hostname)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Setsid:     true,
+	}
+	if hostNetwork {
+		cmd.SysProcAttr.Cloneflags &^= syscall.CLONE_NEWNET
+	}
+	cmd.Dir = "/"
+	cmd.Env = []string{}
+	cmd.ExtraFiles = []*os.File{childSyncPipe}
+	return cmd, syncPipe, nil
+}
+
+// pod 的 infra 进程: 设置主机名、启动 lo 网卡后关闭同步管道，之后一直等待，直到收到 SIGTERM 或 SIGINT
+func RunPodInfra(hostname string) error {
+	syscall.CloseOnExec(3)
+	syncPipe := os.NewFile(uintptr(3), "sync")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	if err := setupPodInfra(hostname); err != nil {
+		WriteInitError(syncPipe, err)
+		syncPipe.Close()
+		return err
+	}
+	syncPipe.Close()
+	<-signals
+	return nil
+}
+
+func setupPodInfra(hostname string) error {
+	if err := syscall.Sethostname([]byte(hostname)); err != nil {
+		return fmt.Errorf("set hostname %s error %v", hostname, err)
+	}
+	// 新的网络命名空间中 lo 默认是关闭的，pod 中的容器需要通过 localhost 互相访问
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("find lo error %v", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("set lo up error %v", err)
+	}
+	return nil
+}
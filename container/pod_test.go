@@ -0,0 +1,32 @@
+package container
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestPodNamespaceJoins(t *testing.T) {
+	pod := &PodInfo{Name: "web", Pid: "1234", CgroupParent: "pod-0123456789"}
+	expect := []NamespaceJoin{
+		{Type: "net", Path: "/proc/1234/ns/net"},
+		{Type: "ipc", Path: "/proc/1234/ns/ipc"},
+		{Type: "uts", Path: "/proc/1234/ns/uts"},
+	}
+	if got := PodNamespaceJoins(pod); !reflect.DeepEqual(got, expect) {
+		t.Errorf("pod namespace joins got %v, expect %v", got, expect)
+	}
+	if got := PodCgroupPath(pod, "9876543210"); got != "pod-0123456789/9876543210" {
+		t.Errorf("pod cgroup path got %s", got)
+	}
+	if got := PodShmPath("web"); got != "/var/run/mydocker/pod/web/shm" {
+		t.Errorf("pod shm path got %s", got)
+	}
+
+	// pod 中的容器不创建网络、IPC、UTS 命名空间
+	mode := NamespacePodPrefix + "web"
+	ns := &Namespaces{Pid: NamespacePrivate, Ipc: mode, Uts: mode, Net: mode}
+	if got := ns.CloneFlags(); got != syscall.CLONE_NEWNS|syscall.CLONE_NEWPID {
+		t.Errorf("clone flags of pod container got %#x", got)
+	}
+}
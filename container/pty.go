@@ -0,0 +1,95 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// 终端窗口大小，对应 C 中的 struct winsize
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// 判断文件描述符是否是终端
+func IsTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	return ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
+
+// 判断文件描述符是否是当前进程的控制终端，只有控制终端才能设置前台进程组
+func isControllingTerminal(fd uintptr) bool {
+	var pgrp int32
+	return ioctl(fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))) == nil
+}
+
+// 创建一对伪终端，master 留在宿主机上读写，slave 作为容器内进程的标准输入输出
+func NewPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// unlockpt
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlock pty error %v", err)
+	}
+	// ptsname
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("get pty number error %v", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// 把终端设置为 raw 模式（同 cfmakeraw），按键原样发给容器内的进程，返回原来的设置用于恢复
+func SetRawTerminal(fd uintptr) (*syscall.Termios, error) {
+	var state syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&state))); err != nil {
+		return nil, err
+	}
+	raw := state
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// 恢复终端设置
+func RestoreTerminal(fd uintptr, state *syscall.Termios) error {
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(state)))
+}
+
+// 把终端 fd 的窗口大小同步给伪终端
+func ResizePty(master *os.File, fd uintptr) error {
+	var ws winsize
+	if err := ioctl(fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return err
+	}
+	return ioctl(master.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
@@ -0,0 +1,192 @@
+package container
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// 在 rootless 的 user 命名空间中运行时设置，子进程（log-forward 等）据此使用 rootless 的目录
+	RootlessEnv = "MYDOCKER_ROOTLESS"
+	// 使用 newuidmap 时，子进程等待父进程设置完映射后再重新执行自己
+	rootlessWaitEnv = "_MYDOCKER_ROOTLESS_WAIT"
+)
+
+// 是否以 rootless 模式运行: 非 root 用户执行，或者已经在 rootless 的 user 命名空间中
+func Rootless() bool {
+	return os.Geteuid() != 0 || os.Getenv(RootlessEnv) == "1"
+}
+
+// rootless 模式下容器状态放在 $XDG_RUNTIME_DIR/mydocker，镜像和容器的层放在 ~/.local/share/mydocker
+func SetupRootlessPaths() error {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return fmt.Errorf("XDG_RUNTIME_DIR needs to be set for rootless mode")
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return fmt.Errorf("HOME or XDG_DATA_HOME needs to be set for rootless mode")
+		}
+		dataHome = filepath.Join(home, ".local/share")
+	}
+
+	RootUrl = filepath.Join(dataHome, "mydocker")
+	MntUrl = RootUrl + "/mnt/%s"
+	WriteLayerUrl = RootUrl + "/writeLayer/%s"
+	RemappedRootUrl = RootUrl + "/%d.%d"
+	DefaultInfoLocation = filepath.Join(runtimeDir, "mydocker") + "/%s/"
+	DefaultPodLocation = filepath.Join(runtimeDir, "mydocker", "pod") + "/%s/"
+	DefaultSecretLocation = filepath.Join(dataHome, "mydocker-secrets") + "/%s/"
+	if err := os.MkdirAll(RootUrl, 0700); err != nil {
+		return fmt.Errorf("create rootless data dir %s error %v", RootUrl, err)
+	}
+	return nil
+}
+
+// 在新的 user 命名空间和 mount 命名空间中重新执行 mydocker，返回它的退出码
+// 当前用户映射为命名空间中的 root；/etc/subuid、/etc/subgid 中有当前用户的范围并且安装了 newuidmap、newgidmap 时，
+// 这些 ID 依次映射为 1、2、...，否则只映射当前用户一个 ID
+func RunInRootlessNamespace(args []string) (int, error) {
+	uidMaps, gidMaps, err := rootlessIDMaps()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command("/proc/self/exe", args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), RootlessEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS}
+
+	// 只有一个 ID 时非特权进程可以自己写映射，多个 ID 需要通过 setuid 的 newuidmap、newgidmap 写
+	var waitWrite *os.File
+	if len(uidMaps) == 1 && len(gidMaps) == 1 {
+		cmd.SysProcAttr.UidMappings = SysProcIDMaps(uidMaps)
+		cmd.SysProcAttr.GidMappings = SysProcIDMaps(gidMaps)
+	} else {
+		waitRead, w, err := os.Pipe()
+		if err != nil {
+			return 0, err
+		}
+		defer waitRead.Close()
+		waitWrite = w
+		defer waitWrite.Close()
+		cmd.ExtraFiles = []*os.File{waitRead}
+		cmd.Env = append(cmd.Env, rootlessWaitEnv+"=1")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start rootless namespace error %v", err)
+	}
+	if waitWrite != nil {
+		if err := writeIDMaps("newuidmap", cmd.Process.Pid, uidMaps); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, err
+		}
+		if err := writeIDMaps("newgidmap", cmd.Process.Pid, gidMaps); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, err
+		}
+		waitWrite.Write([]byte{0})
+		waitWrite.Close()
+	}
+
+	// 信号由终端直接发给整个前台进程组，这里只需要等待子进程退出
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				if status.Signaled() {
+					return 128 + int(status.Signal()), nil
+				}
+				return status.ExitStatus(), nil
+			}
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// RunInRootlessNamespace 使用 newuidmap 时，子进程在设置好映射之前没有任何能力
+// 等父进程设置完映射后重新执行自己，这时当前用户已经是命名空间中的 root，exec 之后拥有所有能力
+func WaitRootlessIDMaps() error {
+	if os.Getenv(rootlessWaitEnv) != "1" {
+		return nil
+	}
+	pipe := os.NewFile(uintptr(3), "rootless-wait")
+	buf := make([]byte, 1)
+	if n, err := pipe.Read(buf); n != 1 {
+		return fmt.Errorf("wait for rootless id maps error %v", err)
+	}
+	pipe.Close()
+	os.Unsetenv(rootlessWaitEnv)
+	if err := syscall.Exec("/proc/self/exe", os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("re-exec in rootless namespace error %v", err)
+	}
+	return nil
+}
+
+// rootless 模式下容器和 mydocker 在同一个 user 命名空间中，返回这个命名空间的映射
+func RootlessIDMaps() ([]IDMap, []IDMap) {
+	return procIDMaps("/proc/self/uid_map"), procIDMaps("/proc/self/gid_map")
+}
+
+// rootless 的 user 命名空间的映射: 当前用户为 0，subuid、subgid 中的范围从 1 开始
+func rootlessIDMaps() ([]IDMap, []IDMap, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, nil, fmt.Errorf("get current user error %v", err)
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	uidMaps := []IDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	gidMaps := []IDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+
+	_, errUid := exec.LookPath("newuidmap")
+	_, errGid := exec.LookPath("newgidmap")
+	if errUid != nil || errGid != nil {
+		log.Warnf("newuidmap/newgidmap not found, only the current user is mapped in the rootless namespace")
+		return uidMaps, gidMaps, nil
+	}
+	subuid, err1 := ioutil.ReadFile(SubuidFile)
+	subgid, err2 := ioutil.ReadFile(SubgidFile)
+	if err1 != nil || err2 != nil {
+		log.Warnf("%s or %s not found, only the current user is mapped in the rootless namespace", SubuidFile, SubgidFile)
+		return uidMaps, gidMaps, nil
+	}
+	subUids := parseSubIDs(subuid, u.Username, strconv.Itoa(uid))
+	subGids := parseSubIDs(subgid, u.Username, strconv.Itoa(uid))
+	if len(subUids) == 0 || len(subGids) == 0 {
+		log.Warnf("no subordinate ids for user %s, only the current user is mapped in the rootless namespace", u.Username)
+		return uidMaps, gidMaps, nil
+	}
+	for _, m := range subUids {
+		uidMaps = append(uidMaps, IDMap{ContainerID: m.ContainerID + 1, HostID: m.HostID, Size: m.Size})
+	}
+	for _, m := range subGids {
+		gidMaps = append(gidMaps, IDMap{ContainerID: m.ContainerID + 1, HostID: m.HostID, Size: m.Size})
+	}
+	return uidMaps, gidMaps, nil
+}
+
+// newuidmap <pid> <容器内 ID> <宿主机 ID> <数量> ...
+func writeIDMaps(helper string, pid int, maps []IDMap) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	if out, err := exec.Command(helper, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s error %v: %s", helper, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSetupRootlessPaths(t *testing.T) {
+	rootUrl, mntUrl, writeLayerUrl, remappedRootUrl, infoLocation := RootUrl, MntUrl, WriteLayerUrl, RemappedRootUrl, DefaultInfoLocation
+	defer func() {
+		RootUrl, MntUrl, WriteLayerUrl, RemappedRootUrl, DefaultInfoLocation = rootUrl, mntUrl, writeLayerUrl, remappedRootUrl, infoLocation
+	}()
+	env := map[string]string{}
+	for _, name := range []string{"XDG_RUNTIME_DIR", "XDG_DATA_HOME", "HOME"} {
+		env[name] = os.Getenv(name)
+	}
+	defer func() {
+		for name, value := range env {
+			os.Setenv(name, value)
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "mydocker-rootless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("XDG_RUNTIME_DIR", "")
+	if err := SetupRootlessPaths(); err == nil {
+		t.Errorf("setup rootless paths without XDG_RUNTIME_DIR should fail")
+	}
+
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	os.Setenv("XDG_DATA_HOME", "")
+	os.Setenv("HOME", dir)
+	if err := SetupRootlessPaths(); err != nil {
+		t.Fatal(err)
+	}
+	data := dir + "/.local/share/mydocker"
+	if RootUrl != data || MntUrl != data+"/mnt/%s" || WriteLayerUrl != data+"/writeLayer/%s" || RemappedRootUrl != data+"/%d.%d" {
+		t.Errorf("unexpected rootless data paths %s %s %s %s", RootUrl, MntUrl, WriteLayerUrl, RemappedRootUrl)
+	}
+	if DefaultInfoLocation != "/run/user/1000/mydocker/%s/" {
+		t.Errorf("unexpected rootless info location %s", DefaultInfoLocation)
+	}
+	if _, err := os.Stat(data); err != nil {
+		t.Errorf("rootless data dir not created: %v", err)
+	}
+
+	os.Setenv("XDG_DATA_HOME", dir+"/data")
+	if err := SetupRootlessPaths(); err != nil {
+		t.Fatal(err)
+	}
+	if RootUrl != dir+"/data/mydocker" {
+		t.Errorf("unexpected rootless root url with XDG_DATA_HOME %s", RootUrl)
+	}
+}
@@ -0,0 +1,240 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// --security-opt seccomp=unconfined 表示不使用 seccomp
+const SeccompUnconfined = "unconfined"
+
+// seccomp 配置，和 docker 的 JSON 格式相同
+// 父进程根据容器的能力、架构、内核版本处理 Includes/Excludes 之后，通过 init 配置发给容器进程
+type SeccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint            `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	ArchMap         []SeccompArchMap `json:"archMap,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls"`
+}
+
+type SeccompArchMap struct {
+	Architecture     string   `json:"architecture"`
+	SubArchitectures []string `json:"subArchitectures"`
+}
+
+// 一组系统调用的规则，Args 中的条件全部满足时执行 Action
+type SeccompSyscall struct {
+	Name     string         `json:"name,omitempty"`
+	Names    []string       `json:"names,omitempty"`
+	Action   string         `json:"action"`
+	ErrnoRet *uint          `json:"errnoRet,omitempty"`
+	Args     []SeccompArg   `json:"args"`
+	Includes *SeccompFilter `json:"includes,omitempty"`
+	Excludes *SeccompFilter `json:"excludes,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+// 参数条件，MASKED_EQ 时 Value 为掩码，ValueTwo 为比较的值
+type SeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// 规则生效的条件
+type SeccompFilter struct {
+	Arches    []string `json:"arches,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// seccomp 动作对应的返回值，ERRNO 和 TRACE 的低 16 位为数据
+var seccompActions = map[string]uint32{
+	"SCMP_ACT_KILL":         0x00000000,
+	"SCMP_ACT_KILL_THREAD":  0x00000000,
+	"SCMP_ACT_KILL_PROCESS": 0x80000000,
+	"SCMP_ACT_TRAP":         0x00030000,
+	"SCMP_ACT_ERRNO":        0x00050000,
+	"SCMP_ACT_TRACE":        0x7ff00000,
+	"SCMP_ACT_LOG":          0x7ffc0000,
+	"SCMP_ACT_ALLOW":        0x7fff0000,
+}
+
+var seccompOps = map[string]bool{
+	"SCMP_CMP_NE":        true,
+	"SCMP_CMP_LT":        true,
+	"SCMP_CMP_LE":        true,
+	"SCMP_CMP_EQ":        true,
+	"SCMP_CMP_GE":        true,
+	"SCMP_CMP_GT":        true,
+	"SCMP_CMP_MASKED_EQ": true,
+}
+
+// 读取 docker 格式的 seccomp 配置文件
+func LoadSeccompProfile(path string) (*SeccompProfile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read seccomp profile error %v", err)
+	}
+	profile := &SeccompProfile{}
+	if err := json.Unmarshal(content, profile); err != nil {
+		return nil, fmt.Errorf("decode seccomp profile %s error %v", path, err)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %v", path, err)
+	}
+	return profile, nil
+}
+
+func (p *SeccompProfile) validate() error {
+	if _, ok := seccompActions[p.DefaultAction]; !ok {
+		return fmt.Errorf("unknown default action %q", p.DefaultAction)
+	}
+	for _, call := range p.Syscalls {
+		if call.Name != "" && len(call.Names) > 0 {
+			return fmt.Errorf("'name' and 'names' were specified in the seccomp profile, use either 'name' or 'names'")
+		}
+		if _, ok := seccompActions[call.Action]; !ok {
+			return fmt.Errorf("unknown action %q", call.Action)
+		}
+		for _, arg := range call.Args {
+			if arg.Index > 5 {
+				return fmt.Errorf("invalid argument index %d", arg.Index)
+			}
+			if !seccompOps[arg.Op] {
+				return fmt.Errorf("unknown operator %q", arg.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// 根据容器的能力、本机架构、内核版本处理 includes/excludes，返回只包含生效规则的配置
+func (p *SeccompProfile) Resolve(capabilities []string) (*SeccompProfile, error) {
+	caps := map[string]bool{}
+	for _, c := range capabilities {
+		caps[c] = true
+	}
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := &SeccompProfile{
+		DefaultAction:   p.DefaultAction,
+		DefaultErrnoRet: p.DefaultErrnoRet,
+		Architectures:   p.Architectures,
+		Syscalls:        []SeccompSyscall{},
+	}
+	// 没有指定 architectures 时使用 archMap 中本机架构及其子架构
+	if len(resolved.Architectures) == 0 {
+		for _, m := range p.ArchMap {
+			if m.Architecture == seccompNativeArch {
+				resolved.Architectures = append([]string{m.Architecture}, m.SubArchitectures...)
+			}
+		}
+	}
+	for _, call := range p.Syscalls {
+		if call.Includes != nil && !seccompIncluded(call.Includes, caps, kernel) {
+			continue
+		}
+		if call.Excludes != nil && seccompExcluded(call.Excludes, caps, kernel) {
+			continue
+		}
+		names := call.Names
+		if call.Name != "" {
+			names = []string{call.Name}
+		}
+		resolved.Syscalls = append(resolved.Syscalls, SeccompSyscall{
+			Names:    names,
+			Action:   call.Action,
+			ErrnoRet: call.ErrnoRet,
+			Args:     call.Args,
+		})
+	}
+	return resolved, nil
+}
+
+// includes 中的条件需要全部满足: 本机架构在 arches 中、拥有 caps 中的所有能力、内核版本不低于 minKernel
+func seccompIncluded(f *SeccompFilter, caps map[string]bool, kernel [2]int) bool {
+	if len(f.Arches) > 0 && !containsString(f.Arches, runtime.GOARCH) {
+		return false
+	}
+	for _, c := range f.Caps {
+		if !caps[c] {
+			return false
+		}
+	}
+	return f.MinKernel == "" || kernelAtLeast(kernel, f.MinKernel)
+}
+
+// excludes 中的条件满足任意一个即排除
+func seccompExcluded(f *SeccompFilter, caps map[string]bool, kernel [2]int) bool {
+	if containsString(f.Arches, runtime.GOARCH) {
+		return true
+	}
+	for _, c := range f.Caps {
+		if caps[c] {
+			return true
+		}
+	}
+	return f.MinKernel != "" && kernelAtLeast(kernel, f.MinKernel)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func kernelAtLeast(kernel [2]int, version string) bool {
+	min, err := parseKernelVersion(version)
+	if err != nil {
+		return false
+	}
+	return kernel[0] > min[0] || (kernel[0] == min[0] && kernel[1] >= min[1])
+}
+
+func kernelVersion() ([2]int, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return [2]int{}, fmt.Errorf("uname error %v", err)
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return parseKernelVersion(string(release))
+}
+
+// 解析 5.8、4.14.0-1-amd64 这样的内核版本，只取主版本号和次版本号
+func parseKernelVersion(version string) ([2]int, error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return [2]int{}, fmt.Errorf("invalid kernel version %q", version)
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	// 次版本号后面可能直接跟着 -rc1 之类的后缀
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	n, err2 := strconv.Atoi(minor)
+	if err1 != nil || err2 != nil {
+		return [2]int{}, fmt.Errorf("invalid kernel version %q", version)
+	}
+	return [2]int{major, n}, nil
+}
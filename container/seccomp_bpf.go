@@ -0,0 +1,281 @@
+package container
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// 把 seccomp 配置编译成 classic BPF 程序
+// 程序的输入为 struct seccomp_data { int nr; u32 arch; u64 instruction_pointer; u64 args[6]; }
+// 结构: 先检查架构，再依次比较系统调用号，每个系统调用有一段自己的规则，规则都不匹配时返回默认动作
+
+// classic BPF 指令，见 /usr/include/linux/filter.h
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+const (
+	bpfLdAbs  = 0x20 // A = *(u32 *)(data + k)
+	bpfAndK   = 0x54 // A &= k
+	bpfJa     = 0x05 // pc += k
+	bpfJeqK   = 0x15 // pc += (A == k) ? jt : jf
+	bpfJgtK   = 0x25 // pc += (A > k) ? jt : jf
+	bpfJgeK   = 0x35 // pc += (A >= k) ? jt : jf
+	bpfRetK   = 0x06 // return k
+	bpfMaxLen = 4096
+
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	// x32 ABI 的系统调用号带有这一位，和 x86_64 使用同一个 AUDIT_ARCH
+	x32SyscallBit = 0x40000000
+)
+
+// 参数条件中的跳转目标，编译完一条规则后替换成实际的偏移量
+const (
+	jumpNext = iota // 下一条指令
+	jumpPass        // 条件满足，跳到下一个条件
+	jumpFail        // 条件不满足，跳到下一条规则
+)
+
+type condInsn struct {
+	sockFilter
+	jt, jf int
+}
+
+func stmt(code uint16, k uint32) sockFilter {
+	return sockFilter{Code: code, K: k}
+}
+
+// 编译 seccomp 配置，只支持本机架构的系统调用，其他架构的系统调用在配置中列出时执行默认动作，否则结束进程
+func compileSeccomp(p *SeccompProfile) ([]sockFilter, error) {
+	defaultAction, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	badArch := seccompActions["SCMP_ACT_KILL_PROCESS"]
+	for _, arch := range p.Architectures {
+		if arch != seccompNativeArch {
+			badArch = defaultAction
+		}
+	}
+
+	// 按系统调用号合并规则，不在本架构上的系统调用忽略
+	rules := map[int][]SeccompSyscall{}
+	for _, call := range p.Syscalls {
+		for _, name := range call.Names {
+			if nr, ok := syscallNumbers[name]; ok {
+				rules[nr] = append(rules[nr], call)
+			}
+		}
+	}
+	var numbers []int
+	for nr := range rules {
+		numbers = append(numbers, nr)
+	}
+	sort.Ints(numbers)
+
+	prog := []sockFilter{
+		stmt(bpfLdAbs, seccompDataArch),
+		{Code: bpfJeqK, Jt: 1, Jf: 0, K: auditArchNative},
+		stmt(bpfRetK, badArch),
+		stmt(bpfLdAbs, seccompDataNr),
+	}
+	if runtime.GOARCH == "amd64" {
+		prog = append(prog, sockFilter{Code: bpfJgeK, Jt: 0, Jf: 1, K: x32SyscallBit}, stmt(bpfRetK, badArch))
+	}
+	for _, nr := range numbers {
+		body, err := compileSyscallRules(rules[nr], defaultAction)
+		if err != nil {
+			return nil, err
+		}
+		prog = append(prog, sockFilter{Code: bpfJeqK, Jt: 1, Jf: 0, K: uint32(nr)}, stmt(bpfJa, uint32(len(body))))
+		prog = append(prog, body...)
+	}
+	prog = append(prog, stmt(bpfRetK, defaultAction))
+	if len(prog) > bpfMaxLen {
+		return nil, fmt.Errorf("seccomp filter is too large (%d instructions)", len(prog))
+	}
+	return prog, nil
+}
+
+// 一个系统调用的所有规则，按顺序匹配，有参数条件的规则在前，都不匹配时返回默认动作
+func compileSyscallRules(calls []SeccompSyscall, defaultAction uint32) ([]sockFilter, error) {
+	sorted := make([]SeccompSyscall, 0, len(calls))
+	for _, call := range calls {
+		if len(call.Args) > 0 {
+			sorted = append(sorted, call)
+		}
+	}
+	for _, call := range calls {
+		if len(call.Args) == 0 {
+			sorted = append(sorted, call)
+		}
+	}
+
+	var body []sockFilter
+	for _, call := range sorted {
+		action, err := seccompAction(call.Action, call.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		if len(call.Args) == 0 {
+			// 无条件的规则之后的规则都不会执行
+			return append(body, stmt(bpfRetK, action)), nil
+		}
+		rule, err := compileRule(call.Args, action)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, rule...)
+	}
+	return append(body, stmt(bpfRetK, defaultAction)), nil
+}
+
+// 一条规则: 所有参数条件都满足时返回 action，否则跳到规则之后
+func compileRule(args []SeccompArg, action uint32) ([]sockFilter, error) {
+	var insns []condInsn
+	var condEnds []int
+	for _, arg := range args {
+		cond, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		insns = append(insns, cond...)
+		for range cond {
+			condEnds = append(condEnds, len(insns))
+		}
+	}
+	ruleLen := len(insns) + 1
+
+	rule := make([]sockFilter, 0, ruleLen)
+	for i, in := range insns {
+		offset := func(target int) (uint8, error) {
+			var off int
+			switch target {
+			case jumpNext:
+				off = 0
+			case jumpPass:
+				off = condEnds[i] - i - 1
+			case jumpFail:
+				off = ruleLen - i - 1
+			}
+			if off > 255 {
+				return 0, fmt.Errorf("seccomp rule is too large")
+			}
+			return uint8(off), nil
+		}
+		f := in.sockFilter
+		if f.Code != bpfLdAbs && f.Code != bpfAndK {
+			var err error
+			if f.Jt, err = offset(in.jt); err != nil {
+				return nil, err
+			}
+			if f.Jf, err = offset(in.jf); err != nil {
+				return nil, err
+			}
+		}
+		rule = append(rule, f)
+	}
+	return append(rule, stmt(bpfRetK, action)), nil
+}
+
+// 64 位参数分成高 32 位和低 32 位比较，先比较高位
+func compileArg(arg SeccompArg) ([]condInsn, error) {
+	hiValue, loValue := uint32(arg.Value>>32), uint32(arg.Value)
+	hiOffset := uint32(seccompDataArgs + 8*arg.Index + 4)
+	loOffset := uint32(seccompDataArgs + 8*arg.Index)
+	ld := func(offset uint32) condInsn { return condInsn{sockFilter: stmt(bpfLdAbs, offset)} }
+	jmp := func(code uint16, k uint32, jt, jf int) condInsn {
+		return condInsn{sockFilter: sockFilter{Code: code, K: k}, jt: jt, jf: jf}
+	}
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []condInsn{
+			ld(hiOffset), jmp(bpfJeqK, hiValue, jumpNext, jumpFail),
+			ld(loOffset), jmp(bpfJeqK, loValue, jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []condInsn{
+			ld(hiOffset), jmp(bpfJeqK, hiValue, jumpNext, jumpPass),
+			ld(loOffset), jmp(bpfJeqK, loValue, jumpFail, jumpPass),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		// Value 为掩码，ValueTwo 为比较的值
+		return []condInsn{
+			ld(hiOffset), {sockFilter: stmt(bpfAndK, hiValue)}, jmp(bpfJeqK, uint32(arg.ValueTwo>>32), jumpNext, jumpFail),
+			ld(loOffset), {sockFilter: stmt(bpfAndK, loValue)}, jmp(bpfJeqK, uint32(arg.ValueTwo), jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		loCode := uint16(bpfJgtK)
+		if arg.Op == "SCMP_CMP_GE" {
+			loCode = bpfJgeK
+		}
+		return []condInsn{
+			ld(hiOffset), jmp(bpfJgtK, hiValue, jumpPass, jumpNext), jmp(bpfJeqK, hiValue, jumpNext, jumpFail),
+			ld(loOffset), jmp(loCode, loValue, jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		// 小于等价于不大于等于，小于等于等价于不大于
+		loCode := uint16(bpfJgeK)
+		if arg.Op == "SCMP_CMP_LE" {
+			loCode = bpfJgtK
+		}
+		return []condInsn{
+			ld(hiOffset), jmp(bpfJgtK, hiValue, jumpFail, jumpNext), jmp(bpfJeqK, hiValue, jumpNext, jumpPass),
+			ld(loOffset), jmp(loCode, loValue, jumpFail, jumpPass),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown seccomp operator %q", arg.Op)
+}
+
+// 动作对应的返回值，ERRNO 默认返回 EPERM
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	ret, ok := seccompActions[action]
+	if !ok {
+		return 0, fmt.Errorf("unknown seccomp action %q", action)
+	}
+	if action == "SCMP_ACT_ERRNO" || action == "SCMP_ACT_TRACE" {
+		data := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			data = uint32(*errnoRet)
+		}
+		ret |= data & 0xffff
+	}
+	return ret, nil
+}
+
+// 编译并加载 seccomp 过滤器，TSYNC 让进程的所有线程都使用这个过滤器
+// 没有设置 no_new_privs 时需要 CAP_SYS_ADMIN，所以要在去掉能力之前调用
+func setupSeccomp(p *SeccompProfile) error {
+	if p == nil {
+		return nil
+	}
+	prog, err := compileSeccomp(p)
+	if err != nil {
+		return err
+	}
+	fprog := sockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(prog)
+	if errno != 0 {
+		return fmt.Errorf("load seccomp filter error %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package container
+
+import (
+	"encoding/binary"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// 解释执行 seccomp 的 classic BPF 程序，只支持 compileSeccomp 用到的指令
+func runSeccompFilter(t *testing.T, prog []sockFilter, arch uint32, nr int, args [6]uint64) uint32 {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data[seccompDataNr:], uint32(nr))
+	binary.LittleEndian.PutUint32(data[seccompDataArch:], arch)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(data[seccompDataArgs+8*i:], arg)
+	}
+	var a uint32
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		jump := func(cond bool) {
+			if cond {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		}
+		switch in.Code {
+		case bpfLdAbs:
+			a = binary.LittleEndian.Uint32(data[in.K:])
+		case bpfAndK:
+			a &= in.K
+		case bpfJa:
+			pc += int(in.K)
+		case bpfJeqK:
+			jump(a == in.K)
+		case bpfJgtK:
+			jump(a > in.K)
+		case bpfJgeK:
+			jump(a >= in.K)
+		case bpfRetK:
+			return in.K
+		default:
+			t.Fatalf("unknown instruction %#x", in.Code)
+		}
+	}
+	t.Fatalf("seccomp filter has no return")
+	return 0
+}
+
+func TestCompileSeccomp(t *testing.T) {
+	errno := uint(syscall.ENOENT)
+	profile := &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Syscalls: []SeccompSyscall{
+			{Names: []string{"read", "write"}, Action: "SCMP_ACT_ALLOW"},
+			{Names: []string{"mkdir"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &errno},
+			{Names: []string{"kill"}, Action: "SCMP_ACT_ALLOW", Args: []SeccompArg{{Index: 1, Value: 9, Op: "SCMP_CMP_NE"}}},
+			{Names: []string{"socket"}, Action: "SCMP_ACT_ALLOW", Args: []SeccompArg{{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"}}},
+			{Names: []string{"socket"}, Action: "SCMP_ACT_ALLOW", Args: []SeccompArg{{Index: 0, Value: 10, Op: "SCMP_CMP_GE"}, {Index: 0, Value: 1 << 32, Op: "SCMP_CMP_LT"}}},
+			{Names: []string{"clone"}, Action: "SCMP_ACT_ALLOW", Args: []SeccompArg{{Index: 0, Value: syscall.CLONE_NEWNS, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}}},
+			{Names: []string{"no_such_syscall"}, Action: "SCMP_ACT_ALLOW"},
+		},
+	}
+	prog, err := compileSeccomp(profile)
+	if err != nil {
+		t.Fatalf("compile seccomp error %v", err)
+	}
+
+	allow := seccompActions["SCMP_ACT_ALLOW"]
+	eperm := seccompActions["SCMP_ACT_ERRNO"] | uint32(syscall.EPERM)
+	tests := []struct {
+		name   string
+		args   [6]uint64
+		expect uint32
+	}{
+		{"read", [6]uint64{}, allow},
+		{"write", [6]uint64{}, allow},
+		{"getpid", [6]uint64{}, eperm},
+		{"mkdir", [6]uint64{}, seccompActions["SCMP_ACT_ERRNO"] | uint32(syscall.ENOENT)},
+		{"kill", [6]uint64{1, 15}, allow},
+		{"kill", [6]uint64{1, 9}, eperm},
+		{"kill", [6]uint64{1, 9 | 1<<32}, allow},
+		{"socket", [6]uint64{1}, allow},
+		{"socket", [6]uint64{2}, eperm},
+		{"socket", [6]uint64{10}, allow},
+		{"socket", [6]uint64{1<<32 - 1}, allow},
+		{"socket", [6]uint64{1 << 32}, eperm},
+		{"clone", [6]uint64{uint64(syscall.SIGCHLD)}, allow},
+		{"clone", [6]uint64{syscall.CLONE_NEWNS | uint64(syscall.SIGCHLD)}, eperm},
+	}
+	for _, test := range tests {
+		got := runSeccompFilter(t, prog, auditArchNative, syscallNumbers[test.name], test.args)
+		if got != test.expect {
+			t.Errorf("%s%v got %#x, expect %#x", test.name, test.args, got, test.expect)
+		}
+	}
+
+	if got := runSeccompFilter(t, prog, 0x40000003, syscallNumbers["read"], [6]uint64{}); got != seccompActions["SCMP_ACT_KILL_PROCESS"] {
+		t.Errorf("foreign arch got %#x, expect kill process", got)
+	}
+}
+
+func TestSeccompResolve(t *testing.T) {
+	profile := &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Syscalls: []SeccompSyscall{
+			{Name: "read", Action: "SCMP_ACT_ALLOW"},
+			{Names: []string{"mount"}, Action: "SCMP_ACT_ALLOW", Includes: &SeccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+			{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", Excludes: &SeccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+			{Names: []string{"ptrace"}, Action: "SCMP_ACT_ALLOW", Includes: &SeccompFilter{MinKernel: "2.6"}},
+			{Names: []string{"future"}, Action: "SCMP_ACT_ALLOW", Includes: &SeccompFilter{MinKernel: "999.0"}},
+			{Names: []string{"foreign"}, Action: "SCMP_ACT_ALLOW", Includes: &SeccompFilter{Arches: []string{"no-such-arch"}}},
+		},
+	}
+	names := func(p *SeccompProfile) []string {
+		var result []string
+		for _, call := range p.Syscalls {
+			result = append(result, call.Names...)
+		}
+		return result
+	}
+
+	resolved, err := profile.Resolve(DefaultCapabilities)
+	if err != nil {
+		t.Fatalf("resolve error %v", err)
+	}
+	if expect := []string{"read", "clone3", "ptrace"}; !reflect.DeepEqual(names(resolved), expect) {
+		t.Errorf("resolve with default capabilities got %v, expect %v", names(resolved), expect)
+	}
+
+	resolved, err = profile.Resolve([]string{"CAP_SYS_ADMIN"})
+	if err != nil {
+		t.Fatalf("resolve error %v", err)
+	}
+	if expect := []string{"read", "mount", "ptrace"}; !reflect.DeepEqual(names(resolved), expect) {
+		t.Errorf("resolve with CAP_SYS_ADMIN got %v, expect %v", names(resolved), expect)
+	}
+}
+
+func TestDefaultSeccompProfile(t *testing.T) {
+	profile, err := DefaultSeccompProfile().Resolve(DefaultCapabilities)
+	if err != nil {
+		t.Fatalf("resolve default profile error %v", err)
+	}
+	if err := profile.validate(); err != nil {
+		t.Fatalf("invalid default profile %v", err)
+	}
+	prog, err := compileSeccomp(profile)
+	if err != nil {
+		t.Fatalf("compile default profile error %v", err)
+	}
+
+	allow := seccompActions["SCMP_ACT_ALLOW"]
+	eperm := seccompActions["SCMP_ACT_ERRNO"] | uint32(syscall.EPERM)
+	tests := []struct {
+		name   string
+		args   [6]uint64
+		expect uint32
+	}{
+		{"read", [6]uint64{}, allow},
+		{"chroot", [6]uint64{}, allow},
+		{"mount", [6]uint64{}, eperm},
+		{"unshare", [6]uint64{}, eperm},
+		{"reboot", [6]uint64{}, eperm},
+		{"clone", [6]uint64{uint64(syscall.SIGCHLD)}, allow},
+		{"clone", [6]uint64{syscall.CLONE_NEWUSER}, eperm},
+		{"clone3", [6]uint64{}, seccompActions["SCMP_ACT_ERRNO"] | uint32(syscall.ENOSYS)},
+		{"socket", [6]uint64{syscall.AF_INET}, allow},
+		{"socket", [6]uint64{40}, eperm},
+		{"personality", [6]uint64{0xffffffff}, allow},
+		{"personality", [6]uint64{0x1}, eperm},
+	}
+	for _, test := range tests {
+		got := runSeccompFilter(t, prog, auditArchNative, syscallNumbers[test.name], test.args)
+		if got != test.expect {
+			t.Errorf("%s%v got %#x, expect %#x", test.name, test.args, got, test.expect)
+		}
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		expect  [2]int
+	}{
+		{"4.8", [2]int{4, 8}},
+		{"5.15.0-91-generic", [2]int{5, 15}},
+		{"6.1-rc1", [2]int{6, 1}},
+	}
+	for _, test := range tests {
+		got, err := parseKernelVersion(test.version)
+		if err != nil || got != test.expect {
+			t.Errorf("parse kernel version %s got %v %v, expect %v", test.version, got, err, test.expect)
+		}
+	}
+	for _, version := range []string{"", "4", "a.b"} {
+		if _, err := parseKernelVersion(version); err == nil {
+			t.Errorf("parse kernel version %q should fail", version)
+		}
+	}
+}
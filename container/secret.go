@@ -0,0 +1,191 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	SecretDataFile   = "data"         // secret 的内容，和 config.json 放在同一个目录下
+	SecretsDir       = "/run/secrets" // 容器内挂载 secret 的目录
+	MaxSecretSize    = 500 * 1024     // secret 最大 500KB，和 docker 相同
+	maxSecretNameLen = 64
+
+	defaultSecretMode = 0444
+	// 容器信息目录下挂载 secret tmpfs 的目录
+	secretsMountDir   = "secrets"
+	secretsMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+)
+
+// secret 存放目录，只有 root 可以访问，rootless 模式下在 ~/.local/share/mydocker-secrets 下
+var DefaultSecretLocation = "/var/lib/mydocker/secrets/%s/"
+
+// secret 名和容器内的文件名只能包含字母、数字和 _ . -，不能以 . 开头，避免路径穿越
+var secretNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// secret 基本信息，保存在 /var/lib/mydocker/secrets/<secret名>/config.json，内容单独保存在 data 文件中
+type SecretInfo struct {
+	Id          string `json:"id"`         //secret ID
+	Name        string `json:"name"`       //secret 名
+	CreatedTime string `json:"createTime"` //创建时间
+	Size        int    `json:"size"`       //内容的字节数
+	Digest      string `json:"digest"`     //内容的 sha256
+}
+
+// run --secret 的参数，记录在容器信息中，不包含 secret 的内容
+type SecretReference struct {
+	Name   string      `json:"name"`   //secret 名
+	Target string      `json:"target"` //容器内 /run/secrets 下的文件名
+	Mode   os.FileMode `json:"mode"`   //文件权限
+	Uid    int         `json:"uid"`    //容器内文件的属主
+	Gid    int         `json:"gid"`
+}
+
+// 校验 secret 名
+func ValidateSecretName(name string) error {
+	if len(name) > maxSecretNameLen || !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed, at most %d characters", name, maxSecretNameLen)
+	}
+	return nil
+}
+
+// 解析 --secret <secret名>[,target=<文件名>][,mode=<八进制权限>][,uid=<uid>][,gid=<gid>]
+// 文件名默认为 secret 名，权限默认为 0444，属主默认为容器内的 root
+func ParseSecretReference(value string) (SecretReference, error) {
+	parts := strings.Split(value, ",")
+	ref := SecretReference{Name: parts[0], Target: parts[0], Mode: defaultSecretMode}
+	if err := ValidateSecretName(ref.Name); err != nil {
+		return SecretReference{}, err
+	}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return SecretReference{}, fmt.Errorf("invalid secret %q, option %q is not in key=value format", value, opt)
+		}
+		switch kv[0] {
+		case "target":
+			if len(kv[1]) > maxSecretNameLen || !secretNamePattern.MatchString(kv[1]) {
+				return SecretReference{}, fmt.Errorf("invalid secret %q, target should be a file name under %s", value, SecretsDir)
+			}
+			ref.Target = kv[1]
+		case "mode":
+			mode, err := strconv.ParseUint(kv[1], 8, 32)
+			if err != nil || mode&^0777 != 0 {
+				return SecretReference{}, fmt.Errorf("invalid secret %q, mode should be octal permission bits", value)
+			}
+			ref.Mode = os.FileMode(mode)
+		case "uid", "gid":
+			id, err := strconv.Atoi(kv[1])
+			if err != nil || id < 0 {
+				return SecretReference{}, fmt.Errorf("invalid secret %q, %s should be a non-negative number", value, kv[0])
+			}
+			if kv[0] == "uid" {
+				ref.Uid = id
+			} else {
+				ref.Gid = id
+			}
+		default:
+			return SecretReference{}, fmt.Errorf("invalid secret %q, unknown option %q", value, kv[0])
+		}
+	}
+	return ref, nil
+}
+
+// secret 的存放目录
+func SecretPath(name string) string {
+	return fmt.Sprintf(DefaultSecretLocation, name)
+}
+
+// 读取 secret 的基本信息，不包含内容
+func LoadSecretInfo(name string) (*SecretInfo, error) {
+	content, err := ioutil.ReadFile(filepath.Join(SecretPath(name), ConfigName))
+	if err != nil {
+		return nil, err
+	}
+	var secret SecretInfo
+	if err := json.Unmarshal(content, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// 容器的 secret 在宿主机上挂载的路径
+func ContainerSecretsPath(containerName string) string {
+	return filepath.Join(fmt.Sprintf(DefaultInfoLocation, containerName), secretsMountDir)
+}
+
+// 在宿主机上容器信息目录下挂载 tmpfs，写入容器使用的 secret 后改为只读，返回只读 bind mount 到容器 /run/secrets 的挂载配置
+// secret 只存在于内存中，不会写入容器的可写层，commit 时也不会打包进镜像
+// 和可以共享的 /dev/shm 一样，需要在容器进程复制 mount 命名空间之前挂载
+func MountSecrets(containerName string, refs []SecretReference, uidMaps, gidMaps []IDMap) (Mount, error) {
+	dir := ContainerSecretsPath(containerName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Mount{}, fmt.Errorf("create secrets dir %s error %v", dir, err)
+	}
+	// 使用 user 命名空间时，目录属于容器内的 root
+	uid, gid := 0, 0
+	if len(uidMaps) > 0 {
+		uid, gid = RemappedRoot(uidMaps, gidMaps)
+	}
+	if err := syscall.Mount("secrets", dir, "tmpfs", secretsMountFlags, fmt.Sprintf("mode=0755,uid=%d,gid=%d", uid, gid)); err != nil {
+		return Mount{}, fmt.Errorf("mount secrets %s error %v", dir, err)
+	}
+	if err := writeSecrets(dir, refs, uidMaps, gidMaps); err != nil {
+		UnmountSecrets(containerName)
+		return Mount{}, err
+	}
+	if err := syscall.Mount("", dir, "", secretsMountFlags|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		UnmountSecrets(containerName)
+		return Mount{}, fmt.Errorf("remount secrets %s readonly error %v", dir, err)
+	}
+	return Mount{Source: dir, Destination: SecretsDir, Flags: syscall.MS_BIND | syscall.MS_RDONLY | secretsMountFlags}, nil
+}
+
+func writeSecrets(dir string, refs []SecretReference, uidMaps, gidMaps []IDMap) error {
+	for _, ref := range refs {
+		data, err := ioutil.ReadFile(filepath.Join(SecretPath(ref.Name), SecretDataFile))
+		if err != nil {
+			return fmt.Errorf("read secret %s error %v", ref.Name, err)
+		}
+		uid, gid := ref.Uid, ref.Gid
+		if len(uidMaps) > 0 {
+			var uidOk, gidOk bool
+			uid, uidOk = HostID(ref.Uid, uidMaps)
+			gid, gidOk = HostID(ref.Gid, gidMaps)
+			if !uidOk || !gidOk {
+				return fmt.Errorf("secret %s owner %d:%d is not mapped in the user namespace", ref.Name, ref.Uid, ref.Gid)
+			}
+		}
+		path := filepath.Join(dir, ref.Target)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("create secret file %s error %v", ref.Target, err)
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("write secret file %s error %v", ref.Target, err)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("chown secret file %s error %v", ref.Target, err)
+		}
+		if err := os.Chmod(path, ref.Mode); err != nil {
+			return fmt.Errorf("chmod secret file %s error %v", ref.Target, err)
+		}
+	}
+	return nil
+}
+
+// 删除容器信息之前卸载 secret 的 tmpfs，没有挂载时忽略
+func UnmountSecrets(containerName string) {
+	unmountTmpfs(ContainerSecretsPath(containerName))
+}
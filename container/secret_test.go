@@ -0,0 +1,48 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSecretReference(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect SecretReference
+		err    bool
+	}{
+		{"db-password", SecretReference{Name: "db-password", Target: "db-password", Mode: 0444}, false},
+		{"db,target=password,mode=0400,uid=1000,gid=100", SecretReference{Name: "db", Target: "password", Mode: 0400, Uid: 1000, Gid: 100}, false},
+		{"db,mode=600", SecretReference{Name: "db", Target: "db", Mode: 0600}, false},
+		{"../db", SecretReference{}, true},
+		{"db,target=../../etc/passwd", SecretReference{}, true},
+		{"db,target=.hidden", SecretReference{}, true},
+		{"db,mode=4755", SecretReference{}, true},
+		{"db,mode=abc", SecretReference{}, true},
+		{"db,uid=-1", SecretReference{}, true},
+		{"db,uid", SecretReference{}, true},
+		{"db,size=1", SecretReference{}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseSecretReference(test.value)
+		if (err != nil) != test.err || got != test.expect {
+			t.Errorf("parse secret %q got %+v %v, expect %+v", test.value, got, err, test.expect)
+		}
+	}
+}
+
+func TestValidateSecretName(t *testing.T) {
+	for _, name := range []string{"db", "db.password", "DB_1-a"} {
+		if err := ValidateSecretName(name); err != nil {
+			t.Errorf("validate secret name %q error %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", ".db", "a/b", "db password", strings.Repeat("a", 65)} {
+		if err := ValidateSecretName(name); err == nil {
+			t.Errorf("validate secret name %q should fail", name)
+		}
+	}
+	if got := ContainerSecretsPath("web"); got != "/var/run/mydocker/web/secrets" {
+		t.Errorf("container secrets path got %s", got)
+	}
+}
@@ -0,0 +1,166 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 默认屏蔽的路径，容器内无法读取，和 docker 相同
+// 文件用 /dev/null 覆盖，目录用只读的空 tmpfs 覆盖
+var DefaultMaskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// 默认只读的路径，容器内修改这些路径会影响宿主机内核
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// --security-opt unmask=ALL 表示取消所有的屏蔽和只读路径
+const UnmaskAll = "ALL"
+
+// --security-opt 解析后的结果
+type SecurityOptions struct {
+	Unmask  []string // 不屏蔽、不设为只读的路径
+	Seccomp string   // seccomp 配置文件的路径，unconfined 表示不使用 seccomp，为空时使用默认配置
+	// no-new-privileges，为 nil 时使用 mydocker --no-new-privileges 的设置
+	NoNewPrivileges *bool
+}
+
+// 解析 --security-opt，格式为 key=value
+// unmask=ALL 或 unmask=/proc/kcore:/proc/sys，可以指定多次
+// seccomp=unconfined 或 seccomp=/path/to/profile.json
+// no-new-privileges 或 no-new-privileges=true|false
+func ParseSecurityOpts(opts []string) (*SecurityOptions, error) {
+	sec := &SecurityOptions{}
+	for _, opt := range opts {
+		if opt == "no-new-privileges" {
+			opt += "=true"
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid security-opt %q, expect key=value", opt)
+		}
+		switch kv[0] {
+		case "unmask":
+			for _, path := range strings.Split(kv[1], ":") {
+				if path != UnmaskAll && !filepath.IsAbs(path) {
+					return nil, fmt.Errorf("invalid unmask path %q, must be ALL or an absolute path", path)
+				}
+				sec.Unmask = append(sec.Unmask, filepath.Clean(path))
+			}
+		case "seccomp":
+			sec.Seccomp = kv[1]
+		case "no-new-privileges":
+			enabled, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid security-opt %q, no-new-privileges must be true or false", opt)
+			}
+			sec.NoNewPrivileges = &enabled
+		default:
+			return nil, fmt.Errorf("invalid security-opt %q, unknown option %s", opt, kv[0])
+		}
+	}
+	return sec, nil
+}
+
+// 从 paths 中去掉 unmask 指定的路径，unmask 包含 ALL 时返回空
+// 指定的路径同时会去掉它下面的子路径，比如 /proc 会去掉所有 /proc 下的路径
+func FilterPaths(paths, unmask []string) []string {
+	result := []string{}
+	for _, path := range paths {
+		keep := true
+		for _, u := range unmask {
+			if u == UnmaskAll || path == u || strings.HasPrefix(path, u+"/") {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+// 屏蔽路径，在 /proc、/sys、/dev 挂载之后调用，路径不存在时跳过
+func maskPaths(paths []string) error {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("mask path %s error %v", path, err)
+		}
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "size=0")
+		} else {
+			err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("mask path %s error %v", path, err)
+		}
+	}
+	return nil
+}
+
+// 把路径 bind mount 到自身后 remount 为只读，路径不存在时跳过
+// /proc 和 /sys 都带有 nosuid、nodev、noexec，remount 时需要保留
+func readonlyPaths(paths []string) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount %s error %v", path, err)
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		if err := syscall.Mount(path, path, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only error %v", path, err)
+		}
+	}
+	return nil
+}
+
+const prSetNoNewPrivs = 38
+
+// execve 之前的最后一步: 切换用户、限制能力、设置 no_new_privs、加载 seccomp 过滤器
+// 没有 no_new_privs 时加载 seccomp 需要 CAP_SYS_ADMIN，只能在去掉能力之前加载
+// 设置了 no_new_privs 时放到最后加载，这样切换用户、设置能力用到的系统调用不需要在配置中允许
+func applySecurity(user *execUser, spec *InitSpec) error {
+	if !spec.NoNewPrivileges {
+		if err := setupSeccomp(spec.Seccomp); err != nil {
+			return err
+		}
+	}
+	if err := setUserAndCapabilities(user, spec.Capabilities); err != nil {
+		return err
+	}
+	if !spec.NoNewPrivileges {
+		return nil
+	}
+	// no_new_privs 是线程级别的，setUserAndCapabilities 已经把 goroutine 固定在当前线程上
+	if err := prctl(prSetNoNewPrivs, 1, 0); err != nil {
+		return fmt.Errorf("set no_new_privs error %v", err)
+	}
+	return setupSeccomp(spec.Seccomp)
+}
@@ -0,0 +1,66 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSecurityOpts(t *testing.T) {
+	sec, err := ParseSecurityOpts([]string{"unmask=/proc/kcore:/proc/sys/", "unmask=ALL"})
+	if err != nil {
+		t.Fatalf("parse security opts error %v", err)
+	}
+	expect := []string{"/proc/kcore", "/proc/sys", "ALL"}
+	if !reflect.DeepEqual(sec.Unmask, expect) {
+		t.Errorf("unmask got %v, expect %v", sec.Unmask, expect)
+	}
+
+	sec, err = ParseSecurityOpts([]string{"seccomp=unconfined"})
+	if err != nil {
+		t.Fatalf("parse security opts error %v", err)
+	}
+	if sec.Seccomp != SeccompUnconfined {
+		t.Errorf("seccomp got %q, expect %q", sec.Seccomp, SeccompUnconfined)
+	}
+
+	sec, err = ParseSecurityOpts([]string{"no-new-privileges"})
+	if err != nil {
+		t.Fatalf("parse security opts error %v", err)
+	}
+	if sec.NoNewPrivileges == nil || !*sec.NoNewPrivileges {
+		t.Errorf("no-new-privileges should be enabled")
+	}
+	sec, err = ParseSecurityOpts([]string{"no-new-privileges=false"})
+	if err != nil {
+		t.Fatalf("parse security opts error %v", err)
+	}
+	if sec.NoNewPrivileges == nil || *sec.NoNewPrivileges {
+		t.Errorf("no-new-privileges should be disabled")
+	}
+
+	for _, opt := range []string{"unmask", "unmask=", "unmask=proc/kcore", "apparmor=unconfined", "seccomp=", "no-new-privileges=yes"} {
+		if _, err := ParseSecurityOpts([]string{opt}); err == nil {
+			t.Errorf("parse security opt %s should fail", opt)
+		}
+	}
+}
+
+func TestFilterPaths(t *testing.T) {
+	paths := []string{"/proc/kcore", "/proc/sys", "/sys/firmware"}
+	tests := []struct {
+		unmask []string
+		expect []string
+	}{
+		{nil, paths},
+		{[]string{"/proc/kcore"}, []string{"/proc/sys", "/sys/firmware"}},
+		{[]string{"/proc"}, []string{"/sys/firmware"}},
+		{[]string{"/proc/sy"}, paths},
+		{[]string{"ALL"}, []string{}},
+	}
+	for _, test := range tests {
+		got := FilterPaths(paths, test.unmask)
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("filter paths with unmask %v got %v, expect %v", test.unmask, got, test.expect)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// init 配置的版本号，父进程和容器 init 进程的版本不一致时拒绝启动
+const InitSpecVersion = 1
+
+// 用户没有设置 PATH 时使用的默认值
+const DefaultPathEnv = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// 父进程通过管道（fd 3）发送给容器 init 进程的配置
+// 使用 JSON 传递，参数中的空格、引号、空字符串都能原样保留
+type InitSpec struct {
+	Version         int             `json:"version"`
+	Args            []string        `json:"args"`            // 用户指令，Args[0] 为可执行文件
+	Env             []string        `json:"env"`             // 用户进程的全部环境变量，不再继承 init 进程的环境变量
+	Cwd             string          `json:"cwd"`             // 工作目录，默认为 /
+	User            string          `json:"user"`            // 运行用户 name、uid、uid:gid 或 name:group，为空时使用 root
+	Hostname        string          `json:"hostname"`        // 容器主机名，为空时不设置
+	Domainname      string          `json:"domainname"`      // NIS 域名，为空时不设置
+	Init            bool            `json:"init"`            // 是否由 mydocker 作为 1 号进程转发信号、回收僵尸进程
+	Tty             bool            `json:"tty"`             // 是否 -ti 前台运行，标准输入输出是容器自己使用的终端
+	Rlimits         []Rlimit        `json:"rlimits"`         // 资源限制
+	Mounts          []Mount         `json:"mounts"`          // pivot_root 之前完成的挂载
+	ShmSize         int64           `json:"shmSize"`         // /dev/shm 的大小，为 0 时使用默认值
+	MaskedPaths     []string        `json:"maskedPaths"`     // 屏蔽的路径
+	ReadonlyPaths   []string        `json:"readonlyPaths"`   // 只读的路径
+	ReadonlyRootfs  bool            `json:"readonlyRootfs"`  // 根目录是否只读
+	Devices         []Device        `json:"devices"`         // --device 指定的设备
+	Capabilities    []string        `json:"capabilities"`    // 用户进程的能力，为 nil 时不限制
+	Seccomp         *SeccompProfile `json:"seccomp"`         // 已经处理过 includes/excludes 的 seccomp 配置，为 nil 时不使用
+	NoNewPrivileges bool            `json:"noNewPrivileges"` // 设置 no_new_privs，setuid 程序不能获得更多权限
+	CgroupNS        bool            `json:"cgroupNS"`        // 加入容器的 cgroup 之后创建新的 cgroup 命名空间
+	TimeOffsets     []TimeOffset    `json:"timeOffsets"`     // 不为空时创建新的 time 命名空间，用户进程在其中运行
+}
+
+// 进程资源限制，Type 为去掉 RLIMIT_ 前缀的小写名字，例如 nofile
+type Rlimit struct {
+	Type string `json:"type"`
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+// 挂载配置，Source 为宿主机上的路径，Destination 为容器内的路径
+type Mount struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Type        string  `json:"type"`
+	Flags       uintptr `json:"flags"`
+	Data        string  `json:"data"`
+}
+
+// syscall 包中没有定义的资源类型（取值见 /usr/include/asm-generic/resource.h）
+const (
+	rlimitRSS        = 5
+	rlimitNPROC      = 6
+	rlimitMEMLOCK    = 8
+	rlimitLOCKS      = 10
+	rlimitSIGPENDING = 11
+	rlimitMSGQUEUE   = 12
+	rlimitNICE       = 13
+	rlimitRTPRIO     = 14
+	rlimitRTTIME     = 15
+)
+
+// 不限制
+const rlimInfinity = ^uint64(0)
+
+// 支持的资源限制类型
+var RlimitTypes = map[string]int{
+	"as":         syscall.RLIMIT_AS,
+	"core":       syscall.RLIMIT_CORE,
+	"cpu":        syscall.RLIMIT_CPU,
+	"data":       syscall.RLIMIT_DATA,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"locks":      rlimitLOCKS,
+	"memlock":    rlimitMEMLOCK,
+	"msgqueue":   rlimitMSGQUEUE,
+	"nice":       rlimitNICE,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"nproc":      rlimitNPROC,
+	"rss":        rlimitRSS,
+	"rtprio":     rlimitRTPRIO,
+	"rttime":     rlimitRTTIME,
+	"sigpending": rlimitSIGPENDING,
+	"stack":      syscall.RLIMIT_STACK,
+}
+
+// 解析 --ulimit，格式为 name=soft[:hard]，没有 hard 时和 soft 相同，-1 或 unlimited 表示不限制
+func ParseRlimit(value string) (Rlimit, error) {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q, expect name=soft[:hard]", value)
+	}
+	name := strings.ToLower(kv[0])
+	if _, ok := RlimitTypes[name]; !ok {
+		return Rlimit{}, fmt.Errorf("invalid ulimit type %q, supported types: %s", kv[0], strings.Join(rlimitTypeNames(), ", "))
+	}
+	limits := strings.SplitN(kv[1], ":", 2)
+	soft, err := parseRlimitValue(limits[0])
+	if err != nil {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: %v", value, err)
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = parseRlimitValue(limits[1]); err != nil {
+			return Rlimit{}, fmt.Errorf("invalid ulimit %q: %v", value, err)
+		}
+	}
+	if soft > hard {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: soft limit %s is greater than hard limit %s", value, limits[0], limits[len(limits)-1])
+	}
+	return Rlimit{Type: name, Soft: soft, Hard: hard}, nil
+}
+
+// JSON 中不限制用 -1 表示，inspect 输出的值可以直接用在 --ulimit 中
+type rlimitJSON struct {
+	Type string      `json:"type"`
+	Soft json.Number `json:"soft"`
+	Hard json.Number `json:"hard"`
+}
+
+func (r Rlimit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rlimitJSON{
+		Type: r.Type,
+		Soft: json.Number(formatRlimitValue(r.Soft)),
+		Hard: json.Number(formatRlimitValue(r.Hard)),
+	})
+}
+
+// 同时兼容之前写入的 18446744073709551615
+func (r *Rlimit) UnmarshalJSON(data []byte) error {
+	var v rlimitJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	soft, err := parseRlimitValue(v.Soft.String())
+	if err != nil {
+		return fmt.Errorf("invalid rlimit %s: %v", v.Type, err)
+	}
+	hard, err := parseRlimitValue(v.Hard.String())
+	if err != nil {
+		return fmt.Errorf("invalid rlimit %s: %v", v.Type, err)
+	}
+	*r = Rlimit{Type: v.Type, Soft: soft, Hard: hard}
+	return nil
+}
+
+func formatRlimitValue(value uint64) string {
+	if value == rlimInfinity {
+		return "-1"
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+func parseRlimitValue(value string) (uint64, error) {
+	if value == "unlimited" || value == "-1" {
+		return rlimInfinity, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit value %q", value)
+	}
+	return n, nil
+}
+
+func rlimitTypeNames() []string {
+	var names []string
+	for name := range RlimitTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 将 init 配置通过管道发给容器进程
+func SendInitSpec(spec *InitSpec, writePipe *os.File) error {
+	defer writePipe.Close()
+	spec.Version = InitSpecVersion
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("marshal init spec error %v", err)
+	}
+	if _, err := writePipe.Write(data); err != nil {
+		return fmt.Errorf("write init spec error %v", err)
+	}
+	return nil
+}
+
+// 从管道中读取 init 配置
+func readInitSpec() (*InitSpec, error) {
+	// uintptr(3)就是指index为3的文件描述符，也就是传递进来的管道的一端
+	// 一个进程默认会有三个文件描述符 stdin stdout stderr（ ls /proc/self/fd 可以看到默认的文件描述符 ）
+	// cmd.ExtraFiles = []*os.File{readPipe} 设置后就成了第四个
+	pipe := os.NewFile(uintptr(3), "pipe")
+	defer pipe.Close()
+	msg, err := ioutil.ReadAll(pipe) // 会等待父进程写完并关闭管道
+	if err != nil {
+		return nil, fmt.Errorf("init read pipe error %v", err)
+	}
+	spec := &InitSpec{}
+	if err := json.Unmarshal(msg, spec); err != nil {
+		return nil, fmt.Errorf("unmarshal init spec error %v", err)
+	}
+	if spec.Version != InitSpecVersion {
+		return nil, fmt.Errorf("unsupported init spec version %d, expect %d", spec.Version, InitSpecVersion)
+	}
+	if len(spec.Args) == 0 {
+		return nil, fmt.Errorf("Run container get user command error, args is empty")
+	}
+	return spec, nil
+}
@@ -0,0 +1,77 @@
+package container
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseRlimit(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect Rlimit
+	}{
+		{"nofile=1024:65536", Rlimit{Type: "nofile", Soft: 1024, Hard: 65536}},
+		{"nproc=64", Rlimit{Type: "nproc", Soft: 64, Hard: 64}},
+		{"core=0", Rlimit{Type: "core", Soft: 0, Hard: 0}},
+		{"NOFILE=10:unlimited", Rlimit{Type: "nofile", Soft: 10, Hard: rlimInfinity}},
+		{"memlock=-1:-1", Rlimit{Type: "memlock", Soft: rlimInfinity, Hard: rlimInfinity}},
+	}
+	for _, test := range tests {
+		r, err := ParseRlimit(test.value)
+		if err != nil {
+			t.Fatalf("parse ulimit %s error %v", test.value, err)
+		}
+		if r != test.expect {
+			t.Errorf("parse ulimit %s got %+v, expect %+v", test.value, r, test.expect)
+		}
+	}
+
+	for _, value := range []string{"nofile", "nofiles=10", "nofile=abc", "nofile=10:5", "nofile=10:", "nproc=-2"} {
+		if _, err := ParseRlimit(value); err == nil {
+			t.Errorf("parse ulimit %s should fail", value)
+		}
+	}
+	if _, err := ParseRlimit("nofiles=10"); !strings.Contains(err.Error(), "invalid ulimit type") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRlimitJSON(t *testing.T) {
+	tests := []struct {
+		rlimit Rlimit
+		json   string
+	}{
+		{Rlimit{Type: "nofile", Soft: 1024, Hard: 65536}, `{"type":"nofile","soft":1024,"hard":65536}`},
+		{Rlimit{Type: "core", Soft: 0, Hard: rlimInfinity}, `{"type":"core","soft":0,"hard":-1}`},
+		{Rlimit{Type: "memlock", Soft: rlimInfinity, Hard: rlimInfinity}, `{"type":"memlock","soft":-1,"hard":-1}`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.rlimit)
+		if err != nil {
+			t.Fatalf("marshal %+v error %v", test.rlimit, err)
+		}
+		if string(data) != test.json {
+			t.Errorf("marshal %+v got %s, expect %s", test.rlimit, data, test.json)
+		}
+		var r Rlimit
+		if err := json.Unmarshal(data, &r); err != nil {
+			t.Fatalf("unmarshal %s error %v", data, err)
+		}
+		if r != test.rlimit {
+			t.Errorf("unmarshal %s got %+v, expect %+v", data, r, test.rlimit)
+		}
+	}
+
+	// 之前的容器信息中不限制记录为 18446744073709551615
+	var r Rlimit
+	if err := json.Unmarshal([]byte(`{"type":"nofile","soft":10,"hard":18446744073709551615}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Hard != rlimInfinity {
+		t.Errorf("unmarshal hard limit got %d, expect %d", r.Hard, rlimInfinity)
+	}
+	if err := json.Unmarshal([]byte(`{"type":"nofile","soft":-2,"hard":10}`), &r); err == nil {
+		t.Errorf("unmarshal soft limit -2 should fail")
+	}
+}
@@ -0,0 +1,78 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// mydocker run 的退出码，和 docker 保持一致
+const (
+	ExitCodeRuntime       = 125 // 容器运行时自身的错误，例如挂载失败
+	ExitCodeNotExecutable = 126 // 指令不可执行
+	ExitCodeNotFound      = 127 // 找不到指令
+)
+
+// 容器 init 进程出错时通过同步管道（fd 4）发给父进程的错误
+type InitError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *InitError) Error() string {
+	return e.Message
+}
+
+func newInitError(code int, format string, args ...interface{}) *InitError {
+	return &InitError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// 查找或执行指令出错时，根据错误类型区分退出码
+func execError(path string, err error) *InitError {
+	if e, ok := err.(*InitError); ok {
+		return e
+	}
+	if os.IsNotExist(err) || err == syscall.ENOENT {
+		return newInitError(ExitCodeNotFound, "exec %s: no such file or directory", path)
+	}
+	if os.IsPermission(err) || err == syscall.EACCES || err == syscall.ENOEXEC || err == syscall.EISDIR {
+		return newInitError(ExitCodeNotExecutable, "exec %s: permission denied or not executable", path)
+	}
+	return newInitError(ExitCodeRuntime, "exec %s: %v", path, err)
+}
+
+// 获取同步管道，并设置 CLOEXEC
+// 用户进程 exec 成功后管道会被自动关闭，父进程读到 EOF 就知道容器已经启动成功
+func openSyncPipe() *os.File {
+	syscall.CloseOnExec(4)
+	return os.NewFile(uintptr(4), "sync")
+}
+
+// 容器 init 进程把错误写回父进程，后台运行的 exec 也用它把启动错误报告给 mydocker exec -d
+func WriteInitError(pipe *os.File, err error) {
+	initErr, ok := err.(*InitError)
+	if !ok {
+		initErr = newInitError(ExitCodeRuntime, "%v", err)
+	}
+	data, _ := json.Marshal(initErr)
+	pipe.Write(data)
+}
+
+// 父进程等待容器 init 完成初始化，返回 init 进程报告的错误
+func ReadInitError(syncPipe *os.File) error {
+	defer syncPipe.Close()
+	data, err := ioutil.ReadAll(syncPipe)
+	if err != nil {
+		return newInitError(ExitCodeRuntime, "read sync pipe error %v", err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	initErr := &InitError{}
+	if err := json.Unmarshal(data, initErr); err != nil {
+		return newInitError(ExitCodeRuntime, "invalid init error %q", string(data))
+	}
+	return initErr
+}
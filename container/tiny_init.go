@@ -0,0 +1,89 @@
+package container
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// 使用 --init 时，mydocker 自己作为容器的 1 号进程，类似 tini：
+// 1. fork 出用户进程，而不是 exec 替换自己
+// 2. 把收到的信号转发给用户进程（内核不会把没有注册处理函数的信号发给 1 号进程，用户进程作为 1 号进程时 SIGTERM 通常无效）
+// 3. 回收所有孤儿进程，避免产生僵尸进程
+// 4. 用户进程退出后，以它的退出码退出
+func runTinyInit(path string, spec *InitSpec, syncPipe *os.File) error {
+	// 先注册信号，避免用户进程启动后、注册信号前收到的信号丢失
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	// -ti 运行时让用户进程成为终端的前台进程组，Ctrl-C 等信号由终端直接发给它
+	// 没有 -ti 时标准输入不是容器的终端，即使它是终端也不能修改它的前台进程组
+	if spec.Tty && isControllingTerminal(0) {
+		attr.Foreground = true
+		attr.Ctty = 0
+	}
+	process, err := os.StartProcess(path, spec.Args, &os.ProcAttr{
+		Env:   spec.Env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   attr,
+	})
+	if err != nil {
+		return execError(spec.Args[0], unwrapPathError(err))
+	}
+	// 用户进程已经启动，关闭同步管道通知父进程容器启动成功
+	syncPipe.Close()
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+			if status, exited := reapChildren(process.Pid); exited {
+				os.Exit(exitStatus(status))
+			}
+		case syscall.SIGURG:
+			// go runtime 抢占调度使用的信号，不需要转发
+		default:
+			if err := syscall.Kill(process.Pid, sig.(syscall.Signal)); err != nil && err != syscall.ESRCH {
+				log.Warnf("forward signal %v error %v", sig, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 回收所有已经退出的子进程，返回用户进程是否已经退出以及它的退出状态
+func reapChildren(childPid int) (syscall.WaitStatus, bool) {
+	var childStatus syscall.WaitStatus
+	exited := false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			return childStatus, exited
+		}
+		if pid == childPid {
+			childStatus = status
+			exited = true
+		}
+	}
+}
+
+// 和 shell 一样，被信号结束时退出码为 128+信号值
+func exitStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+func unwrapPathError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
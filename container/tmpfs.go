@@ -0,0 +1,92 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// --tmpfs 默认的挂载参数，和 docker 相同
+const defaultTmpfsFlags = syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
+
+// --tmpfs 中可以使用的挂载标志，clear 为 true 时清除对应的标志，否则设置
+var tmpfsFlagOptions = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":          {false, syscall.MS_RDONLY},
+	"rw":          {true, syscall.MS_RDONLY},
+	"noexec":      {false, syscall.MS_NOEXEC},
+	"exec":        {true, syscall.MS_NOEXEC},
+	"nosuid":      {false, syscall.MS_NOSUID},
+	"suid":        {true, syscall.MS_NOSUID},
+	"nodev":       {false, syscall.MS_NODEV},
+	"dev":         {true, syscall.MS_NODEV},
+	"sync":        {false, syscall.MS_SYNCHRONOUS},
+	"async":       {true, syscall.MS_SYNCHRONOUS},
+	"noatime":     {false, syscall.MS_NOATIME},
+	"atime":       {true, syscall.MS_NOATIME},
+	"nodiratime":  {false, syscall.MS_NODIRATIME},
+	"diratime":    {true, syscall.MS_NODIRATIME},
+	"relatime":    {false, syscall.MS_RELATIME},
+	"norelatime":  {true, syscall.MS_RELATIME},
+	"strictatime": {false, syscall.MS_STRICTATIME},
+}
+
+// 传给 tmpfs 文件系统的参数
+var tmpfsDataOptions = map[string]bool{
+	"size":      true,
+	"nr_blocks": true,
+	"nr_inodes": true,
+	"mode":      true,
+	"uid":       true,
+	"gid":       true,
+	"huge":      true,
+	"mpol":      true,
+}
+
+// 解析 --tmpfs，格式为 <容器内路径>[:<参数>]，例如 /run:size=64m,mode=1777
+// 参数中的 ro、noexec 等转换为挂载标志，size、mode 等原样传给 tmpfs
+func ParseTmpfs(value string) (Mount, error) {
+	parts := strings.SplitN(value, ":", 2)
+	dest := parts[0]
+	if !filepath.IsAbs(dest) {
+		return Mount{}, fmt.Errorf("invalid tmpfs %q, mount destination must be an absolute path", value)
+	}
+	dest = filepath.Clean(dest)
+	if dest == "/" {
+		return Mount{}, fmt.Errorf("invalid tmpfs %q, mount destination can not be /", value)
+	}
+
+	m := Mount{Source: "tmpfs", Destination: dest, Type: "tmpfs", Flags: defaultTmpfsFlags}
+	if len(parts) == 1 || parts[1] == "" {
+		return m, nil
+	}
+	var data []string
+	for _, opt := range strings.Split(parts[1], ",") {
+		if f, ok := tmpfsFlagOptions[opt]; ok {
+			if f.clear {
+				m.Flags &^= f.flag
+			} else {
+				m.Flags |= f.flag
+			}
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" || !tmpfsDataOptions[kv[0]] {
+			return Mount{}, fmt.Errorf("invalid tmpfs %q, unknown option %q", value, opt)
+		}
+		data = append(data, opt)
+	}
+	m.Data = strings.Join(data, ",")
+	return m, nil
+}
+
+// 把根目录 remount 为只读，/proc、/dev、数据卷等单独的挂载不受影响
+func remountRootfsReadonly() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount rootfs read-only error %v", err)
+	}
+	return nil
+}
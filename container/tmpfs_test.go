@@ -0,0 +1,34 @@
+package container
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseTmpfs(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect Mount
+	}{
+		{"/run", Mount{Source: "tmpfs", Destination: "/run", Type: "tmpfs", Flags: defaultTmpfsFlags}},
+		{"/run/", Mount{Source: "tmpfs", Destination: "/run", Type: "tmpfs", Flags: defaultTmpfsFlags}},
+		{"/run:size=64m,mode=1777", Mount{Source: "tmpfs", Destination: "/run", Type: "tmpfs", Flags: defaultTmpfsFlags, Data: "size=64m,mode=1777"}},
+		{"/tmp:ro,exec,uid=1000", Mount{Source: "tmpfs", Destination: "/tmp", Type: "tmpfs",
+			Flags: syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV, Data: "uid=1000"}},
+	}
+	for _, test := range tests {
+		m, err := ParseTmpfs(test.value)
+		if err != nil {
+			t.Fatalf("parse tmpfs %s error %v", test.value, err)
+		}
+		if m != test.expect {
+			t.Errorf("parse tmpfs %s got %+v, expect %+v", test.value, m, test.expect)
+		}
+	}
+
+	for _, value := range []string{"", "run", "/", "/run:foo", "/run:size=", "/run:bar=1"} {
+		if _, err := ParseTmpfs(value); err == nil {
+			t.Errorf("parse tmpfs %s should fail", value)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 容器内用户信息从容器 rootfs 的这两个文件中查找，而不是宿主机的
+const (
+	PasswdPath = "/etc/passwd"
+	GroupPath  = "/etc/group"
+)
+
+// /etc/passwd 中的一行: name:password:uid:gid:gecos:home:shell
+type passwdEntry struct {
+	Name string
+	Uid  int
+	Gid  int
+	Home string
+}
+
+// /etc/group 中的一行: name:password:gid:user1,user2
+type groupEntry struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+// 用户进程最终使用的身份
+type execUser struct {
+	Uid   int
+	Gid   int
+	Sgids []int  // 附加组
+	Home  string // 家目录，用于设置 HOME
+}
+
+func parsePasswd(r io.Reader) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := parseColonFile(r, func(fields []string) {
+		if len(fields) < 6 {
+			return
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{Name: fields[0], Uid: uid, Gid: gid, Home: fields[5]})
+	})
+	return entries, err
+}
+
+func parseGroup(r io.Reader) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := parseColonFile(r, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		entry := groupEntry{Name: fields[0], Gid: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			entry.Members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+// 按行解析以冒号分隔的文件，跳过空行和注释
+func parseColonFile(r io.Reader, fn func(fields []string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+// 解析 --user，支持 name、uid、uid:gid、name:group 等格式
+// 用户名和组名在容器 rootfs 的 passwd/group 中查找；数字 uid 在 passwd 中不存在时也允许使用，此时 gid 为 0，家目录为 /
+// 附加组为 group 文件中包含该用户的所有组
+func resolveUser(user string, passwd, group io.Reader) (*execUser, error) {
+	u := &execUser{Uid: 0, Gid: 0, Home: "/"}
+	if user == "" {
+		user = "0"
+	}
+	parts := strings.SplitN(user, ":", 2)
+	userArg := parts[0]
+	if userArg == "" {
+		return nil, fmt.Errorf("invalid user %q", user)
+	}
+
+	var users []passwdEntry
+	if passwd != nil {
+		var err error
+		if users, err = parsePasswd(passwd); err != nil {
+			return nil, fmt.Errorf("parse passwd file error %v", err)
+		}
+	}
+	var groups []groupEntry
+	if group != nil {
+		var err error
+		if groups, err = parseGroup(group); err != nil {
+			return nil, fmt.Errorf("parse group file error %v", err)
+		}
+	}
+
+	uid, uidErr := strconv.Atoi(userArg)
+	userName := ""
+	found := false
+	for _, entry := range users {
+		if (uidErr == nil && entry.Uid == uid) || (uidErr != nil && entry.Name == userArg) {
+			u.Uid = entry.Uid
+			u.Gid = entry.Gid
+			u.Home = entry.Home
+			userName = entry.Name
+			found = true
+			break
+		}
+	}
+	if !found {
+		if uidErr != nil {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userArg)
+		}
+		if uid < 0 {
+			return nil, fmt.Errorf("invalid uid %d", uid)
+		}
+		u.Uid = uid
+	}
+
+	if len(parts) == 2 {
+		groupArg := parts[1]
+		gid, gidErr := strconv.Atoi(groupArg)
+		if gidErr == nil {
+			if gid < 0 {
+				return nil, fmt.Errorf("invalid gid %d", gid)
+			}
+			u.Gid = gid
+		} else {
+			found := false
+			for _, g := range groups {
+				if g.Name == groupArg {
+					u.Gid = g.Gid
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unable to find group %s: no matching entries in group file", groupArg)
+			}
+		}
+	}
+
+	// 附加组
+	if userName != "" {
+		for _, g := range groups {
+			for _, member := range g.Members {
+				if member == userName {
+					u.Sgids = append(u.Sgids, g.Gid)
+					break
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// 在当前 rootfs 中解析用户，passwd/group 文件不存在时只支持数字 uid/gid
+func lookupUser(user string) (*execUser, error) {
+	var passwd, group io.Reader
+	if f, err := os.Open(PasswdPath); err == nil {
+		defer f.Close()
+		passwd = f
+	}
+	if f, err := os.Open(GroupPath); err == nil {
+		defer f.Close()
+		group = f
+	}
+	return resolveUser(user, passwd, group)
+}
+
+// 切换到指定的用户
+func setUser(u *execUser) error {
+	// 先设置组，切换到非 root 用户之后就没有权限再设置了
+	sgids := u.Sgids
+	if sgids == nil {
+		sgids = []int{}
+	}
+	// rootless 模式下只映射了当前用户时 user 命名空间禁止了 setgroups，只能保留原来的附加组
+	if !setgroupsDenied() {
+		if err := syscall.Setgroups(sgids); err != nil {
+			return fmt.Errorf("setgroups error %v", err)
+		}
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf("setgid %d error %v", u.Gid, err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf("setuid %d error %v", u.Uid, err)
+	}
+	return nil
+}
+
+func setgroupsDenied() bool {
+	content, err := ioutil.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(content)) == "deny"
+}
+
+// 没有设置 HOME 时使用用户的家目录
+func withHomeEnv(env []string, home string) []string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "HOME=") {
+			return env
+		}
+	}
+	return append(env, "HOME="+home)
+}
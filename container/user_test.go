@@ -0,0 +1,61 @@
+package container
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/bash
+# comment
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+app:x:1000:1000::/home/app:/bin/sh
+`
+
+const testGroup = `root:x:0:
+wheel:x:10:app,other
+app:x:1000:
+audio:x:29:app
+`
+
+func TestResolveUser(t *testing.T) {
+	tests := []struct {
+		user   string
+		expect execUser
+	}{
+		{"", execUser{Uid: 0, Gid: 0, Home: "/root"}},
+		{"app", execUser{Uid: 1000, Gid: 1000, Sgids: []int{10, 29}, Home: "/home/app"}},
+		{"1000", execUser{Uid: 1000, Gid: 1000, Sgids: []int{10, 29}, Home: "/home/app"}},
+		{"app:wheel", execUser{Uid: 1000, Gid: 10, Sgids: []int{10, 29}, Home: "/home/app"}},
+		{"nobody:5", execUser{Uid: 65534, Gid: 5, Home: "/nonexistent"}},
+		// passwd 中不存在的数字 uid
+		{"2000", execUser{Uid: 2000, Gid: 0, Home: "/"}},
+		{"2000:2000", execUser{Uid: 2000, Gid: 2000, Home: "/"}},
+	}
+	for _, test := range tests {
+		u, err := resolveUser(test.user, strings.NewReader(testPasswd), strings.NewReader(testGroup))
+		if err != nil {
+			t.Fatalf("resolve user %q error %v", test.user, err)
+		}
+		if !reflect.DeepEqual(*u, test.expect) {
+			t.Errorf("resolve user %q got %+v, expect %+v", test.user, *u, test.expect)
+		}
+	}
+
+	for _, user := range []string{"nosuch", "app:nosuch", ":0", "-1"} {
+		if _, err := resolveUser(user, strings.NewReader(testPasswd), strings.NewReader(testGroup)); err == nil {
+			t.Errorf("resolve user %q should fail", user)
+		}
+	}
+}
+
+func TestWithHomeEnv(t *testing.T) {
+	env := withHomeEnv([]string{"PATH=/bin"}, "/home/app")
+	if !reflect.DeepEqual(env, []string{"PATH=/bin", "HOME=/home/app"}) {
+		t.Fatalf("unexpected env %v", env)
+	}
+	env = withHomeEnv([]string{"HOME=/data"}, "/home/app")
+	if !reflect.DeepEqual(env, []string{"HOME=/data"}) {
+		t.Fatalf("unexpected env %v", env)
+	}
+}
@@ -0,0 +1,299 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	SubuidFile = "/etc/subuid"
+	SubgidFile = "/etc/subgid"
+	// --userns=host 表示不使用 user 命名空间
+	UsernsHost = "host"
+)
+
+// 使用 user 命名空间时 mydocker 的数据目录，<uid>.<gid> 为容器内 root 对应的宿主机 ID
+// 修改过属主的镜像解压目录、容器的挂载点和可写层都在这个目录下
+var RemappedRootUrl = "/var/lib/mydocker/%d.%d"
+
+// uid/gid 映射，容器内从 ContainerID 开始的 Size 个 ID 对应宿主机上从 HostID 开始的 ID
+type IDMap struct {
+	ContainerID int `json:"containerID"`
+	HostID      int `json:"hostID"`
+	Size        int `json:"size"`
+}
+
+// 根据 --userns-remap 的 user[:group] 从 /etc/subuid、/etc/subgid 中生成映射
+// 没有指定 group 时使用和用户同名的组
+func LoadRemapIDMaps(remap string) ([]IDMap, []IDMap, error) {
+	userName, groupName := remap, remap
+	if i := strings.Index(remap, ":"); i >= 0 {
+		userName, groupName = remap[:i], remap[i+1:]
+	}
+	u, err := lookupRemapUser(userName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if groupName == remap {
+		groupName = u.Username
+	}
+	g, err := lookupRemapGroup(groupName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := ioutil.ReadFile(SubuidFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s error %v", SubuidFile, err)
+	}
+	uidMaps := parseSubIDs(content, u.Username, u.Uid)
+	if len(uidMaps) == 0 {
+		return nil, nil, fmt.Errorf("no subordinate uid range found for user %s in %s", u.Username, SubuidFile)
+	}
+	content, err = ioutil.ReadFile(SubgidFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s error %v", SubgidFile, err)
+	}
+	gidMaps := parseSubIDs(content, g.Name, g.Gid)
+	if len(gidMaps) == 0 {
+		return nil, nil, fmt.Errorf("no subordinate gid range found for group %s in %s", g.Name, SubgidFile)
+	}
+	return uidMaps, gidMaps, nil
+}
+
+func lookupRemapUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup userns-remap user %s error %v", name, err)
+	}
+	return u, nil
+}
+
+func lookupRemapGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if g, err := user.LookupGroupId(name); err == nil {
+			return g, nil
+		}
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup userns-remap group %s error %v", name, err)
+	}
+	return g, nil
+}
+
+// 解析 /etc/subuid 格式的内容，每行为 <名字或 ID>:<起始 ID>:<数量>
+// 同一个用户的多个范围依次映射到容器内从 0 开始的连续 ID
+func parseSubIDs(content []byte, name, id string) []IDMap {
+	var maps []IDMap
+	containerID := 0
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != id) {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		size, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || size <= 0 {
+			continue
+		}
+		maps = append(maps, IDMap{ContainerID: containerID, HostID: start, Size: size})
+		containerID += size
+	}
+	return maps
+}
+
+// 容器内的 ID 对应的宿主机 ID
+func HostID(id int, maps []IDMap) (int, bool) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// 宿主机上的 ID 对应的容器内 ID
+func ContainerID(id int, maps []IDMap) (int, bool) {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID, true
+		}
+	}
+	return 0, false
+}
+
+// 容器内 root 在宿主机上的 uid、gid，没有映射时为 0
+func RemappedRoot(uidMaps, gidMaps []IDMap) (int, int) {
+	uid, _ := HostID(0, uidMaps)
+	gid, _ := HostID(0, gidMaps)
+	return uid, gid
+}
+
+// 镜像只读层的目录，使用 user 命名空间时为按映射修改过属主的副本
+func ImageLayerUrl(imageName string, uidMaps, gidMaps []IDMap) string {
+	if len(uidMaps) == 0 {
+		return RootUrl + "/" + imageName
+	}
+	return remappedRootDir(uidMaps, gidMaps) + "/" + imageName
+}
+
+// 容器的挂载点，使用 user 命名空间时在 mydocker 的数据目录下，容器内的 root 不需要能进入 /root
+func ContainerMntUrl(containerName string, uidMaps, gidMaps []IDMap) string {
+	if len(uidMaps) == 0 {
+		return fmt.Sprintf(MntUrl, containerName)
+	}
+	return remappedRootDir(uidMaps, gidMaps) + "/mnt/" + containerName
+}
+
+// 容器的可写层目录，使用 user 命名空间时和挂载点放在一起
+func ContainerWriteLayerUrl(containerName string, uidMaps, gidMaps []IDMap) string {
+	if len(uidMaps) == 0 {
+		return fmt.Sprintf(WriteLayerUrl, containerName)
+	}
+	return remappedRootDir(uidMaps, gidMaps) + "/writeLayer/" + containerName
+}
+
+func remappedRootDir(uidMaps, gidMaps []IDMap) string {
+	uid, gid := RemappedRoot(uidMaps, gidMaps)
+	return fmt.Sprintf(RemappedRootUrl, uid, gid)
+}
+
+// 创建使用 user 命名空间的容器的数据目录，容器内的 root 在宿主机上是普通用户，需要能进入这个目录访问挂载点
+// 数据目录和它的上级目录都由 mydocker 创建，权限设置为 0711，不修改 /root 等宿主机上已有目录的权限
+func CreateRemappedRoot(uidMaps, gidMaps []IDMap) error {
+	dir := remappedRootDir(uidMaps, gidMaps)
+	for _, path := range []string{filepath.Dir(dir), dir} {
+		if err := os.MkdirAll(path, 0711); err != nil {
+			return fmt.Errorf("mkdir %s error %v", path, err)
+		}
+		if err := os.Chmod(path, 0711); err != nil {
+			return fmt.Errorf("chmod %s error %v", path, err)
+		}
+	}
+	return nil
+}
+
+func SysProcIDMaps(maps []IDMap) []syscall.SysProcIDMap {
+	var result []syscall.SysProcIDMap
+	for _, m := range maps {
+		result = append(result, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return result
+}
+
+// 容器内的 root 在宿主机上不是 root，需要能进入这些目录才能访问 rootfs 和 bind mount 的文件
+func AllowTraverse(paths ...string) error {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&0111 == 0111 {
+			continue
+		}
+		if err := os.Chmod(path, info.Mode().Perm()|0111); err != nil {
+			return fmt.Errorf("chmod %s error %v", path, err)
+		}
+	}
+	return nil
+}
+
+// 当前进程是否在宿主机之外的 user 命名空间中
+func runningInUserNS() bool {
+	content, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(content))
+	return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295")
+}
+
+// 读取 /proc/<pid>/uid_map、gid_map 中当前 user 命名空间的映射
+func procIDMaps(file string) []IDMap {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return parseProcIDMaps(content)
+}
+
+// 每行为 <命名空间中的起始 ID> <父命名空间中的起始 ID> <数量>
+func parseProcIDMaps(content []byte) []IDMap {
+	var maps []IDMap
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		containerID, err1 := strconv.Atoi(fields[0])
+		hostID, err2 := strconv.Atoi(fields[1])
+		size, err3 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		maps = append(maps, IDMap{ContainerID: containerID, HostID: hostID, Size: int(size)})
+	}
+	return maps
+}
+
+// 生成 tar --owner-map、--group-map 的内容，把宿主机上的 ID 还原为容器内的 ID
+// 只包含目录中实际用到的 ID，oneFileSystem 为 true 时和 tar --one-file-system 一样不进入其它文件系统
+func TarIDMaps(dir string, uidMaps, gidMaps []IDMap, oneFileSystem bool) ([]byte, []byte, error) {
+	uids, gids := map[int]bool{}, map[int]bool{}
+	var rootDev uint64
+	if info, err := os.Stat(dir); err == nil {
+		rootDev = uint64(info.Sys().(*syscall.Stat_t).Dev)
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if oneFileSystem && info.IsDir() && uint64(st.Dev) != rootDev {
+				return filepath.SkipDir
+			}
+			uids[int(st.Uid)] = true
+			gids[int(st.Gid)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tarIDMap(uids, uidMaps), tarIDMap(gids, gidMaps), nil
+}
+
+func tarIDMap(ids map[int]bool, maps []IDMap) []byte {
+	var sorted []int
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+	var buf bytes.Buffer
+	for _, id := range sorted {
+		if cid, ok := ContainerID(id, maps); ok {
+			fmt.Fprintf(&buf, "+%d +%d\n", id, cid)
+		}
+	}
+	return buf.Bytes()
+}
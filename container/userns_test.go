@@ -0,0 +1,92 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSubIDs(t *testing.T) {
+	content := []byte(`# comment
+alice:100000:65536
+bob:200000:65536
+1000:300000:1000
+alice:400000:bad
+alice:500000:10
+`)
+	tests := []struct {
+		name, id string
+		expect   []IDMap
+	}{
+		{"alice", "1001", []IDMap{{0, 100000, 65536}, {65536, 500000, 10}}},
+		{"carol", "1000", []IDMap{{0, 300000, 1000}}},
+		{"dave", "1002", nil},
+	}
+	for _, test := range tests {
+		got := parseSubIDs(content, test.name, test.id)
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("parse sub ids for %s got %v, expect %v", test.name, got, test.expect)
+		}
+	}
+}
+
+func TestParseProcIDMaps(t *testing.T) {
+	content := []byte("         0       1000          1\n         1     100000      65536\nbad line\n")
+	expect := []IDMap{{0, 1000, 1}, {1, 100000, 65536}}
+	if got := parseProcIDMaps(content); !reflect.DeepEqual(got, expect) {
+		t.Errorf("parse proc id maps got %v, expect %v", got, expect)
+	}
+	full := parseProcIDMaps([]byte("0 0 4294967295\n"))
+	if _, ok := HostID(5, full); len(full) != 1 || !ok {
+		t.Errorf("parse full proc id map got %v", full)
+	}
+}
+
+func TestIDMapping(t *testing.T) {
+	maps := []IDMap{{0, 100000, 1000}, {1000, 500000, 10}}
+	tests := []struct {
+		containerID, hostID int
+	}{
+		{0, 100000},
+		{999, 100999},
+		{1000, 500000},
+		{1009, 500009},
+	}
+	for _, test := range tests {
+		if got, ok := HostID(test.containerID, maps); !ok || got != test.hostID {
+			t.Errorf("host id of %d got %d %v, expect %d", test.containerID, got, ok, test.hostID)
+		}
+		if got, ok := ContainerID(test.hostID, maps); !ok || got != test.containerID {
+			t.Errorf("container id of %d got %d %v, expect %d", test.hostID, got, ok, test.containerID)
+		}
+	}
+	if _, ok := HostID(1010, maps); ok {
+		t.Errorf("container id 1010 should not be mapped")
+	}
+	if _, ok := ContainerID(0, maps); ok {
+		t.Errorf("host id 0 should not be mapped")
+	}
+
+	if got := ImageLayerUrl("busybox", nil, nil); got != "/root/busybox" {
+		t.Errorf("image layer url without maps got %s", got)
+	}
+	gidMaps := []IDMap{{0, 200000, 1000}}
+	if got := ImageLayerUrl("busybox", maps, gidMaps); got != "/var/lib/mydocker/100000.200000/busybox" {
+		t.Errorf("image layer url with maps got %s", got)
+	}
+	// 使用 user 命名空间时挂载点和可写层不在 /root 下
+	if got := ContainerMntUrl("web", nil, nil); got != "/root/mnt/web" {
+		t.Errorf("mount point without maps got %s", got)
+	}
+	if got := ContainerMntUrl("web", maps, gidMaps); got != "/var/lib/mydocker/100000.200000/mnt/web" {
+		t.Errorf("mount point with maps got %s", got)
+	}
+	if got := ContainerWriteLayerUrl("web", maps, gidMaps); got != "/var/lib/mydocker/100000.200000/writeLayer/web" {
+		t.Errorf("write layer with maps got %s", got)
+	}
+
+	ids := map[int]bool{100000: true, 0: true, 500001: true}
+	expect := "+100000 +0\n+500001 +1001\n"
+	if got := string(tarIDMap(ids, maps)); got != expect {
+		t.Errorf("tar id map got %q, expect %q", got, expect)
+	}
+}
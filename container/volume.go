@@ -10,24 +10,41 @@ import (
 
 // 为当前容器创建 AUFS文件系统
 //Create a AUFS filesystem as container root workspace
-func NewWorkSpace(volume, imageName, containerName string) {
-	CreateReadOnlyLayer(imageName)             // 创建只读层（解压镜像文件）
-	CreateWriteLayer(containerName)            // 创建容器可写层目录
-	CreateMountPoint(containerName, imageName) // 进行aufs文件系统挂载
+// 使用 user 命名空间时 uidMaps、gidMaps 不为空，各层目录的属主都按映射设置为容器内 root 对应的宿主机用户
+// 镜像解压或挂载失败时返回错误，并删除已经创建的可写层和挂载点，不能让容器运行在空的挂载点上
+func NewWorkSpace(volume, imageName, containerName string, uidMaps, gidMaps []IDMap) error {
+	if err := CreateReadOnlyLayer(imageName); err != nil { // 创建只读层（解压镜像文件）
+		return err
+	}
+	if len(uidMaps) > 0 {
+		if err := CreateRemappedLayer(imageName, uidMaps, gidMaps); err != nil { // 按映射修改属主的只读层
+			return err
+		}
+	}
+	if err := CreateWriteLayer(containerName, uidMaps, gidMaps); err != nil { // 创建容器可写层目录
+		return err
+	}
+	if err := CreateMountPoint(containerName, imageName, uidMaps, gidMaps); err != nil { // 进行aufs文件系统挂载
+		os.Remove(ContainerMntUrl(containerName, uidMaps, gidMaps))
+		DeleteWriteLayer(containerName, uidMaps, gidMaps)
+		return err
+	}
 	if volume != "" {
 		volumeURLs := strings.Split(volume, ":")
 		length := len(volumeURLs)
 		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			MountVolume(volumeURLs, containerName) // 挂载到宿主机目录
+			MountVolume(volumeURLs, containerName, uidMaps, gidMaps) // 挂载到宿主机目录
 			log.Infof("NewWorkSpace volume urls %q", volumeURLs)
 		} else {
 			log.Infof("Volume parameter input is not correct.")
 		}
 	}
+	return nil
 }
 
 // 解压镜像文件
 //Decompression tar image
+// 在进程内解压，镜像中的路径不会超出解压目录，解压失败时不会留下解压了一半的目录
 func CreateReadOnlyLayer(imageName string) error {
 	unTarFolderUrl := RootUrl + "/" + imageName + "/" //镜像解压目录
 	imageUrl := RootUrl + "/" + imageName + ".tar"    // 指定的镜像文件路径
@@ -37,36 +54,66 @@ func CreateReadOnlyLayer(imageName string) error {
 		return err
 	}
 	if !exist {
-		// 创建镜像解压目录
-		if err := os.MkdirAll(unTarFolderUrl, 0622); err != nil {
-			log.Errorf("Mkdir %s error %v", unTarFolderUrl, err)
-			return err
-		}
 		// 解压镜像
-		if _, err := exec.Command("tar", "-xvf", imageUrl, "-C", unTarFolderUrl).CombinedOutput(); err != nil {
-			log.Errorf("Untar dir %s error %v", unTarFolderUrl, err)
-			return err
+		if err := ExtractImage(imageUrl, unTarFolderUrl, nil, nil); err != nil {
+			return fmt.Errorf("Untar dir %s error %v", unTarFolderUrl, err)
 		}
 	}
 	return nil
 }
 
-// 创建容器可写层目录
-func CreateWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
+// 解压镜像文件到 /var/lib/mydocker/<uid>.<gid>/<镜像名>，解压时把属主改为宿主机上对应的 ID
+// 容器内的 root 在宿主机上只是普通用户，属主不改的话容器内无法修改镜像中的文件
+func CreateRemappedLayer(imageName string, uidMaps, gidMaps []IDMap) error {
+	if err := CreateRemappedRoot(uidMaps, gidMaps); err != nil {
+		return fmt.Errorf("Create remapped root dir error %v", err)
+	}
+	unTarFolderUrl := ImageLayerUrl(imageName, uidMaps, gidMaps) + "/"
+	imageUrl := RootUrl + "/" + imageName + ".tar"
+	exist, err := PathExists(unTarFolderUrl)
+	if err != nil {
+		log.Infof("Fail to judge whether dir %s exists. %v", unTarFolderUrl, err)
+		return err
+	}
+	if exist {
+		return nil
+	}
+	if err := ExtractImage(imageUrl, unTarFolderUrl, uidMaps, gidMaps); err != nil {
+		return fmt.Errorf("Untar dir %s error %v", unTarFolderUrl, err)
+	}
+	return nil
+}
+
+// 创建容器可写层目录，使用 user 命名空间时属主改不过来，容器内的 root 无法写入，同样作为错误返回
+func CreateWriteLayer(containerName string, uidMaps, gidMaps []IDMap) error {
+	writeURL := ContainerWriteLayerUrl(containerName, uidMaps, gidMaps)
 	if err := os.MkdirAll(writeURL, 0777); err != nil {
-		log.Infof("Mkdir write layer dir %s error. %v", writeURL, err)
+		return fmt.Errorf("Mkdir write layer dir %s error %v", writeURL, err)
 	}
+	if len(uidMaps) > 0 {
+		uid, gid := RemappedRoot(uidMaps, gidMaps)
+		if err := os.Chown(writeURL, uid, gid); err != nil {
+			DeleteWriteLayer(containerName, uidMaps, gidMaps)
+			return fmt.Errorf("Chown write layer dir %s error %v", writeURL, err)
+		}
+	}
+	return nil
 }
 
 // 挂载目录，将容器外目录挂载到容器内目录，由此可以把数据存到容器外
-func MountVolume(volumeURLs []string, containerName string) error {
+// 使用 user 命名空间时，新创建的容器外目录属主为容器内 root 对应的宿主机用户
+func MountVolume(volumeURLs []string, containerName string, uidMaps, gidMaps []IDMap) error {
 	parentUrl := volumeURLs[0] // 容器外目录
 	if err := os.Mkdir(parentUrl, 0777); err != nil {
 		log.Infof("Mkdir parent dir %s error. %v", parentUrl, err)
+	} else if len(uidMaps) > 0 {
+		uid, gid := RemappedRoot(uidMaps, gidMaps)
+		if err := os.Chown(parentUrl, uid, gid); err != nil {
+			log.Errorf("Chown volume dir %s error %v", parentUrl, err)
+		}
 	}
 	containerUrl := volumeURLs[1]                     //容器内目录
-	mntURL := fmt.Sprintf(MntUrl, containerName)      //挂载点路径
+	mntURL := ContainerMntUrl(containerName, uidMaps, gidMaps) //挂载点路径
 	containerVolumeURL := mntURL + "/" + containerUrl //宿主机上的容器目录
 	if err := os.Mkdir(containerVolumeURL, 0777); err != nil {
 		log.Infof("Mkdir container dir %s error. %v", containerVolumeURL, err)
@@ -81,46 +128,45 @@ func MountVolume(volumeURLs []string, containerName string) error {
 }
 
 // 将镜像解压目录和容器可写层目录进行 aufs文件系统挂载
-func CreateMountPoint(containerName, imageName string) error {
-	mntUrl := fmt.Sprintf(MntUrl, containerName)
+func CreateMountPoint(containerName, imageName string, uidMaps, gidMaps []IDMap) error {
+	mntUrl := ContainerMntUrl(containerName, uidMaps, gidMaps)
 	if err := os.MkdirAll(mntUrl, 0777); err != nil {
-		log.Errorf("Mkdir mountpoint dir %s error. %v", mntUrl, err)
-		return err
+		return fmt.Errorf("Mkdir mountpoint dir %s error %v", mntUrl, err)
 	}
-	tmpWriteLayer := fmt.Sprintf(WriteLayerUrl, containerName) //容器可写层目录
-	tmpImageLocation := RootUrl + "/" + imageName              // 镜像解压目录
-	mntURL := fmt.Sprintf(MntUrl, containerName)               // 挂载点
+	tmpWriteLayer := ContainerWriteLayerUrl(containerName, uidMaps, gidMaps) //容器可写层目录
+	tmpImageLocation := ImageLayerUrl(imageName, uidMaps, gidMaps)           // 镜像解压目录
 	// 从左向右，默认第一个是可读写层，后面都是只读层
 	dirs := "dirs=" + tmpWriteLayer + ":" + tmpImageLocation
 	// 参考： https://www.cnblogs.com/sparkdev/p/11237347.html
-	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntURL).CombinedOutput()
+	output, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntUrl).CombinedOutput()
 	// mount aufs参考
 	// https://segmentfault.com/a/1190000008489207
 	// http://manpages.ubuntu.com/manpages/xenial/en/man5/aufs.5.html
 	if err != nil {
-		log.Errorf("Run command for creating mount point failed %v", err)
-		return err
+		return fmt.Errorf("Mount aufs on %s error %v, %s", mntUrl, err, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
 //Delete the AUFS filesystem while container exit
-func DeleteWorkSpace(volume, containerName string) {
+// uidMaps、gidMaps 为容器使用的映射，用来找到挂载点和可写层
+func DeleteWorkSpace(volume, containerName string, uidMaps, gidMaps []IDMap) {
 	if volume != "" {
 		volumeURLs := strings.Split(volume, ":")
 		length := len(volumeURLs)
 		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			DeleteVolume(volumeURLs, containerName)
+			DeleteVolume(volumeURLs, containerName, uidMaps, gidMaps)
 		}
 	}
-	DeleteMountPoint(containerName)
-	DeleteWriteLayer(containerName)
+	DeleteMountPoint(containerName, uidMaps, gidMaps)
+	DeleteWriteLayer(containerName, uidMaps, gidMaps)
 }
 
-func DeleteMountPoint(containerName string) error {
-	mntURL := fmt.Sprintf(MntUrl, containerName)
+func DeleteMountPoint(containerName string, uidMaps, gidMaps []IDMap) error {
+	mntURL := ContainerMntUrl(containerName, uidMaps, gidMaps)
+	// rootless 模式下挂载只存在于 run 所在的 mount 命名空间中，后台运行的容器退出后挂载就不存在了
 	_, err := exec.Command("umount", mntURL).CombinedOutput()
-	if err != nil {
+	if err != nil && !Rootless() {
 		log.Errorf("Unmount %s error %v", mntURL, err)
 		return err
 	}
@@ -131,18 +177,18 @@ func DeleteMountPoint(containerName string) error {
 	return nil
 }
 
-func DeleteVolume(volumeURLs []string, containerName string) error {
-	mntURL := fmt.Sprintf(MntUrl, containerName)
+func DeleteVolume(volumeURLs []string, containerName string, uidMaps, gidMaps []IDMap) error {
+	mntURL := ContainerMntUrl(containerName, uidMaps, gidMaps)
 	containerUrl := mntURL + "/" + volumeURLs[1]
-	if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
+	if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil && !Rootless() {
 		log.Errorf("Umount volume %s failed. %v", containerUrl, err)
 		return err
 	}
 	return nil
 }
 
-func DeleteWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
+func DeleteWriteLayer(containerName string, uidMaps, gidMaps []IDMap) {
+	writeURL := ContainerWriteLayerUrl(containerName, uidMaps, gidMaps)
 	if err := os.RemoveAll(writeURL); err != nil {
 		log.Infof("Remove writeLayer dir %s error %v", writeURL, err)
 	}
@@ -4,47 +4,485 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/xianlubird/mydocker/cgroups"
 	"github.com/xianlubird/mydocker/container"
 	_ "github.com/xianlubird/mydocker/nsenter"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 const ENV_EXEC_PID = "mydocker_pid"
-const ENV_EXEC_CMD = "mydocker_cmd"
+
+// exec 命令的参数
+type execOptions struct {
+	tty     bool     // 是否分配伪终端并交互运行
+	detach  bool     // 是否后台运行
+	env     []string // 额外的环境变量
+	workdir string   // 工作目录，为空时使用容器的工作目录
+	user    string   // 运行用户，为空时使用容器的用户
+}
 
 // 容器后台运行后，再执行指令
-func ExecContainer(containerName string, comArray []string) {
-	// 获取容器进程id
-	pid, err := GetContainerPidByName(containerName)
+func ExecContainer(containerName string, comArray []string, opts *execOptions) error {
+	containerInfo, err := getContainerInfoByName(containerName)
 	if err != nil {
-		log.Errorf("Exec container getContainerPidByName %s error %v", containerName, err)
-		return
+		return fmt.Errorf("Get container %s info error %v", containerName, err)
+	}
+	if containerInfo.Status != container.RUNNING {
+		return fmt.Errorf("Container %s is not running", containerName)
+	}
+
+	// 默认使用容器的环境变量、工作目录和用户
+	config := containerInfo.Config
+	if config == nil {
+		config = &container.ImageConfig{}
+	}
+	session := &container.ExecInfo{
+		ID:        randStringBytes(10),
+		Container: containerName,
+		Args:      comArray,
+		Env:       container.MergeEnv(container.DefaultEnv("", opts.tty), containerInfo.Env, opts.env),
+		Cwd:       config.WorkingDir,
+		User:      config.User,
+		Tty:       opts.tty,
+		Detach:    opts.detach,
+		Status:    container.Created,
+	}
+	if opts.workdir != "" {
+		session.Cwd = opts.workdir
+	}
+	if opts.user != "" {
+		session.User = opts.user
+	}
+
+	// 每次 exec 都记录在容器信息目录下，容器停止时清理
+	execDir := fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ExecDirName
+	if err := os.MkdirAll(execDir, 0700); err != nil {
+		return fmt.Errorf("Mkdir %s error %v", execDir, err)
+	}
+	if err := recordExecInfo(session); err != nil {
+		return err
+	}
+	if opts.detach {
+		return startDetachedExec(session)
+	}
+	return runExecSession(containerInfo, session, nil)
+}
+
+// 后台运行 exec: 启动一个脱离终端的 exec-monitor 进程执行指令并等待它退出，记录退出码
+// mydocker exec -d 只等待用户进程启动成功，然后输出 exec ID
+func startDetachedExec(session *container.ExecInfo) error {
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("New pipe error %v", err)
+	}
+	cmd := exec.Command("/proc/self/exe", "exec-monitor", session.Container, session.ID)
+	cmd.ExtraFiles = []*os.File{writePipe}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	writePipe.Close()
+	if err != nil {
+		readPipe.Close()
+		return fmt.Errorf("Start exec monitor error %v", err)
+	}
+	if err := container.ReadInitError(readPipe); err != nil {
+		cmd.Wait()
+		return err
+	}
+	fmt.Println(session.ID)
+	return cmd.Process.Release()
+}
+
+// exec-monitor 进程: 读取 exec 会话信息并执行，启动结果通过 fd 3 报告给 mydocker exec -d
+func monitorExec(containerName, execID string) error {
+	syscall.CloseOnExec(3)
+	started := os.NewFile(uintptr(3), "started")
+	defer started.Close()
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		container.WriteInitError(started, err)
+		return err
+	}
+	session, err := getExecInfo(containerName, execID)
+	if err != nil {
+		container.WriteInitError(started, err)
+		return err
+	}
+	return runExecSession(containerInfo, session, started)
+}
+
+// 在容器中执行一次 exec 会话，等待用户进程退出，并记录会话的状态和退出码
+// started 不为空时，用户进程启动成功后关闭它，启动失败时把错误写入它
+func runExecSession(containerInfo *container.ContainerInfo, session *container.ExecInfo, started *os.File) error {
+	err := execSession(containerInfo, session, started)
+	session.Status = container.Exit
+	session.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	switch e := err.(type) {
+	case nil:
+		session.ExitCode = 0
+	case *container.InitError:
+		session.ExitCode = e.Code
+	case *containerExitError:
+		session.ExitCode = e.ExitCode()
+	default:
+		session.ExitCode = container.ExitCodeRuntime
+	}
+	if err := recordExecInfo(session); err != nil {
+		log.Warnf("Record exec %s error %v", session.ID, err)
 	}
+	return err
+}
 
-	cmdStr := strings.Join(comArray, " ")
-	log.Infof("container pid %s", pid)
-	log.Infof("command %s", cmdStr)
+func execSession(containerInfo *container.ContainerInfo, session *container.ExecInfo, started *os.File) error {
+	// 和 run 一样通过管道发给容器内的进程，资源限制和容器的相同
+	pid := containerInfo.Pid
+	spec := &container.InitSpec{
+		Args:            session.Args,
+		Env:             session.Env,
+		Cwd:             session.Cwd,
+		User:            session.User,
+		Rlimits:         containerInfo.Rlimits,
+		Capabilities:    containerInfo.Capabilities,
+		Seccomp:         containerInfo.Seccomp,
+		NoNewPrivileges: containerInfo.NoNewPrivileges,
+	}
 
-	// 获取自身，fork一个新进程，啥都不处理，目的是执行nsenter的cgo代码（不需要这个进程拥有什么命名空间的隔离）
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("New pipe error %v", err)
+	}
+	syncPipe, childSyncPipe, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("New pipe error %v", err)
+	}
+	cgroupReadyPipe, cgroupReadyWritePipe, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("New pipe error %v", err)
+	}
+	defer cgroupReadyWritePipe.Close()
+
+	// 获取自身，fork一个新进程，nsenter 的 cgo 代码根据环境变量加入容器的命名空间
 	cmd := exec.Command("/proc/self/exe", "exec")
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// 不传递宿主机的环境变量，加入容器命名空间后的进程在容器内可见
+	cmd.Env = []string{ENV_EXEC_PID + "=" + pid}
+	cmd.ExtraFiles = []*os.File{readPipe, childSyncPipe, cgroupReadyPipe}
+	// 新的会话，终端上的 Ctrl-C 等信号不会直接发给容器内的进程
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	var master, slave *os.File
+	switch {
+	case session.Detach:
+		// 后台运行，标准输入输出都为 /dev/null
+	case session.Tty:
+		master, slave, err = container.NewPty()
+		if err != nil {
+			return fmt.Errorf("New pty error %v", err)
+		}
+		defer master.Close()
+		cmd.Stdin = slave
+		cmd.Stdout = slave
+		cmd.Stderr = slave
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+	default:
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	err = cmd.Start()
+	readPipe.Close()
+	childSyncPipe.Close()
+	cgroupReadyPipe.Close()
+	if slave != nil {
+		slave.Close()
+	}
+	if err != nil {
+		writePipe.Close()
+		syncPipe.Close()
+		return reportStarted(started, fmt.Errorf("Exec container %s error %v", session.Container, err))
+	}
+
+	// nsenter 在加入命名空间之前等待，先把它加入容器的 cgroup，之后 fork 的用户进程同样受容器的资源限制
+	// rootless 模式下 exec 的进程和容器的 cgroup 可能没有共同的委派目录，没有权限移动，这时不限制资源
+	if err := cgroups.JoinContainerCgroups(pid, cmd.Process.Pid); err != nil && container.Rootless() {
+		log.Warnf("Join container %s cgroups error %v, resource limits are not applied in rootless mode", session.Container, err)
+	} else if err != nil {
+		writePipe.Close()
+		syncPipe.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return reportStarted(started, fmt.Errorf("Join container %s cgroups error %v", session.Container, err))
+	}
+	cgroupReadyWritePipe.Write([]byte{0})
+
+	if err := container.SendInitSpec(spec, writePipe); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return reportStarted(started, err)
+	}
+	// 等待用户进程启动，失败时返回对应的退出码
+	if err := container.ReadInitError(syncPipe); err != nil {
+		cmd.Wait()
+		return reportStarted(started, err)
+	}
+
+	session.Pid = getChildPid(cmd.Process.Pid)
+	session.Status = container.RUNNING
+	session.StartedAt = time.Now().Format("2006-01-02 15:04:05")
+	if err := recordExecInfo(session); err != nil {
+		log.Warnf("Record exec %s error %v", session.ID, err)
+	}
+	reportStarted(started, nil)
+
+	// 转发 mydocker exec 收到的信号
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	var outputDone chan struct{}
+	if master != nil {
+		if container.IsTerminal(os.Stdin.Fd()) {
+			state, err := container.SetRawTerminal(os.Stdin.Fd())
+			if err != nil {
+				log.Warnf("Set raw terminal error %v", err)
+			} else {
+				defer container.RestoreTerminal(os.Stdin.Fd(), state)
+			}
+			resizePty(master)
+		}
+		go io.Copy(master, os.Stdin)
+		outputDone = make(chan struct{})
+		go func() {
+			// 容器内的进程都退出后读取 master 会返回 EIO
+			io.Copy(os.Stdout, master)
+			close(outputDone)
+		}()
+	}
+
+	err = cmd.Wait()
+	if outputDone != nil {
+		<-outputDone
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &containerExitError{status: exitErr.Sys().(syscall.WaitStatus)}
+	}
+	return err
+}
+
+// 把用户进程的启动结果报告给 mydocker exec -d，前台运行时 started 为空
+func reportStarted(started *os.File, err error) error {
+	if started != nil {
+		if err != nil {
+			container.WriteInitError(started, err)
+		}
+		started.Close()
+	}
+	return err
+}
+
+// nsenter 加入命名空间后 fork 出用户进程，宿主机上用户进程的 PID 是它的子进程
+// 读不到时（内核不支持 children 文件）返回 nsenter 进程自己的 PID
+func getChildPid(pid int) int {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", pid, pid))
+	if err != nil {
+		return pid
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return pid
+	}
+	child, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return pid
+	}
+	return child
+}
+
+func execInfoPath(containerName, execID string) string {
+	return fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ExecDirName + "/" + execID + ".json"
+}
+
+// 保存 exec 会话信息
+// 不会自动创建目录，只有新建的会话会创建记录文件，容器停止清理之后结束的会话不会再留下记录
+func recordExecInfo(session *container.ExecInfo) error {
+	content, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("Json marshal exec %s error %v", session.ID, err)
+	}
+	flag := os.O_WRONLY | os.O_TRUNC
+	if session.Status == container.Created {
+		flag |= os.O_CREATE
+	}
+	path := execInfoPath(session.Container, session.ID)
+	f, err := os.OpenFile(path, flag, 0622)
+	if err != nil {
+		if os.IsNotExist(err) && session.Status != container.Created {
+			return nil
+		}
+		return fmt.Errorf("Write file %s error %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		return fmt.Errorf("Write file %s error %v", path, err)
+	}
+	return nil
+}
+
+func getExecInfo(containerName, execID string) (*container.ExecInfo, error) {
+	content, err := ioutil.ReadFile(execInfoPath(containerName, execID))
+	if err != nil {
+		return nil, err
+	}
+	var session container.ExecInfo
+	if err := json.Unmarshal(content, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// 获取容器的所有 exec 会话
+func getExecInfos(containerName string) ([]*container.ExecInfo, error) {
+	execDir := fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ExecDirName
+	files, err := ioutil.ReadDir(execDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sessions []*container.ExecInfo
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		session, err := getExecInfo(containerName, strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			log.Errorf("Get exec %s info error %v", file.Name(), err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// mydocker exec ls 容器名
+func ListExecs(containerName string) error {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("Get container %s info error %v", containerName, err)
+	}
+	reapStaleExecs(containerInfo)
+	sessions, err := getExecInfos(containerName)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tPID\tSTATUS\tEXIT CODE\tCOMMAND\tSTARTED\tFINISHED\n")
+	for _, item := range sessions {
+		exitCode := ""
+		if item.Status == container.Exit {
+			exitCode = strconv.Itoa(item.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			item.ID,
+			item.Pid,
+			item.Status,
+			exitCode,
+			strings.Join(item.Args, " "),
+			item.StartedAt,
+			item.FinishedAt)
+	}
+	return w.Flush()
+}
+
+// mydocker exec inspect ID，exec ID 在所有容器中查找
+func InspectExec(execID string) error {
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		session, err := getExecInfo(file.Name(), execID)
+		if err != nil {
+			continue
+		}
+		content, err := json.MarshalIndent(session, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+		return nil
+	}
+	return fmt.Errorf("No such exec %s", execID)
+}
+
+// 容器的 init 进程不在了说明容器已经停止，后台运行的容器退出时不会更新状态，所以还要检查进程
+func containerRunning(containerInfo *container.ContainerInfo) bool {
+	if containerInfo.Status != container.RUNNING {
+		return false
+	}
+	pid, err := strconv.Atoi(containerInfo.Pid)
+	return err == nil && syscall.Kill(pid, 0) != syscall.ESRCH
+}
 
-	// 设置环境变量 使cgo逻辑获取
-	os.Setenv(ENV_EXEC_PID, pid)
-	os.Setenv(ENV_EXEC_CMD, cmdStr)
-	containerEnvs := getEnvsByPid(pid)
-	cmd.Env = append(os.Environ(), containerEnvs...)
+// 清理已经停止的容器遗留的 exec 会话记录
+// exec 进程已经随容器的 PID 命名空间一起结束，记录中的 PID 可能被复用了，不能再发送信号
+func reapStaleExecs(containerInfo *container.ContainerInfo) {
+	if containerRunning(containerInfo) {
+		return
+	}
+	execDir := fmt.Sprintf(container.DefaultInfoLocation, containerInfo.Name) + container.ExecDirName
+	if err := os.RemoveAll(execDir); err != nil {
+		log.Errorf("Remove dir %s error %v", execDir, err)
+	}
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Errorf("Exec container %s error %v", containerName, err)
+// 容器停止时结束还在运行的 exec 进程，并清理 exec 会话记录
+func cleanupExecs(containerName string) {
+	sessions, err := getExecInfos(containerName)
+	if err != nil {
+		log.Errorf("Get container %s execs error %v", containerName, err)
+	}
+	for _, session := range sessions {
+		if session.Status == container.RUNNING && session.Pid > 0 {
+			syscall.Kill(session.Pid, syscall.SIGKILL)
+		}
+	}
+	execDir := fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ExecDirName
+	if err := os.RemoveAll(execDir); err != nil {
+		log.Errorf("Remove dir %s error %v", execDir, err)
 	}
 }
 
+// 同步终端窗口大小，并在窗口大小变化时重新同步
+func resizePty(master *os.File) {
+	if err := container.ResizePty(master, os.Stdin.Fd()); err != nil {
+		log.Warnf("Resize pty error %v", err)
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			container.ResizePty(master, os.Stdin.Fd())
+		}
+	}()
+}
+
 // 通过容器信息文件读取容器pid
 func GetContainerPidByName(containerName string) (string, error) {
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
@@ -59,15 +497,3 @@ func GetContainerPidByName(containerName string) (string, error) {
 	}
 	return containerInfo.Pid, nil
 }
-
-func getEnvsByPid(pid string) []string {
-	path := fmt.Sprintf("/proc/%s/environ", pid)
-	contentBytes, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Errorf("Read file %s error %v", path, err)
-		return nil
-	}
-	//env split by \u0000
-	envs := strings.Split(string(contentBytes), "\u0000")
-	return envs
-}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// 输出容器的详细信息，也就是保存的容器信息文件
+func inspectContainer(containerName string) error {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("No such container %s", containerName)
+	}
+	content, err := json.MarshalIndent(containerInfo, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
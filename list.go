@@ -12,34 +12,18 @@ import (
 
 // 获取已经创建的容器的信息
 func ListContainers() {
-	// 获取存放容器信息的目录
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
-	dirURL = dirURL[:len(dirURL)-1]
-	// 遍历里面的目录
-	files, err := ioutil.ReadDir(dirURL)
+	containers, err := listContainerInfos()
 	if err != nil {
-		log.Errorf("Read dir %s error %v", dirURL, err)
+		log.Errorf("List containers error %v", err)
 		return
 	}
 
-	var containers []*container.ContainerInfo
-	for _, file := range files {
-		if file.Name() == "network" {
-			continue
-		}
-		// 读取文件中的信息
-		tmpContainer, err := getContainerInfo(file)
-		if err != nil {
-			log.Errorf("Get container info error %v", err)
-			continue
-		}
-		containers = append(containers, tmpContainer)
-	}
-
 	// 构建输出的信息
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
 	fmt.Fprint(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
 	for _, item := range containers {
+		// 顺便清理已经停止的容器遗留的 exec 会话
+		reapStaleExecs(item)
 		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
 			item.Id,
 			item.Name,
@@ -54,6 +38,34 @@ func ListContainers() {
 	}
 }
 
+// 读取所有容器的信息
+func listContainerInfos() ([]*container.ContainerInfo, error) {
+	// 获取存放容器信息的目录
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
+	dirURL = dirURL[:len(dirURL)-1]
+	// 遍历里面的目录
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil {
+		return nil, fmt.Errorf("Read dir %s error %v", dirURL, err)
+	}
+
+	var containers []*container.ContainerInfo
+	for _, file := range files {
+		// network、pod 目录存放的是网络和 pod 的信息
+		if file.Name() == "network" || file.Name() == "pod" {
+			continue
+		}
+		// 读取文件中的信息
+		tmpContainer, err := getContainerInfo(file)
+		if err != nil {
+			log.Errorf("Get container info error %v", err)
+			continue
+		}
+		containers = append(containers, tmpContainer)
+	}
+	return containers, nil
+}
+
 func getContainerInfo(file os.FileInfo) (*container.ContainerInfo, error) {
 	containerName := file.Name()
 	configFileDir := fmt.Sprintf(container.DefaultInfoLocation, containerName)
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/xianlubird/mydocker/container"
+	"github.com/xianlubird/mydocker/logger"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"sync"
+	"syscall"
 )
 
 // 读取日志
@@ -25,3 +29,90 @@ func logContainer(containerName string) {
 	}
 	fmt.Fprint(os.Stdout, string(content))
 }
+
+// 把容器进程的 stdout/stderr 换成管道，返回管道的读端
+func setLogPipes(parent *exec.Cmd) ([]*os.File, error) {
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		stdoutRead.Close()
+		stdoutWrite.Close()
+		return nil, err
+	}
+	parent.Stdout = stdoutWrite
+	parent.Stderr = stderrWrite
+	return []*os.File{stdoutRead, stderrRead}, nil
+}
+
+// 启动 log-forward 进程转发容器日志
+// 容器后台运行时 mydocker run 会直接退出，所以转发需要放在独立的进程中，容器退出、管道关闭后它也随之退出
+func startLogForwarder(containerName string, logPipes []*os.File, parent *exec.Cmd) error {
+	// 容器进程已经继承了管道的写端，这里需要关闭，否则容器退出后读端收不到 EOF
+	if w, ok := parent.Stdout.(*os.File); ok {
+		w.Close()
+	}
+	if w, ok := parent.Stderr.(*os.File); ok {
+		w.Close()
+	}
+	defer func() {
+		for _, p := range logPipes {
+			p.Close()
+		}
+	}()
+
+	cmd := exec.Command("/proc/self/exe", "log-forward", containerName)
+	cmd.ExtraFiles = logPipes // fd 3 为 stdout，fd 4 为 stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// log-forward 进程：从管道读取容器日志，发送给日志驱动，同时写一份到容器日志文件
+func forwardContainerLog(containerName string) error {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return err
+	}
+	if containerInfo.LogConfig == nil {
+		return fmt.Errorf("container %s has no log driver", containerName)
+	}
+
+	driver, err := logger.New(containerInfo.LogConfig.Type, &logger.Info{
+		ContainerID:   containerInfo.Id,
+		ContainerName: containerInfo.Name,
+		ImageName:     containerInfo.Image,
+		Labels:        containerInfo.Labels,
+		Config:        containerInfo.LogConfig.Config,
+	})
+	if err != nil {
+		return fmt.Errorf("create log driver error %v", err)
+	}
+	defer driver.Close()
+
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
+	logFile, err := logger.NewFileLogger(dirURL + container.ContainerLogFile)
+	if err != nil {
+		return fmt.Errorf("open log file error %v", err)
+	}
+	defer logFile.Close()
+
+	stdout := os.NewFile(uintptr(3), "stdout")
+	stderr := os.NewFile(uintptr(4), "stderr")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		logger.Copy(stdout, logger.SourceStdout, driver, logFile)
+	}()
+	go func() {
+		defer wg.Done()
+		logger.Copy(stderr, logger.SourceStderr, driver, logFile)
+	}()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const maxLineSize = 16 * 1024 // 超过这个长度的行会被拆成多条日志
+
+// 从容器的 stdout/stderr 中按行读取日志，发送给所有日志驱动，直到读到 EOF
+func Copy(src io.Reader, source string, loggers ...Logger) {
+	reader := bufio.NewReaderSize(src, maxLineSize)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] == '\n' {
+				line = line[:len(line)-1]
+			}
+			msg := &Message{
+				Line:      append([]byte(nil), line...),
+				Source:    source,
+				Timestamp: time.Now(),
+			}
+			for _, l := range loggers {
+				if err := l.Log(msg); err != nil {
+					log.Errorf("%s log driver error %v", l.Name(), err)
+				}
+			}
+		}
+		if err == nil || err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != io.EOF {
+			log.Errorf("read container %s error %v", source, err)
+		}
+		return
+	}
+}
+
+// 把日志原样写入容器的日志文件，保证使用了日志驱动后 mydocker logs 依然可用
+type fileLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileLogger(path string) (Logger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLogger{file: file}, nil
+}
+
+func (l *fileLogger) Name() string {
+	return "file"
+}
+
+func (l *fileLogger) Log(msg *Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(msg.Line); err != nil {
+		return err
+	}
+	_, err := l.file.Write([]byte{'\n'})
+	return err
+}
+
+func (l *fileLogger) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+)
+
+var fluentdOpts = map[string]bool{
+	"fluentd-address": true,
+}
+
+// fluentd 日志驱动，使用 forward 协议的 Message Mode 发送: [tag, time, record]
+// 支持的地址: host:24224 tcp://host:24224 unix:///var/run/fluentd.sock
+type fluentdLogger struct {
+	tag    string
+	extra  map[string]string // 每条记录都带上的容器信息和标签
+	sender *sender
+}
+
+func validateFluentdOpts(cfg map[string]string) error {
+	if err := checkOpts("fluentd", cfg, fluentdOpts); err != nil {
+		return err
+	}
+	proto, _, err := parseAddress(fluentdAddress(cfg), "tcp", 24224)
+	if err != nil {
+		return err
+	}
+	if proto != "tcp" && proto != "unix" {
+		return fmt.Errorf("fluentd-address only supports tcp and unix")
+	}
+	return nil
+}
+
+func fluentdAddress(cfg map[string]string) string {
+	if addr := cfg["fluentd-address"]; addr != "" {
+		return addr
+	}
+	return "localhost:24224"
+}
+
+func newFluentdLogger(info *Info) (Logger, error) {
+	tag, err := ParseTag(info)
+	if err != nil {
+		return nil, err
+	}
+	proto, address, err := parseAddress(fluentdAddress(info.Config), "tcp", 24224)
+	if err != nil {
+		return nil, err
+	}
+	size, err := bufferSize(info.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := map[string]string{}
+	for k, v := range info.Labels {
+		extra[k] = v
+	}
+	extra["container_id"] = info.ContainerID
+	extra["container_name"] = info.ContainerName
+	extra["image_name"] = info.ImageName
+
+	l := &fluentdLogger{
+		tag:   tag,
+		extra: extra,
+	}
+	l.sender = newSender(func() (net.Conn, error) {
+		return net.DialTimeout(proto, address, writeTimeout)
+	}, size)
+	return l, nil
+}
+
+func (l *fluentdLogger) Name() string {
+	return "fluentd"
+}
+
+func (l *fluentdLogger) Log(msg *Message) error {
+	record := map[string]string{
+		"log":    string(msg.Line),
+		"source": msg.Source,
+	}
+	for k, v := range l.extra {
+		record[k] = v
+	}
+	e := &msgpackEncoder{}
+	e.writeArrayHeader(3)
+	e.writeString(l.tag)
+	e.writeUint(uint64(msg.Timestamp.Unix()))
+	e.writeStringMap(record)
+	return l.sender.send(e.Bytes())
+}
+
+func (l *fluentdLogger) Close() error {
+	return l.sender.close()
+}
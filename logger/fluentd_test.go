@@ -0,0 +1,145 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试用的 msgpack 解码，只支持 fluentd 驱动会写出的类型
+func decodeMsgpack(r *bufio.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	readLen := func(size int) (int, error) {
+		buf, err := readN(size)
+		if err != nil {
+			return 0, err
+		}
+		switch size {
+		case 1:
+			return int(buf[0]), nil
+		case 2:
+			return int(binary.BigEndian.Uint16(buf)), nil
+		default:
+			return int(binary.BigEndian.Uint32(buf)), nil
+		}
+	}
+	var n int
+	switch {
+	case b < 0x80:
+		return uint64(b), nil
+	case b&0xf0 == 0x80:
+		return decodeMsgpackMap(r, int(b&0x0f))
+	case b&0xf0 == 0x90:
+		return decodeMsgpackArray(r, int(b&0x0f))
+	case b&0xe0 == 0xa0:
+		buf, err := readN(int(b & 0x1f))
+		return string(buf), err
+	case b == 0xce:
+		buf, err := readN(4)
+		return uint64(binary.BigEndian.Uint32(buf)), err
+	case b == 0xd9, b == 0xda, b == 0xdb:
+		if n, err = readLen(map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4}[b]); err != nil {
+			return nil, err
+		}
+		buf, err := readN(n)
+		return string(buf), err
+	case b == 0xde:
+		if n, err = readLen(2); err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(r, n)
+	}
+	return nil, fmt.Errorf("unsupported msgpack type 0x%x", b)
+}
+
+func decodeMsgpackArray(r *bufio.Reader, n int) (interface{}, error) {
+	var arr []interface{}
+	for i := 0; i < n; i++ {
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func decodeMsgpackMap(r *bufio.Reader, n int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		k, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
+
+func TestFluentdForward(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	l, err := New("fluentd", testInfo(map[string]string{
+		"fluentd-address": ln.Addr().String(),
+		"tag":             "docker.{{.Name}}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	now := time.Now()
+	l.Log(&Message{Line: []byte("hello fluentd"), Source: SourceStderr, Timestamp: now})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	v, err := decodeMsgpack(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("fluentd message: %v", v)
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) != 3 {
+		t.Fatalf("expect [tag, time, record], got %v", v)
+	}
+	if arr[0] != "docker.web" || arr[1] != uint64(now.Unix()) {
+		t.Fatalf("unexpected tag or time: %v", arr)
+	}
+	record := arr[2].(map[string]interface{})
+	expect := map[string]string{
+		"log":            "hello fluentd",
+		"source":         "stderr",
+		"container_id":   "1234567890",
+		"container_name": "web",
+		"image_name":     "busybox",
+		"app":            "nginx",
+	}
+	for k, want := range expect {
+		if record[k] != want {
+			t.Fatalf("record %s expect %s, got %v", k, want, record[k])
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+const (
+	gelfDefaultChunkSize = 1420 // UDP 默认分块大小，保证不超过常见 MTU
+	gelfMaxChunks        = 128  // GELF 协议规定一条消息最多 128 个分块
+)
+
+// GELF 分块消息的魔数
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// 附加字段名只能包含字母、数字、下划线、点和横线
+var gelfInvalidFieldChars = regexp.MustCompile(`[^\w\.\-]`)
+
+var gelfOpts = map[string]bool{
+	"gelf-address":           true,
+	"gelf-compression-type":  true,
+	"gelf-compression-level": true,
+	"gelf-chunk-size":        true,
+}
+
+// gelf 日志驱动，支持 udp://host:12201（可压缩、分块）和 tcp://host:12201（以 \0 分隔）
+type gelfLogger struct {
+	hostname    string
+	extra       map[string]interface{} // 每条消息都带上的附加字段
+	udp         bool
+	compression string
+	level       int
+	chunkSize   int
+	sender      *sender
+}
+
+func validateGelfOpts(cfg map[string]string) error {
+	if err := checkOpts("gelf", cfg, gelfOpts); err != nil {
+		return err
+	}
+	if cfg["gelf-address"] == "" {
+		return fmt.Errorf("gelf-address is required for gelf log driver")
+	}
+	proto, _, err := parseAddress(cfg["gelf-address"], "udp", 12201)
+	if err != nil {
+		return err
+	}
+	if proto != "udp" && proto != "tcp" {
+		return fmt.Errorf("gelf-address only supports udp and tcp")
+	}
+	switch cfg["gelf-compression-type"] {
+	case "", "gzip", "zlib", "none":
+	default:
+		return fmt.Errorf("invalid gelf-compression-type %s", cfg["gelf-compression-type"])
+	}
+	if _, err := gelfIntOpt(cfg, "gelf-compression-level", gzip.DefaultCompression, -1, 9); err != nil {
+		return err
+	}
+	_, err = gelfIntOpt(cfg, "gelf-chunk-size", gelfDefaultChunkSize, 13, 65507)
+	return err
+}
+
+func gelfIntOpt(cfg map[string]string, key string, def, min, max int) (int, error) {
+	value, ok := cfg[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid %s %s, must be between %d and %d", key, value, min, max)
+	}
+	return n, nil
+}
+
+func newGelfLogger(info *Info) (Logger, error) {
+	tag, err := ParseTag(info)
+	if err != nil {
+		return nil, err
+	}
+	proto, address, err := parseAddress(info.Config["gelf-address"], "udp", 12201)
+	if err != nil {
+		return nil, err
+	}
+	size, err := bufferSize(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	level, _ := gelfIntOpt(info.Config, "gelf-compression-level", gzip.DefaultCompression, -1, 9)
+	chunkSize, _ := gelfIntOpt(info.Config, "gelf-chunk-size", gelfDefaultChunkSize, 13, 65507)
+	compression := info.Config["gelf-compression-type"]
+	if compression == "" {
+		compression = "gzip"
+	}
+
+	extra := map[string]interface{}{
+		"_container_id":   info.ContainerID,
+		"_container_name": info.ContainerName,
+		"_image_name":     info.ImageName,
+		"_tag":            tag,
+	}
+	for k, v := range info.Labels {
+		extra["_"+gelfInvalidFieldChars.ReplaceAllString(k, "_")] = v
+	}
+
+	l := &gelfLogger{
+		hostname:    hostname(),
+		extra:       extra,
+		udp:         proto == "udp",
+		compression: compression,
+		level:       level,
+		chunkSize:   chunkSize,
+	}
+	l.sender = newSender(func() (net.Conn, error) {
+		return net.DialTimeout(proto, address, writeTimeout)
+	}, size)
+	return l, nil
+}
+
+func (l *gelfLogger) Name() string {
+	return "gelf"
+}
+
+func (l *gelfLogger) Log(msg *Message) error {
+	level := syslogSeverityInfo
+	if msg.Source == SourceStderr {
+		level = syslogSeverityErr
+	}
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          l.hostname,
+		"short_message": string(msg.Line),
+		"timestamp":     float64(msg.Timestamp.UnixNano()) / 1e9,
+		"level":         level,
+		"_source":       msg.Source,
+	}
+	for k, v := range l.extra {
+		m[k] = v
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	// TCP 不支持压缩，每条消息以 \0 结尾
+	if !l.udp {
+		return l.sender.send(append(data, 0))
+	}
+	if data, err = l.compress(data); err != nil {
+		return err
+	}
+	packets, err := gelfChunks(data, l.chunkSize)
+	if err != nil {
+		return err
+	}
+	return l.sender.send(packets...)
+}
+
+func (l *gelfLogger) Close() error {
+	return l.sender.close()
+}
+
+func (l *gelfLogger) compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	switch l.compression {
+	case "none":
+		return data, nil
+	case "zlib":
+		w, err := zlib.NewWriterLevel(buf, l.level)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		w, err := gzip.NewWriterLevel(buf, l.level)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// 超过分块大小的 UDP 消息需要分块发送
+// 每个分块的头部: 魔数(2字节) + 消息ID(8字节) + 序号(1字节) + 分块总数(1字节)
+func gelfChunks(data []byte, chunkSize int) ([][]byte, error) {
+	if len(data) <= chunkSize {
+		return [][]byte{data}, nil
+	}
+	payloadSize := chunkSize - 12
+	count := (len(data) + payloadSize - 1) / payloadSize
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("gelf message too large, need %d chunks", count)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	var chunks [][]byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 0, 12+end-i*payloadSize)
+		chunk = append(chunk, gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*payloadSize:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
@@ -0,0 +1,128 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGelfUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l, err := New("gelf", testInfo(map[string]string{"gelf-address": "udp://" + conn.LocalAddr().String()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(testMessage("hello gelf"))
+
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(buf[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("gelf message: %v", m)
+	expect := map[string]interface{}{
+		"version":         "1.1",
+		"short_message":   "hello gelf",
+		"_container_id":   "1234567890",
+		"_container_name": "web",
+		"_image_name":     "busybox",
+		"_tag":            "1234567890",
+		"_app":            "nginx",
+		"level":           float64(6),
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Fatalf("field %s expect %v, got %v", k, v, m[k])
+		}
+	}
+}
+
+func TestGelfTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	l, err := New("gelf", testInfo(map[string]string{"gelf-address": "tcp://" + ln.Addr().String()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(testMessage("one"))
+	l.Log(testMessage("two"))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"one", "two"} {
+		frame, err := reader.ReadBytes(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(frame[:len(frame)-1], &m); err != nil {
+			t.Fatal(err)
+		}
+		if m["short_message"] != want {
+			t.Fatalf("expect %s, got %v", want, m["short_message"])
+		}
+	}
+}
+
+func TestGelfChunks(t *testing.T) {
+	data := []byte(strings.Repeat("x", 3000))
+	chunks, err := gelfChunks(data, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("expect 4 chunks, got %d", len(chunks))
+	}
+	var joined []byte
+	for i, c := range chunks {
+		if !bytes.Equal(c[:2], gelfChunkMagic) || int(c[10]) != i || int(c[11]) != len(chunks) {
+			t.Fatalf("invalid chunk header %v", c[:12])
+		}
+		if !bytes.Equal(c[2:10], chunks[0][2:10]) {
+			t.Fatalf("chunk %d has different message id", i)
+		}
+		joined = append(joined, c[12:]...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("chunks do not rebuild the message")
+	}
+
+	if _, err := gelfChunks(make([]byte, 200*100), 100); err == nil {
+		t.Fatalf("expect error for message with too many chunks")
+	}
+}
@@ -0,0 +1,157 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 日志来源
+const (
+	SourceStdout = "stdout"
+	SourceStderr = "stderr"
+)
+
+// 一条日志消息，对应容器 stdout/stderr 输出的一行
+type Message struct {
+	Line      []byte    // 日志内容，不包含结尾的换行符
+	Source    string    // stdout 或 stderr
+	Timestamp time.Time // 读取到这一行的时间
+}
+
+// 日志驱动需要的容器信息，每条消息都会带上这些信息
+type Info struct {
+	ContainerID   string            `json:"id"`
+	ContainerName string            `json:"name"`
+	ImageName     string            `json:"image"`
+	Labels        map[string]string `json:"labels"`
+	Config        map[string]string `json:"config"` // --log-opt 指定的驱动参数
+}
+
+// 日志驱动
+type Logger interface {
+	// 驱动名
+	Name() string
+	// 发送一条日志，不应该阻塞（端点不可用时由驱动自己缓存）
+	Log(msg *Message) error
+	// 关闭驱动，尽量把缓存中的日志发送出去
+	Close() error
+}
+
+// 创建日志驱动的函数
+type Creator func(info *Info) (Logger, error)
+
+// 校验 --log-opt 参数的函数
+type OptValidator func(cfg map[string]string) error
+
+type driver struct {
+	creator   Creator
+	validator OptValidator
+}
+
+var drivers = map[string]driver{
+	"syslog":  {creator: newSyslogLogger, validator: validateSyslogOpts},
+	"gelf":    {creator: newGelfLogger, validator: validateGelfOpts},
+	"fluentd": {creator: newFluentdLogger, validator: validateFluentdOpts},
+}
+
+// 所有驱动都支持的参数
+var commonOpts = map[string]bool{
+	"tag":             true,
+	"max-buffer-size": true,
+}
+
+// 是否是支持的日志驱动
+func IsValidDriver(name string) bool {
+	_, ok := drivers[name]
+	return ok
+}
+
+// 支持的日志驱动列表
+func Drivers() []string {
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 在启动容器之前校验日志驱动和参数，避免容器跑起来之后才发现配置错误
+func ValidateLogOpts(name string, cfg map[string]string) error {
+	d, ok := drivers[name]
+	if !ok {
+		return fmt.Errorf("unknown log driver %s, supported drivers: %v", name, Drivers())
+	}
+	if _, err := parseTagTemplate(cfg["tag"]); err != nil {
+		return err
+	}
+	if _, err := bufferSize(cfg); err != nil {
+		return err
+	}
+	return d.validator(cfg)
+}
+
+// 创建日志驱动
+func New(name string, info *Info) (Logger, error) {
+	d, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown log driver %s", name)
+	}
+	if info.Config == nil {
+		info.Config = map[string]string{}
+	}
+	if err := ValidateLogOpts(name, info.Config); err != nil {
+		return nil, err
+	}
+	return d.creator(info)
+}
+
+// 检查是否有驱动不支持的参数
+func checkOpts(driverName string, cfg map[string]string, known map[string]bool) error {
+	for key := range cfg {
+		if commonOpts[key] || known[key] {
+			continue
+		}
+		return fmt.Errorf("unknown log opt '%s' for %s log driver", key, driverName)
+	}
+	return nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "-"
+	}
+	return name
+}
+
+// 解析 proto://host:port 格式的地址，unix 类型的地址是 socket 文件路径
+func parseAddress(address, defaultProto string, defaultPort int) (string, string, error) {
+	proto := defaultProto
+	if idx := strings.Index(address, "://"); idx >= 0 {
+		proto = address[:idx]
+		address = address[idx+3:]
+	}
+	switch proto {
+	case "unix", "unixgram":
+		if address == "" {
+			return "", "", fmt.Errorf("missing socket path for %s address", proto)
+		}
+		return proto, address, nil
+	case "tcp", "udp":
+		if address == "" {
+			return "", "", fmt.Errorf("missing host for %s address", proto)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, strconv.Itoa(defaultPort))
+		}
+		return proto, address, nil
+	default:
+		return "", "", fmt.Errorf("unsupported protocol %s in address", proto)
+	}
+}
@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// fluentd forward 协议使用 msgpack 编码，这里只实现了日志需要用到的类型
+// 参考： https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *msgpackEncoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+func (e *msgpackEncoder) writeArrayHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf.WriteByte(0x90 | byte(n))
+	case n <= 0xffff:
+		e.buf.WriteByte(0xdc)
+		e.writeUint16(uint16(n))
+	default:
+		e.buf.WriteByte(0xdd)
+		e.writeUint32(uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) writeMapHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf.WriteByte(0x80 | byte(n))
+	case n <= 0xffff:
+		e.buf.WriteByte(0xde)
+		e.writeUint16(uint16(n))
+	default:
+		e.buf.WriteByte(0xdf)
+		e.writeUint32(uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf.WriteByte(0xa0 | byte(n))
+	case n <= 0xff:
+		e.buf.WriteByte(0xd9)
+		e.buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		e.buf.WriteByte(0xda)
+		e.writeUint16(uint16(n))
+	default:
+		e.buf.WriteByte(0xdb)
+		e.writeUint32(uint32(n))
+	}
+	e.buf.WriteString(s)
+}
+
+func (e *msgpackEncoder) writeUint(v uint64) {
+	switch {
+	case v < 128:
+		e.buf.WriteByte(byte(v))
+	case v <= 0xffffffff:
+		e.buf.WriteByte(0xce)
+		e.writeUint32(uint32(v))
+	default:
+		e.buf.WriteByte(0xcf)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		e.buf.Write(b)
+	}
+}
+
+// key 排序后写入，保证相同内容的编码结果一致
+func (e *msgpackEncoder) writeStringMap(m map[string]string) {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e.writeMapHeader(len(keys))
+	for _, k := range keys {
+		e.writeString(k)
+		e.writeString(m[k])
+	}
+}
+
+func (e *msgpackEncoder) writeUint16(v uint16) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	e.buf.Write(b)
+}
+
+func (e *msgpackEncoder) writeUint32(v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	e.buf.Write(b)
+}
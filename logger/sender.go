@@ -0,0 +1,156 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const defaultBufferSize = 1000 // 默认最多缓存的日志条数
+
+var (
+	retryInterval = time.Second      // 端点不可用时的重连间隔
+	flushTimeout  = 5 * time.Second  // 关闭时等待缓存日志发送完成的最长时间
+	writeTimeout  = 10 * time.Second // 单次写入的超时时间
+)
+
+type dialFunc func() (net.Conn, error)
+
+// 带缓冲的发送器
+// 日志先放进内存队列，由后台 goroutine 按顺序发送；端点不可用时保留在队列中，重连成功后补发。
+// 队列满了以后丢弃最旧的日志，保证容器输出不会被阻塞。
+type sender struct {
+	dial    dialFunc
+	maxSize int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   [][][]byte // 每一项是一条日志，一条日志可能需要多个包发送（例如 GELF 分块）
+	dropped int
+	closed  bool
+
+	conn net.Conn
+	done chan struct{}
+}
+
+func newSender(dial dialFunc, maxSize int) *sender {
+	s := &sender{
+		dial:    dial,
+		maxSize: maxSize,
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.loop()
+	return s
+}
+
+// 读取 max-buffer-size 参数
+func bufferSize(cfg map[string]string) (int, error) {
+	value, ok := cfg["max-buffer-size"]
+	if !ok {
+		return defaultBufferSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid max-buffer-size %s", value)
+	}
+	return size, nil
+}
+
+// 把一条日志放入发送队列
+func (s *sender) send(packets ...[]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("log sender is closed")
+	}
+	if len(s.queue) >= s.maxSize {
+		s.queue = s.queue[1:]
+		s.dropped++
+		if s.dropped == 1 || s.dropped%s.maxSize == 0 {
+			log.Warnf("log buffer is full, %d messages dropped", s.dropped)
+		}
+	}
+	s.queue = append(s.queue, packets)
+	s.cond.Signal()
+	return nil
+}
+
+func (s *sender) loop() {
+	defer close(s.done)
+	var deadline time.Time
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			break
+		}
+		if s.closed && deadline.IsZero() {
+			deadline = time.Now().Add(flushTimeout)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Warnf("log endpoint unavailable, %d buffered messages dropped", len(s.queue))
+			s.mu.Unlock()
+			break
+		}
+		packets := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		if err := s.write(packets); err != nil {
+			log.Debugf("send log error %v, retry in %v", err, retryInterval)
+			s.requeue(packets)
+			time.Sleep(retryInterval)
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// 发送失败的日志放回队首，队列已满时它是最旧的一条，直接丢弃
+func (s *sender) requeue(packets [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= s.maxSize {
+		s.dropped++
+		return
+	}
+	s.queue = append([][][]byte{packets}, s.queue...)
+}
+
+func (s *sender) write(packets [][]byte) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	for _, p := range packets {
+		s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := s.conn.Write(p); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// 关闭发送器，在 flushTimeout 时间内尽量发送完缓存的日志
+func (s *sender) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,184 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RFC5424 中示例用的 enterprise number，用于结构化数据的 SD-ID
+const syslogSDEnterprise = "32473"
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const (
+	syslogSeverityErr  = 3
+	syslogSeverityInfo = 6
+)
+
+var syslogOpts = map[string]bool{
+	"syslog-address":  true,
+	"syslog-facility": true,
+}
+
+// syslog 日志驱动，按 RFC5424 格式发送
+// 支持的地址: unixgram:///dev/log unix:///dev/log udp://host:514 tcp://host:514
+type syslogLogger struct {
+	tag      string
+	facility int
+	hostname string
+	sd       string // 结构化数据，包含容器名、ID、镜像和标签
+	stream   bool   // 流式连接需要用换行分隔消息
+	sender   *sender
+}
+
+func validateSyslogOpts(cfg map[string]string) error {
+	if err := checkOpts("syslog", cfg, syslogOpts); err != nil {
+		return err
+	}
+	if _, err := syslogFacility(cfg["syslog-facility"]); err != nil {
+		return err
+	}
+	_, _, err := parseAddress(syslogAddress(cfg), "udp", 514)
+	return err
+}
+
+func syslogAddress(cfg map[string]string) string {
+	if addr := cfg["syslog-address"]; addr != "" {
+		return addr
+	}
+	return "unixgram:///dev/log"
+}
+
+func syslogFacility(name string) (int, error) {
+	if name == "" {
+		return syslogFacilities["daemon"], nil
+	}
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid syslog facility %s", name)
+	}
+	return facility, nil
+}
+
+func newSyslogLogger(info *Info) (Logger, error) {
+	tag, err := ParseTag(info)
+	if err != nil {
+		return nil, err
+	}
+	facility, err := syslogFacility(info.Config["syslog-facility"])
+	if err != nil {
+		return nil, err
+	}
+	proto, address, err := parseAddress(syslogAddress(info.Config), "udp", 514)
+	if err != nil {
+		return nil, err
+	}
+	size, err := bufferSize(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	l := &syslogLogger{
+		tag:      tag,
+		facility: facility,
+		hostname: hostname(),
+		sd:       syslogStructuredData(info),
+		stream:   proto == "tcp" || proto == "unix",
+	}
+	l.sender = newSender(func() (net.Conn, error) {
+		return net.DialTimeout(proto, address, writeTimeout)
+	}, size)
+	return l, nil
+}
+
+func (l *syslogLogger) Name() string {
+	return "syslog"
+}
+
+func (l *syslogLogger) Log(msg *Message) error {
+	severity := syslogSeverityInfo
+	if msg.Source == SourceStderr {
+		severity = syslogSeverityErr
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - %s %s",
+		l.facility*8+severity,
+		msg.Timestamp.UTC().Format(time.RFC3339Nano),
+		l.hostname,
+		syslogHeaderField(l.tag, 48),
+		os.Getpid(),
+		l.sd,
+		msg.Line)
+	if l.stream {
+		line += "\n"
+	}
+	return l.sender.send([]byte(line))
+}
+
+func (l *syslogLogger) Close() error {
+	return l.sender.close()
+}
+
+// 生成结构化数据：[container@32473 id="" name="" image=""][labels@32473 k="v"]
+func syslogStructuredData(info *Info) string {
+	sd := fmt.Sprintf(`[container@%s id="%s" name="%s" image="%s"]`, syslogSDEnterprise,
+		syslogEscape(info.ContainerID), syslogEscape(info.ContainerName), syslogEscape(info.ImageName))
+	if len(info.Labels) == 0 {
+		return sd
+	}
+	var keys []string
+	for k := range info.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sd += "[labels@" + syslogSDEnterprise
+	for _, k := range keys {
+		sd += fmt.Sprintf(` %s="%s"`, syslogParamName(k), syslogEscape(info.Labels[k]))
+	}
+	return sd + "]"
+}
+
+// PARAM-VALUE 中的 " \ ] 需要转义
+func syslogEscape(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	return r.Replace(value)
+}
+
+// SD-NAME 只能包含可打印字符，并且不能有 = 空格 ] "，最长 32 个字符
+func syslogParamName(name string) string {
+	return syslogTruncate(syslogSanitize(name), 32)
+}
+
+// 头部字段不能包含空格，为空时用 - 表示
+func syslogHeaderField(value string, maxLen int) string {
+	value = syslogTruncate(syslogSanitize(value), maxLen)
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func syslogSanitize(value string) string {
+	b := []byte(value)
+	for i, c := range b {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func syslogTruncate(value string, maxLen int) string {
+	if len(value) > maxLen {
+		return value[:maxLen]
+	}
+	return value
+}
@@ -0,0 +1,164 @@
+package logger
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testInfo(cfg map[string]string) *Info {
+	return &Info{
+		ContainerID:   "1234567890",
+		ContainerName: "web",
+		ImageName:     "busybox",
+		Labels:        map[string]string{"app": "nginx"},
+		Config:        cfg,
+	}
+}
+
+func testMessage(line string) *Message {
+	return &Message{Line: []byte(line), Source: SourceStdout, Timestamp: time.Now()}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l, err := New("syslog", testInfo(map[string]string{
+		"syslog-address": "udp://" + conn.LocalAddr().String(),
+		"tag":            "{{.ImageName}}/{{.Name}}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(testMessage("hello world"))
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	t.Logf("syslog message: %s", got)
+	// daemon(3)*8 + info(6) = 30
+	if !strings.HasPrefix(got, "<30>1 ") {
+		t.Fatalf("unexpected priority: %s", got)
+	}
+	for _, want := range []string{" busybox/web ", `id="1234567890"`, `name="web"`, `image="busybox"`,
+		`[labels@32473 app="nginx"]`, "] hello world"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("message %q missing %q", got, want)
+		}
+	}
+}
+
+func TestSyslogUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenPacket("unixgram", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l, err := New("syslog", testInfo(map[string]string{"syslog-address": "unixgram://" + sock}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(&Message{Line: []byte("oops"), Source: SourceStderr, Timestamp: time.Now()})
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	// daemon(3)*8 + err(3) = 27，默认 tag 是容器 ID
+	if !strings.HasPrefix(got, "<27>1 ") || !strings.Contains(got, " 1234567890 ") || !strings.HasSuffix(got, " oops") {
+		t.Fatalf("unexpected message: %s", got)
+	}
+}
+
+// 端点不可用时日志先缓存，监听起来之后按顺序补发
+func TestSyslogTCPBuffered(t *testing.T) {
+	retryInterval = 50 * time.Millisecond
+	defer func() { retryInterval = time.Second }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	l, err := New("syslog", testInfo(map[string]string{"syslog-address": "tcp://" + addr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(testMessage("first"))
+	l.Log(testMessage("second"))
+	time.Sleep(200 * time.Millisecond)
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"first", "second"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(line, " "+want+"\n") {
+			t.Fatalf("expect %s, got %q", want, line)
+		}
+	}
+}
+
+func TestValidateLogOpts(t *testing.T) {
+	cases := []struct {
+		driver string
+		cfg    map[string]string
+		ok     bool
+	}{
+		{"syslog", map[string]string{"syslog-address": "tcp://127.0.0.1:514", "tag": "{{.Name}}"}, true},
+		{"syslog", map[string]string{"syslog-facility": "nope"}, false},
+		{"syslog", map[string]string{"syslog-address": "http://127.0.0.1"}, false},
+		{"syslog", map[string]string{"tag": "{{.Name"}, false},
+		{"gelf", map[string]string{}, false},
+		{"gelf", map[string]string{"gelf-address": "udp://127.0.0.1:12201", "max-buffer-size": "10"}, true},
+		{"fluentd", map[string]string{"fluentd-address": "udp://127.0.0.1:24224"}, false},
+		{"fluentd", map[string]string{"unknown": "x"}, false},
+		{"json-file", map[string]string{}, false},
+	}
+	for _, c := range cases {
+		err := ValidateLogOpts(c.driver, c.cfg)
+		if (err == nil) != c.ok {
+			t.Fatalf("validate %s %v: expect ok=%v, got %v", c.driver, c.cfg, c.ok, err)
+		}
+	}
+}
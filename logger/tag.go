@@ -0,0 +1,48 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// 默认的 tag 模板
+const DefaultTagTemplate = "{{.ID}}"
+
+// tag 模板中可以使用的字段，例如 --log-opt tag="{{.ImageName}}/{{.Name}}"
+type tagContext struct {
+	ID        string
+	Name      string
+	ImageName string
+	Labels    map[string]string
+}
+
+func parseTagTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTagTemplate
+	}
+	tmpl, err := template.New("tag").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log tag template %q: %v", text, err)
+	}
+	return tmpl, nil
+}
+
+// 根据 tag 模板生成当前容器的 tag
+func ParseTag(info *Info) (string, error) {
+	tmpl, err := parseTagTemplate(info.Config["tag"])
+	if err != nil {
+		return "", err
+	}
+	ctx := tagContext{
+		ID:        info.ContainerID,
+		Name:      info.ContainerName,
+		ImageName: info.ImageName,
+		Labels:    info.Labels,
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, ctx); err != nil {
+		return "", fmt.Errorf("execute log tag template error %v", err)
+	}
+	return buf.String(), nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/urfave/cli"
+	"github.com/xianlubird/mydocker/container"
 	"os"
+	"runtime"
 )
 
 /*
@@ -12,10 +14,25 @@ https://github.com/urfave/cli
 https://github.com/urfave/cli/blob/master/docs/v1/manual.md
 */
 
+// rootless 模式下需要在 user 命名空间中执行的命令
+// exec 直接加入容器的命名空间，commit 通过容器进程的根目录打包，stop、ps 等只需要读写 $XDG_RUNTIME_DIR 下的容器信息
+var rootlessNamespaceCommands = map[string]bool{
+	"run": true,
+	"rm":  true,
+}
+
 const usage = `mydocker is a simple container runtime implementation.
 			   The purpose of this project is to learn how docker works and how to write a docker by ourselves
 			   Enjoy it, just for fun.`
 
+// 容器的 init 进程把 main goroutine 固定在主线程上执行，
+// 创建 time 命名空间时 /proc/self/timens_offsets 设置的是主线程的命名空间
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		runtime.LockOSThread()
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "mydocker"
@@ -23,14 +40,33 @@ func main() {
 
 	app.Commands = []cli.Command{
 		initCommand,
+		podInfraCommand,
+		logForwardCommand,
 		runCommand,
 		listCommand,
 		logCommand,
 		execCommand,
+		execMonitorCommand,
+		inspectCommand,
 		stopCommand,
 		removeCommand,
 		commitCommand,
 		networkCommand,
+		podCommand,
+		secretCommand,
+	}
+
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{ // 所有容器默认设置 no_new_privs，可以用 --security-opt no-new-privileges=false 关闭
+			Name:   "no-new-privileges",
+			Usage:  "set no-new-privileges for all containers by default",
+			EnvVar: "MYDOCKER_NO_NEW_PRIVILEGES",
+		},
+		cli.StringFlag{ // 所有容器默认使用 user 命名空间，容器内的 ID 按 /etc/subuid、/etc/subgid 映射，可以用 --userns=host 关闭
+			Name:   "userns-remap",
+			Usage:  "user[:group] whose subordinate ids are used for the user namespace of all containers",
+			EnvVar: "MYDOCKER_USERNS_REMAP",
+		},
 	}
 
 	app.Before = func(context *cli.Context) error {
@@ -38,6 +74,26 @@ func main() {
 		log.SetFormatter(&log.JSONFormatter{})
 
 		log.SetOutput(os.Stdout)
+
+		// 非 root 用户运行时使用 rootless 模式
+		// rootless 模式下不支持 pod，由 podCommand 的 Before 直接报错，不准备 rootless 环境，也不进入 user 命名空间
+		if !container.Rootless() || context.Args().First() == "pod" {
+			return nil
+		}
+		if err := container.WaitRootlessIDMaps(); err != nil {
+			return err
+		}
+		if err := container.SetupRootlessPaths(); err != nil {
+			return err
+		}
+		// 这些命令需要挂载文件系统、访问属主为其它 ID 的文件，先进入 rootless 的 user 命名空间再执行
+		if os.Geteuid() != 0 && rootlessNamespaceCommands[context.Args().First()] {
+			code, err := container.RunInRootlessNamespace(os.Args)
+			if err != nil {
+				return err
+			}
+			os.Exit(code)
+		}
 		return nil
 	}
 
@@ -6,13 +6,17 @@ import (
 	"github.com/urfave/cli"
 	"github.com/xianlubird/mydocker/cgroups/subsystems"
 	"github.com/xianlubird/mydocker/container"
+	"github.com/xianlubird/mydocker/logger"
 	"github.com/xianlubird/mydocker/network"
+	"net"
 	"os"
 )
 
 var runCommand = cli.Command{
 	Name:  "run",
 	Usage: `Create a container with namespace and cgroups limit ie: mydocker run -ti [image] [command]`,
+	// 镜像名之后的参数都属于用户指令，不能当作 mydocker 的参数解析，例如 sh -c "echo a b"
+	SkipArgReorder: true,
 	Flags: []cli.Flag{
 		cli.BoolFlag{ // 是否前台运行命令行
 			Name:  "ti",
@@ -47,52 +51,402 @@ var runCommand = cli.Command{
 			Name:  "e",
 			Usage: "set environment",
 		},
+		cli.StringSliceFlag{ // 从文件读取环境变量，每行一个 KEY=VALUE
+			Name:  "env-file",
+			Usage: "read in a file of environment variables",
+		},
 		cli.StringFlag{ // 设置容器网络配置   mydocker run -ti -p 80:80 --net testbridgenet xxxx
 			Name:  "net",
-			Usage: "container network",
+			Usage: "container network, host, none or a network created by mydocker network create",
 		},
 		cli.StringSliceFlag{ // 设置端口映射
 			Name:  "p",
 			Usage: "port mapping",
 		},
+		cli.StringSliceFlag{ // 设置容器标签 --label key=value
+			Name:  "label",
+			Usage: "set meta data on a container",
+		},
+		cli.StringFlag{ // 日志驱动 mydocker run -d --log-driver syslog --log-opt syslog-address=udp://127.0.0.1:514 xxxx
+			Name:  "log-driver",
+			Usage: "logging driver for container: syslog, gelf or fluentd",
+		},
+		cli.StringSliceFlag{ // 日志驱动参数 --log-opt key=value
+			Name:  "log-opt",
+			Usage: "log driver options",
+		},
+		cli.StringFlag{ // 覆盖镜像的 Entrypoint，为空字符串时清空
+			Name:  "entrypoint",
+			Usage: "overwrite the default entrypoint of the image",
+		},
+		cli.StringFlag{ // 覆盖镜像的 WorkingDir
+			Name:  "workdir, w",
+			Usage: "working directory inside the container",
+		},
+		cli.BoolFlag{ // 由 mydocker 作为容器 1 号进程，转发信号并回收僵尸进程
+			Name:  "init",
+			Usage: "run an init inside the container that forwards signals and reaps processes",
+		},
+		cli.StringFlag{ // 覆盖镜像的 User，在容器 rootfs 的 /etc/passwd、/etc/group 中查找
+			Name:  "user, u",
+			Usage: "username or uid (format: <name|uid>[:<group|gid>])",
+		},
+		cli.StringSliceFlag{ // 资源限制 --ulimit nofile=1024:65536
+			Name:  "ulimit",
+			Usage: "ulimit options (format: <type>=<soft limit>[:<hard limit>])",
+		},
+		cli.StringFlag{ // 主机名，默认为容器 ID
+			Name:  "hostname",
+			Usage: "container host name",
+		},
+		cli.StringFlag{ // NIS 域名
+			Name:  "domainname",
+			Usage: "container NIS domain name",
+		},
+		cli.StringSliceFlag{ // DNS 服务器 --dns 8.8.8.8
+			Name:  "dns",
+			Usage: "set custom DNS servers",
+		},
+		cli.StringSliceFlag{ // DNS 搜索域，. 表示不设置
+			Name:  "dns-search",
+			Usage: "set custom DNS search domains",
+		},
+		cli.StringSliceFlag{ // resolv.conf 的 options --dns-option ndots:2
+			Name:  "dns-option",
+			Usage: "set DNS options",
+		},
+		cli.StringSliceFlag{ // 添加到 /etc/hosts 中的记录 --add-host name:ip，ip 可以为 host-gateway
+			Name:  "add-host",
+			Usage: "add a custom host-to-IP mapping (name:ip)",
+		},
+		cli.StringFlag{ // /dev/shm 的大小 --shm-size 128m，默认 64m
+			Name:  "shm-size",
+			Usage: "size of /dev/shm (format: <number>[<unit>], unit can be b, k, m or g)",
+		},
+		cli.BoolFlag{ // 根目录只读，需要写入的路径使用 --tmpfs 或数据卷
+			Name:  "read-only",
+			Usage: "mount the container's root filesystem as read only",
+		},
+		cli.StringSliceFlag{ // tmpfs 挂载 --tmpfs /run:size=64m,mode=1777
+			Name:  "tmpfs",
+			Usage: "mount a tmpfs directory (format: <path>[:<options>])",
+		},
+		cli.StringSliceFlag{ // 添加宿主机设备 --device /dev/fuse
+			Name:  "device",
+			Usage: "add a host device to the container (format: <host>[:<container>][:<rwm>])",
+		},
+		cli.StringSliceFlag{ // 允许访问的设备 --device-cgroup-rule 'c 10:229 rwm'
+			Name:  "device-cgroup-rule",
+			Usage: "add a rule to the cgroup allowed devices list (format: <type> <major>:<minor> <rwm>)",
+		},
+		cli.StringSliceFlag{ // 添加能力 --cap-add NET_ADMIN，ALL 表示所有能力
+			Name:  "cap-add",
+			Usage: "add Linux capabilities",
+		},
+		cli.StringSliceFlag{ // 去掉能力 --cap-drop ALL
+			Name:  "cap-drop",
+			Usage: "drop Linux capabilities",
+		},
+		cli.BoolFlag{ // 特权容器
+			Name:  "privileged",
+			Usage: "give extended privileges to this container",
+		},
+		cli.StringFlag{ // 在 pod 中运行，网络、IPC、UTS 命名空间和端口映射、主机名都属于 pod
+			Name:  "pod",
+			Usage: "run the container in an existing pod",
+		},
+		cli.StringFlag{ // PID 命名空间 --pid host
+			Name:  "pid",
+			Usage: "pid namespace to use (host, private or container:<name>)",
+		},
+		cli.StringFlag{ // IPC 命名空间，shareable 表示允许其它容器通过 --ipc container:<name> 加入
+			Name:  "ipc",
+			Usage: "ipc namespace to use (host, private, shareable or container:<name>)",
+		},
+		cli.StringFlag{ // UTS 命名空间，不是 private 时不能设置主机名
+			Name:  "uts",
+			Usage: "uts namespace to use (host, private or container:<name>)",
+		},
+		cli.StringFlag{ // cgroup 命名空间，默认使用宿主机的
+			Name:  "cgroupns",
+			Usage: "cgroup namespace to use (host, private or container:<name>)",
+		},
+		cli.StringSliceFlag{ // 在新的 time 命名空间中运行 --time-offset monotonic=24h
+			Name:  "time-offset",
+			Usage: "run in a new time namespace with the clock offset (format: monotonic|boottime=<offset>)",
+		},
+		cli.StringFlag{ // --userns=host 不使用 mydocker --userns-remap 设置的 user 命名空间
+			Name:  "userns",
+			Usage: "user namespace to use (host)",
+		},
+		cli.StringSliceFlag{ // --secret db-password,target=password,mode=0400,uid=1000
+			Name:  "secret",
+			Usage: "mount a secret created by mydocker secret create into /run/secrets (format: <name>[,target=<file>][,mode=<mode>][,uid=<uid>][,gid=<gid>])",
+		},
+		cli.StringSliceFlag{ // 安全选项 --security-opt unmask=/proc/kcore
+			Name:  "security-opt",
+			Usage: "security options (unmask=ALL|<path>[:<path>...], seccomp=unconfined|<profile.json>, no-new-privileges[=true|false])",
+		},
 	},
 	Action: func(context *cli.Context) error {
-		if len(context.Args()) < 1 { //没有传入参数直接返回
-			return fmt.Errorf("Missing container command")
+		// 参数错误和 Run 中的错误一样使用 125 退出，和容器进程的退出码区分开
+		opts, err := parseRunOptions(context)
+		if err != nil {
+			return runExitError(err)
 		}
-		//读取命令行参数
-		var cmdArray []string
-		for _, arg := range context.Args() {
-			cmdArray = append(cmdArray, arg)
+		if err := Run(opts); err != nil {
+			return runExitError(err)
 		}
+		return nil
+	},
+}
 
-		//get image name
-		imageName := cmdArray[0] // 指定镜像文件名字
-		cmdArray = cmdArray[1:]  // 需要执行的指令
+// 解析并校验 run 的命令行参数
+func parseRunOptions(context *cli.Context) (*runOptions, error) {
+	if len(context.Args()) < 1 { //没有传入参数直接返回
+		return nil, fmt.Errorf("Missing image name")
+	}
+	//读取命令行参数
+	var cmdArray []string
+	for _, arg := range context.Args() {
+		cmdArray = append(cmdArray, arg)
+	}
 
-		createTty := context.Bool("ti") // 是否前台运行
-		detach := context.Bool("d")     // 是否后台运行
-		// 不能同时指定
-		if createTty && detach {
-			return fmt.Errorf("ti and d paramter can not both provided")
+	//get image name
+	imageName := cmdArray[0] // 指定镜像文件名字
+	cmdArray = cmdArray[1:]  // 需要执行的指令，为空时使用镜像的 Cmd
+
+	createTty := context.Bool("ti") // 是否前台运行
+	detach := context.Bool("d")     // 是否后台运行
+	// 不能同时指定
+	if createTty && detach {
+		return nil, fmt.Errorf("ti and d paramter can not both provided")
+	}
+	// 资源限制设置
+	resConf := &subsystems.ResourceConfig{
+		MemoryLimit: context.String("m"),
+		CpuSet:      context.String("cpuset"),
+		CpuShare:    context.String("cpushare"),
+	}
+	log.Infof("createTty %v", createTty)
+	containerName := context.String("name") // 指定创建的容器名字
+	volume := context.String("v")           // 挂载信息，挂载后可以使用宿主机的目录，删除容器后可以保留数据
+	network := context.String("net")        // 网络配置信息
+
+	portmapping := context.StringSlice("p") // 端口映射
+	// 环境变量，-e KEY 时使用宿主机上同名变量的值
+	envSlice, err := parseEnvOptions(context.StringSlice("env-file"), context.StringSlice("e"))
+	if err != nil {
+		return nil, err
+	}
+
+	rlimits, err := parseUlimits(context.StringSlice("ulimit"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dns := range context.StringSlice("dns") {
+		if net.ParseIP(dns) == nil {
+			return nil, fmt.Errorf("invalid dns server %s", dns)
 		}
-		// 资源限制设置
-		resConf := &subsystems.ResourceConfig{
-			MemoryLimit: context.String("m"),
-			CpuSet:      context.String("cpuset"),
-			CpuShare:    context.String("cpushare"),
+	}
+	for _, host := range context.StringSlice("add-host") {
+		if _, _, err := container.ParseExtraHost(host); err != nil {
+			return nil, err
 		}
-		log.Infof("createTty %v", createTty)
-		containerName := context.String("name") // 指定创建的容器名字
-		volume := context.String("v")           // 挂载信息，挂载后可以使用宿主机的目录，删除容器后可以保留数据
-		network := context.String("net")        // 网络配置信息
-
-		envSlice := context.StringSlice("e")    // 环境变量
-		portmapping := context.StringSlice("p") // 端口映射
+	}
+	var shmSize int64
+	if context.IsSet("shm-size") {
+		if shmSize, err = container.ParseSize(context.String("shm-size")); err != nil || shmSize == 0 {
+			return nil, fmt.Errorf("invalid shm-size %q", context.String("shm-size"))
+		}
+	}
+	namespaces, err := parseNamespaceOptions(context)
+	if err != nil {
+		return nil, err
+	}
+	// pod 中的容器不能单独设置网络、端口映射、主机名和 IPC、UTS 命名空间
+	podName := context.String("pod")
+	if podName != "" {
+		if container.Rootless() {
+			return nil, fmt.Errorf("pods are not supported in rootless mode")
+		}
+		for _, flag := range []string{"net", "p", "hostname", "domainname", "ipc", "uts", "shm-size"} {
+			if context.IsSet(flag) {
+				return nil, fmt.Errorf("conflicting options: %s and pod, it belongs to the pod", flag)
+			}
+		}
+	}
+	// rootless 模式下每个容器在各自的 user 命名空间中，不能加入其它容器的命名空间，也不能挂载宿主机 PID 命名空间的 /proc
+	if container.Rootless() {
+		if namespaces.Pid == container.NamespaceHost {
+			return nil, fmt.Errorf("pid host is not supported in rootless mode")
+		}
+		for _, mode := range []string{namespaces.Pid, namespaces.Ipc, namespaces.Uts, namespaces.Cgroup} {
+			if container.NamespaceContainer(mode) != "" {
+				return nil, fmt.Errorf("joining the namespaces of other containers is not supported in rootless mode")
+			}
+		}
+	}
+	// 共享 UTS 命名空间时使用对方的主机名，共享 IPC 命名空间时使用对方的 /dev/shm
+	if namespaces.Uts != container.NamespacePrivate && (context.String("hostname") != "" || context.String("domainname") != "") {
+		return nil, fmt.Errorf("conflicting options: hostname and the uts mode %s", namespaces.Uts)
+	}
+	if namespaces.Ipc != container.NamespacePrivate && namespaces.Ipc != container.NamespaceShareable && shmSize > 0 {
+		return nil, fmt.Errorf("conflicting options: shm-size and the ipc mode %s", namespaces.Ipc)
+	}
+	devices, deviceRules, err := parseDeviceOptions(context.StringSlice("device"), context.StringSlice("device-cgroup-rule"))
+	if err != nil {
+		return nil, err
+	}
+	resConf.DeviceRules = deviceRules
+	tmpfsDests := map[string]bool{}
+	for _, value := range context.StringSlice("tmpfs") {
+		m, err := container.ParseTmpfs(value)
+		if err != nil {
+			return nil, err
+		}
+		if tmpfsDests[m.Destination] {
+			return nil, fmt.Errorf("duplicate tmpfs mount point %s", m.Destination)
+		}
+		tmpfsDests[m.Destination] = true
+	}
+	var secrets []container.SecretReference
+	secretTargets := map[string]bool{}
+	for _, value := range context.StringSlice("secret") {
+		ref, err := container.ParseSecretReference(value)
+		if err != nil {
+			return nil, err
+		}
+		if secretTargets[ref.Target] {
+			return nil, fmt.Errorf("duplicate secret target %s", ref.Target)
+		}
+		secretTargets[ref.Target] = true
+		if _, err := container.LoadSecretInfo(ref.Name); err != nil {
+			return nil, fmt.Errorf("No such secret %s", ref.Name)
+		}
+		secrets = append(secrets, ref)
+	}
+	security, err := container.ParseSecurityOpts(context.StringSlice("security-opt"))
+	if err != nil {
+		return nil, err
+	}
+	capabilities, err := container.TweakCapabilities(container.DefaultCapabilities, context.StringSlice("cap-add"), context.StringSlice("cap-drop"))
+	if err != nil {
+		return nil, err
+	}
+	// 特权容器拥有所有能力，可以访问宿主机的所有设备，不屏蔽任何路径
+	privileged := context.Bool("privileged")
+	if privileged {
+		capabilities = container.ListCapabilities()
+		hostDevices, err := container.HostDevices()
+		if err != nil {
+			return nil, fmt.Errorf("get host devices error %v", err)
+		}
+		devices = append(hostDevices, devices...)
+		resConf.DeviceRules = []subsystems.DeviceRule{{Type: 'a', Major: -1, Minor: -1, Access: "rwm"}}
+		security.Unmask = append(security.Unmask, container.UnmaskAll)
+	}
+	seccomp, err := loadSeccompProfile(security.Seccomp, privileged, capabilities)
+	if err != nil {
+		return nil, err
+	}
+	// 设置了 mydocker --userns-remap 时容器默认使用 user 命名空间，--userns=host 表示不使用
+	userns := context.String("userns")
+	if userns != "" && userns != container.UsernsHost {
+		return nil, fmt.Errorf("invalid userns %q, only %s is supported", userns, container.UsernsHost)
+	}
+	var uidMaps, gidMaps []container.IDMap
+	if remap := context.GlobalString("userns-remap"); remap != "" && userns != container.UsernsHost {
+		if container.Rootless() {
+			return nil, fmt.Errorf("userns-remap is not supported in rootless mode")
+		}
+		if privileged {
+			return nil, fmt.Errorf("privileged mode is incompatible with user namespace remapping, use --userns=host")
+		}
+		if podName != "" {
+			return nil, fmt.Errorf("pods are incompatible with user namespace remapping, use --userns=host")
+		}
+		// 容器内的 root 不是宿主机的 root，不能使用宿主机的命名空间
+		if namespaces.Pid == container.NamespaceHost || namespaces.Ipc == container.NamespaceHost ||
+			namespaces.Uts == container.NamespaceHost || network == "host" {
+			return nil, fmt.Errorf("host namespaces are incompatible with user namespace remapping, use --userns=host")
+		}
+		if uidMaps, gidMaps, err = container.LoadRemapIDMaps(remap); err != nil {
+			return nil, err
+		}
+	}
+	// 没有通过 --security-opt 指定时使用 mydocker --no-new-privileges 的默认值
+	noNewPrivs := context.GlobalBool("no-new-privileges")
+	if security.NoNewPrivileges != nil {
+		noNewPrivs = *security.NoNewPrivileges
+	}
+	labels, err := parseKeyValues(context.StringSlice("label"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid label: %v", err)
+	}
+	// 日志驱动配置，启动容器前先校验
+	var logConfig *container.LogConfig
+	if driver := context.String("log-driver"); driver != "" {
+		if createTty {
+			return nil, fmt.Errorf("log driver can only be used with detached container")
+		}
+		opts, err := parseKeyValues(context.StringSlice("log-opt"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log opt: %v", err)
+		}
+		if err := logger.ValidateLogOpts(driver, opts); err != nil {
+			return nil, err
+		}
+		logConfig = &container.LogConfig{Type: driver, Config: opts}
+	} else if len(context.StringSlice("log-opt")) > 0 {
+		return nil, fmt.Errorf("log-opt requires log-driver")
+	}
 
-		Run(createTty, cmdArray, resConf, containerName, volume, imageName, envSlice, network, portmapping)
-		return nil
-	},
+	opts := &runOptions{
+		tty:           createTty,
+		args:          cmdArray,
+		workdir:       context.String("workdir"),
+		init:          context.Bool("init"),
+		user:          context.String("user"),
+		rlimits:       rlimits,
+		hostname:      context.String("hostname"),
+		domainname:    context.String("domainname"),
+		dns:           context.StringSlice("dns"),
+		dnsSearch:     context.StringSlice("dns-search"),
+		dnsOptions:    context.StringSlice("dns-option"),
+		extraHosts:    context.StringSlice("add-host"),
+		shmSize:       shmSize,
+		readonly:      context.Bool("read-only"),
+		tmpfs:         context.StringSlice("tmpfs"),
+		secrets:       secrets,
+		devices:       devices,
+		capabilities:  capabilities,
+		privileged:    privileged,
+		seccomp:       seccomp,
+		noNewPrivs:    noNewPrivs,
+		userns:        userns,
+		uidMaps:       uidMaps,
+		gidMaps:       gidMaps,
+		deviceRules:   context.StringSlice("device-cgroup-rule"),
+		securityOpt:   context.StringSlice("security-opt"),
+		security:      security,
+		resConf:       resConf,
+		containerName: containerName,
+		volume:        volume,
+		imageName:     imageName,
+		env:           envSlice,
+		network:       network,
+		namespaces:    namespaces,
+		pod:           podName,
+		portMapping:   portmapping,
+		labels:        labels,
+		logConfig:     logConfig,
+	}
+	if context.IsSet("entrypoint") {
+		entrypoint := context.String("entrypoint")
+		opts.entrypoint = &entrypoint
+	}
+	return opts, nil
 }
 
 var initCommand = cli.Command{
@@ -105,6 +459,28 @@ var initCommand = cli.Command{
 	},
 }
 
+var podInfraCommand = cli.Command{
+	Name:  "pod-infra",
+	Usage: "Hold the namespaces of a pod. Do not call it outside",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing hostname")
+		}
+		return container.RunPodInfra(context.Args().Get(0))
+	},
+}
+
+var logForwardCommand = cli.Command{
+	Name:  "log-forward",
+	Usage: "Forward container output to its log driver. Do not call it outside",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return forwardContainerLog(context.Args().Get(0))
+	},
+}
+
 var listCommand = cli.Command{
 	Name:  "ps",
 	Usage: "list all the containers",
@@ -128,14 +504,62 @@ var logCommand = cli.Command{
 }
 
 var execCommand = cli.Command{
-	Name:  "exec",
-	Usage: "exec a command into container",
+	Name:           "exec",
+	Usage:          "exec a command into container, or list (exec ls) and inspect (exec inspect) exec sessions",
+	SkipArgReorder: true,
+	Flags: []cli.Flag{
+		cli.BoolFlag{ // 分配伪终端，交互运行
+			Name:  "ti",
+			Usage: "enable tty",
+		},
+		cli.BoolFlag{ // 后台运行
+			Name:  "d",
+			Usage: "detach command",
+		},
+		cli.StringSliceFlag{ // 额外的环境变量 -e KEY=VALUE
+			Name:  "e",
+			Usage: "set environment",
+		},
+		cli.StringSliceFlag{ // 从文件读取环境变量，每行一个 KEY=VALUE
+			Name:  "env-file",
+			Usage: "read in a file of environment variables",
+		},
+		cli.StringFlag{ // 覆盖容器的工作目录
+			Name:  "workdir, w",
+			Usage: "working directory inside the container",
+		},
+		cli.StringFlag{ // 运行用户 name、uid、uid:gid 或 name:group
+			Name:  "user, u",
+			Usage: "username or uid (format: <name|uid>[:<group|gid>])",
+		},
+	},
 	Action: func(context *cli.Context) error {
 		//This is for callback
 		if os.Getenv(ENV_EXEC_PID) != "" {
-			log.Infof("pid callback pid %s", os.Getgid())
+			// 错误已经通过同步管道报告给了 mydocker exec，这里不再输出
+			if err := container.RunContainerExecProcess(); err != nil {
+				return cli.NewExitError("", container.ExitCodeRuntime)
+			}
 			return nil
 		}
+		// mydocker exec ls 容器名、mydocker exec inspect ID 查询 exec 会话
+		// 不用子命令实现，这样已经存在名为 ls、inspect 的容器时优先 exec 到容器中
+		switch name := context.Args().First(); name {
+		case "ls", "inspect":
+			if _, err := os.Stat(fmt.Sprintf(container.DefaultInfoLocation, name) + container.ConfigName); err == nil {
+				break
+			}
+			if len(context.Args()) < 2 {
+				if name == "ls" {
+					return fmt.Errorf("Missing container name")
+				}
+				return fmt.Errorf("Missing exec id")
+			}
+			if name == "ls" {
+				return ListExecs(context.Args().Get(1))
+			}
+			return InspectExec(context.Args().Get(1))
+		}
 		// mydocker exec 容器名 命令
 		if len(context.Args()) < 2 {
 			return fmt.Errorf("Missing container name or command")
@@ -145,11 +569,52 @@ var execCommand = cli.Command{
 		for _, arg := range context.Args().Tail() { // 指令列表
 			commandArray = append(commandArray, arg)
 		}
-		ExecContainer(containerName, commandArray)
+		env, err := parseEnvOptions(context.StringSlice("env-file"), context.StringSlice("e"))
+		if err != nil {
+			return err
+		}
+		opts := &execOptions{
+			tty:     context.Bool("ti"),
+			detach:  context.Bool("d"),
+			env:     env,
+			workdir: context.String("workdir"),
+			user:    context.String("user"),
+		}
+		if opts.tty && opts.detach {
+			return fmt.Errorf("ti and d paramter can not both provided")
+		}
+		if err := ExecContainer(containerName, commandArray, opts); err != nil {
+			return runExitError(err)
+		}
 		return nil
 	},
 }
 
+var execMonitorCommand = cli.Command{
+	Name:  "exec-monitor",
+	Usage: "Run a detached exec session and record its exit code. Do not call it outside",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("Missing container name or exec id")
+		}
+		if err := monitorExec(context.Args().Get(0), context.Args().Get(1)); err != nil {
+			return cli.NewExitError("", container.ExitCodeRuntime)
+		}
+		return nil
+	},
+}
+
+var inspectCommand = cli.Command{
+	Name:  "inspect",
+	Usage: "show details of a container",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return inspectContainer(context.Args().Get(0))
+	},
+}
+
 var stopCommand = cli.Command{
 	Name:  "stop",
 	Usage: "stop a container",
@@ -193,6 +658,13 @@ var commitCommand = cli.Command{
 var networkCommand = cli.Command{
 	Name:  "network",
 	Usage: "container network commands",
+	// 创建网桥、配置 iptables 需要宿主机上的 root 权限
+	Before: func(context *cli.Context) error {
+		if container.Rootless() {
+			return fmt.Errorf("network commands are not supported in rootless mode")
+		}
+		return nil
+	},
 	Subcommands: []cli.Command{
 		{
 			Name:  "create",
@@ -249,3 +721,157 @@ var networkCommand = cli.Command{
 		},
 	},
 }
+
+var podCommand = cli.Command{
+	Name:  "pod",
+	Usage: "pod commands, containers in a pod share network, IPC and UTS namespaces",
+	// pod 的命名空间属于 infra 进程所在的 user 命名空间，rootless 模式下其它容器无法加入
+	// 父命令的 Before 在执行任何子命令之前调用，pod create、rm、ps、inspect 都会在这里被拒绝
+	Before: func(context *cli.Context) error {
+		if container.Rootless() {
+			return fmt.Errorf("pod commands are not supported in rootless mode")
+		}
+		return nil
+	},
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create a pod",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "net",
+					Usage: "pod network, host, none or a network created by mydocker network create",
+				},
+				cli.StringSliceFlag{
+					Name:  "p",
+					Usage: "port mapping",
+				},
+				cli.StringFlag{ // 主机名，默认为 pod 名
+					Name:  "hostname",
+					Usage: "pod host name",
+				},
+				cli.StringFlag{
+					Name:  "shm-size",
+					Usage: "size of /dev/shm shared by the pod (format: <number>[<unit>], unit can be b, k, m or g)",
+				},
+				cli.StringFlag{
+					Name:  "m",
+					Usage: "memory limit of the pod",
+				},
+				cli.StringFlag{
+					Name:  "cpushare",
+					Usage: "cpushare limit of the pod",
+				},
+				cli.StringFlag{
+					Name:  "cpuset",
+					Usage: "cpuset limit of the pod",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				// mydocker pod create --net testbridgenet -p 8080:80 web
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				opts := &podOptions{
+					name:        context.Args().Get(0),
+					hostname:    context.String("hostname"),
+					network:     context.String("net"),
+					portMapping: context.StringSlice("p"),
+					resConf: &subsystems.ResourceConfig{
+						MemoryLimit: context.String("m"),
+						CpuSet:      context.String("cpuset"),
+						CpuShare:    context.String("cpushare"),
+					},
+				}
+				if context.IsSet("shm-size") {
+					shmSize, err := container.ParseSize(context.String("shm-size"))
+					if err != nil || shmSize == 0 {
+						return fmt.Errorf("invalid shm-size %q", context.String("shm-size"))
+					}
+					opts.shmSize = shmSize
+				}
+				if len(opts.portMapping) > 0 && !bridgeNetwork(opts.network) {
+					return fmt.Errorf("port mapping requires --net")
+				}
+				return CreatePod(opts)
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove a pod and its containers",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				return RemovePod(context.Args().Get(0))
+			},
+		},
+		{
+			Name:  "ps",
+			Usage: "list pods",
+			Action: func(context *cli.Context) error {
+				return ListPods()
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "show details of a pod",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				return InspectPod(context.Args().Get(0))
+			},
+		},
+	},
+}
+
+var secretCommand = cli.Command{
+	Name:  "secret",
+	Usage: "secret commands, secrets are mounted into containers on tmpfs instead of passing them through environment variables",
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create a secret from a file, or from stdin when the file is -",
+			Action: func(context *cli.Context) error {
+				// mydocker secret create db-password ./password.txt
+				if len(context.Args()) < 2 {
+					return fmt.Errorf("Missing secret name or file")
+				}
+				return CreateSecret(context.Args().Get(0), context.Args().Get(1))
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list secrets",
+			Action: func(context *cli.Context) error {
+				return ListSecrets()
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove secrets",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing secret name")
+				}
+				for _, name := range context.Args() {
+					if err := RemoveSecret(name); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "show details of a secret, without its data",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing secret name")
+				}
+				return InspectSecret(context.Args().Get(0))
+			},
+		},
+	},
+}
@@ -86,7 +86,16 @@ func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 	return nil
 }
 
+// 删除网络端点在宿主机上的 veth，另一端随之删除
+// 容器的网络命名空间销毁时 veth 已经自动删除，这时找不到接口直接返回
 func (d *BridgeNetworkDriver) Disconnect(network Network, endpoint *Endpoint) error {
+	link, err := netlink.LinkByName(endpoint.ID[:5])
+	if err != nil {
+		return nil
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("Error Delete Endpoint Device: %v", err)
+	}
 	return nil
 }
 
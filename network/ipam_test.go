@@ -3,6 +3,10 @@ package network
 import(
 	"testing"
 	"net"
+	"io/ioutil"
+	"os"
+	"path"
+	"github.com/xianlubird/mydocker/container"
 )
 
 func TestAllocate(t *testing.T) {
@@ -14,4 +18,35 @@ func TestAllocate(t *testing.T) {
 func TestRelease(t *testing.T) {
 	ip, ipnet, _ := net.ParseCIDR("192.168.0.1/24")
 	ipAllocator.Release(ipnet, &ip)
-}
\ No newline at end of file
+}
+func TestDisconnectRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mydocker-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allocatorPath := ipAllocator.SubnetAllocatorPath
+	ipAllocator.SubnetAllocatorPath = path.Join(dir, "subnet.json")
+	defer func() { ipAllocator.SubnetAllocatorPath = allocatorPath }()
+
+	_, ipnet, _ := net.ParseCIDR("172.30.0.0/24")
+	drivers["bridge"] = &BridgeNetworkDriver{}
+	networks["testdisconnect"] = &Network{Name: "testdisconnect", IpRange: ipnet, Driver: "bridge"}
+	defer delete(networks, "testdisconnect")
+
+	ip, err := ipAllocator.Allocate(ipnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 断开连接后 IP 还给 IPAM，下一次分配得到同一个 IP
+	if err := Disconnect("testdisconnect", &container.ContainerInfo{Id: "testcontainer"}, ip); err != nil {
+		t.Fatalf("disconnect error %v", err)
+	}
+	again, err := ipAllocator.Allocate(ipnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(ip) {
+		t.Errorf("ip %v is not released, allocate got %v", ip, again)
+	}
+}
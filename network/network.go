@@ -22,6 +22,11 @@ import (
 	"text/tabwriter"
 )
 
+const (
+	HostNetwork = "host" // --net host 使用宿主机的网络命名空间
+	NoneNetwork = "none" // --net none 只有 lo 网卡
+)
+
 var (
 	defaultNetworkPath = "/var/run/mydocker/network/network/"
 	drivers            = map[string]NetworkDriver{}
@@ -79,20 +84,20 @@ func (nw *Network) dump(dumpPath string) error {
 	nwPath := path.Join(dumpPath, nw.Name)
 	nwFile, err := os.OpenFile(nwPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		logrus.Errorf("error：", err)
+		logrus.Errorf("error：%v", err)
 		return err
 	}
 	defer nwFile.Close()
 
 	nwJson, err := json.Marshal(nw)
 	if err != nil {
-		logrus.Errorf("error：", err)
+		logrus.Errorf("error：%v", err)
 		return err
 	}
 
 	_, err = nwFile.Write(nwJson)
 	if err != nil {
-		logrus.Errorf("error：", err)
+		logrus.Errorf("error：%v", err)
 		return err
 	}
 	return nil
@@ -126,7 +131,7 @@ func (nw *Network) load(dumpPath string) error {
 
 	err = json.Unmarshal(nwJson[:n], nw)
 	if err != nil {
-		logrus.Errorf("Error load nw info", err)
+		logrus.Errorf("Error load nw info %v", err)
 		return err
 	}
 	return nil
@@ -171,6 +176,9 @@ func Init() error {
 
 // 创建网络
 func CreateNetwork(driver, subnet, name string) error {
+	if name == HostNetwork || name == NoneNetwork {
+		return fmt.Errorf("network name %s is reserved", name)
+	}
 	// subnet： 子网网段信息 192.168.0.0/24
 	// ParseCIDR 是golang net 包的函数， 功能是将网络的字符串转换成net.IPNet的对象
 	_, cidr, _ := net.ParseCIDR(subnet)
@@ -331,6 +339,21 @@ func configEndpointIpAddressAndRoute(ep *Endpoint, cinfo *container.ContainerInf
 	return nil
 }
 
+// 删除端口映射添加的 DNAT 规则
+func removePortMapping(ep *Endpoint) {
+	for _, pm := range ep.PortMapping {
+		portMapping := strings.Split(pm, ":")
+		if len(portMapping) != 2 {
+			continue
+		}
+		iptablesCmd := fmt.Sprintf("-t nat -D PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
+			portMapping[0], ep.IPAddress.String(), portMapping[1])
+		if output, err := exec.Command("iptables", strings.Split(iptablesCmd, " ")...).CombinedOutput(); err != nil {
+			logrus.Warnf("remove port mapping %s error %v, %s", pm, err, output)
+		}
+	}
+}
+
 // 配置容器到宿主机的端口映射
 func configPortMapping(ep *Endpoint, cinfo *container.ContainerInfo) error {
 	//遍历容器端口映射列表
@@ -359,40 +382,70 @@ func configPortMapping(ep *Endpoint, cinfo *container.ContainerInfo) error {
 }
 
 //连接容器到之前创建的网络 mydocker run net testnet -p 8080:80 xxxx
-func Connect(networkName string, cinfo *container.ContainerInfo) error {
+// 返回容器的网络端点，包括分配的 IP 和所在网络的信息
+func Connect(networkName string, cinfo *container.ContainerInfo) (*Endpoint, error) {
 	// 从 networks 字典中取到容器连接的网络的信息， networks 字典中保存了当前己经创建的网络
 	network, ok := networks[networkName]
 	if !ok {
-		return fmt.Errorf("No Such Network: %s", networkName)
+		return nil, fmt.Errorf("No Such Network: %s", networkName)
 	}
 
 	// 通过调用 IPAM 从网络的网段中获取可用的 IP 作为容器 IP 地址
 	ip, err := ipAllocator.Allocate(network.IpRange)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 创建网络端点
 	ep := &Endpoint{
-		ID:          fmt.Sprintf("%s-%s", cinfo.Id, networkName),
-		IPAddress:   ip,
-		Network:     network,
-		PortMapping: cinfo.PortMapping,
+		ID:        fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+		IPAddress: ip,
+		Network:   network,
 	}
 	// 调用网络驱动挂载和配置网络端点
 	// 传入： network: 网络配置信息  ep： 进程的ip等网络端点信息
 	if err = drivers[network.Driver].Connect(network, ep); err != nil {
-		return err
+		releaseEndpoint(ep)
+		return nil, err
 	}
 	// 进入到容器的网络 Namespace 配置容器网络设备的 IP 地址和路由
 	if err = configEndpointIpAddressAndRoute(ep, cinfo); err != nil {
-		return err
+		releaseEndpoint(ep)
+		return nil, err
 	}
 
-	// 配置容器到宿主机的端口映射
-	return configPortMapping(ep, cinfo)
+	// 配置容器到宿主机的端口映射，失败时 releaseEndpoint 删除已经添加的规则
+	ep.PortMapping = cinfo.PortMapping
+	if err = configPortMapping(ep, cinfo); err != nil {
+		releaseEndpoint(ep)
+		return nil, err
+	}
+	return ep, nil
 }
 
-func Disconnect(networkName string, cinfo *container.ContainerInfo) error {
-	return nil
+// 断开容器和网络的连接，ip 为 Connect 时分配的 IP
+// 删除端口映射的 DNAT 规则和 veth，把 IP 还给 IPAM
+func Disconnect(networkName string, cinfo *container.ContainerInfo, ip net.IP) error {
+	network, ok := networks[networkName]
+	if !ok {
+		return fmt.Errorf("No Such Network: %s", networkName)
+	}
+	return releaseEndpoint(&Endpoint{
+		ID:          fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+		IPAddress:   ip,
+		Network:     network,
+		PortMapping: cinfo.PortMapping,
+	})
+}
+
+// 释放网络端点占用的资源，Connect 失败时也用来清理已经创建的部分
+func releaseEndpoint(ep *Endpoint) error {
+	removePortMapping(ep)
+	err := drivers[ep.Network.Driver].Disconnect(*ep.Network, ep)
+	// Release 会修改传入的 IP，使用一个副本
+	ip := append(net.IP{}, ep.IPAddress...)
+	if releaseErr := ipAllocator.Release(ep.Network.IpRange, &ip); err == nil {
+		err = releaseErr
+	}
+	return err
 }
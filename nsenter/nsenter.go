@@ -9,47 +9,128 @@ package nsenter
 #include <stdlib.h>
 #include <string.h>
 #include <fcntl.h>
+#include <signal.h>
+#include <sys/stat.h>
+#include <sys/wait.h>
+
+// 和 container.ExitCodeRuntime 保持一致
+#define EXIT_CODE_RUNTIME 125
+
+static pid_t child_pid;
+
+// 把 mydocker exec 转发过来的信号再转发给用户进程
+// 终端产生的信号（Ctrl-C 等）内核会直接发给整个前台进程组，不需要再转发
+static void forward_signal(int sig, siginfo_t *info, void *context) {
+	if (info->si_code == SI_KERNEL) {
+		return;
+	}
+	kill(child_pid, sig);
+}
+
+// 等待用户进程退出，并以它的退出码退出
+static void wait_child(void) {
+	int i, status;
+	int signals[] = { SIGINT, SIGTERM, SIGHUP, SIGQUIT, SIGUSR1, SIGUSR2 };
+	struct sigaction sa;
+
+	// 管道留给子进程，自己不关闭的话 mydocker exec 读不到 EOF
+	close(3);
+	close(4);
+
+	memset(&sa, 0, sizeof(sa));
+	sa.sa_sigaction = forward_signal;
+	sa.sa_flags = SA_SIGINFO | SA_RESTART;
+	for (i=0; i<sizeof(signals)/sizeof(signals[0]); i++) {
+		sigaction(signals[i], &sa, NULL);
+	}
+	while (waitpid(child_pid, &status, 0) == -1) {
+		if (errno != EINTR) {
+			fprintf(stderr, "nsenter: wait child failed: %s\n", strerror(errno));
+			exit(EXIT_CODE_RUNTIME);
+		}
+	}
+	if (WIFSIGNALED(status)) {
+		exit(128 + WTERMSIG(status));
+	}
+	exit(WEXITSTATUS(status));
+}
+
 //只要这个包被导入 它就会在所有 Go 代码前执行,故使用环境变量
+//这里只负责加入容器的命名空间，要执行的指令、环境变量等由 go 代码通过管道读取，最后 execve 用户指令
 __attribute__((constructor)) void enter_namespace(void) {
 	char *mydocker_pid;
 	mydocker_pid = getenv("mydocker_pid");
-	if (mydocker_pid) {
-		//fprintf(stdout, "got mydocker_pid=%s\n", mydocker_pid);
-	} else {
+	if (!mydocker_pid) {
 		//fprintf(stdout, "missing mydocker_pid env skip nsenter");
 		return;
 	}
-	char *mydocker_cmd;
-	mydocker_cmd = getenv("mydocker_cmd");
-	if (mydocker_cmd) {
-		//fprintf(stdout, "got mydocker_cmd=%s\n", mydocker_cmd);
-	} else {
-		//fprintf(stdout, "missing mydocker_cmd env skip nsenter");
-		return;
-	}
 	int i;
+	char c;
 	char nspath[1024];
-	char *namespaces[] = { "ipc", "uts", "net", "pid", "mnt" };
+	struct stat self_st, st;
+	// user 命名空间要最先加入，之后才有权限加入其它命名空间；mnt 最后加入，之前还需要访问宿主机的 /proc
+	char *namespaces[] = { "user", "cgroup", "ipc", "uts", "net", "pid", "time", "mnt" };
+	int n = sizeof(namespaces) / sizeof(namespaces[0]);
+	int fds[n];
 
-	for (i=0; i<5; i++) {
-		sprintf(nspath, "/proc/%s/ns/%s", mydocker_pid, namespaces[i]);
-		int fd = open(nspath, O_RDONLY);
+	// 等待 mydocker exec 把当前进程加入容器的 cgroup（fd 5），之后 fork 出的用户进程也就在容器的 cgroup 中
+	if (read(5, &c, 1) != 1) {
+		fprintf(stderr, "nsenter: wait for cgroup setup failed\n");
+		exit(EXIT_CODE_RUNTIME);
+	}
+	close(5);
 
+	// 先打开所有命名空间文件，加入 mnt 命名空间后 /proc 就是容器内的了，找不到宿主机上的 pid
+	// 只加入容器实际使用的命名空间: 内核不支持的（没有对应文件）和与当前进程相同的都跳过
+	for (i=0; i<n; i++) {
+		fds[i] = -1;
+		snprintf(nspath, sizeof(nspath), "/proc/%s/ns/%s", mydocker_pid, namespaces[i]);
+		if (stat(nspath, &st) == -1) {
+			if (errno == ENOENT) {
+				continue;
+			}
+			fprintf(stderr, "nsenter: stat %s failed: %s\n", nspath, strerror(errno));
+			exit(EXIT_CODE_RUNTIME);
+		}
+		snprintf(nspath, sizeof(nspath), "/proc/self/ns/%s", namespaces[i]);
+		if (stat(nspath, &self_st) == 0 && self_st.st_dev == st.st_dev && self_st.st_ino == st.st_ino) {
+			continue;
+		}
+		snprintf(nspath, sizeof(nspath), "/proc/%s/ns/%s", mydocker_pid, namespaces[i]);
+		fds[i] = open(nspath, O_RDONLY | O_CLOEXEC);
+		if (fds[i] == -1) {
+			fprintf(stderr, "nsenter: open %s failed: %s\n", nspath, strerror(errno));
+			exit(EXIT_CODE_RUNTIME);
+		}
+	}
+
+	for (i=0; i<n; i++) {
+		if (fds[i] == -1) {
+			continue;
+		}
 		//setns 个系统调用，可以根据提供的 PID 再次进入到指定的 Namespace 。
 		//它需要先打开／proc/[pid]/ns／文件夹下对应的文件，然后使当前进程进入到指定的 Namespace 。
 		//系统调用描述非常简单，但是有一点对于 Go 来说很麻烦。对于 Mount Namespace 来说， 一个具有多线程的进程是无法使用 setns 调用进入到对应的命名空间的。
 		//但是， Go 每启动一个程序就会进入多线程状态，因此无法简简单单地在 Go 里面直接调用系统调用，使当前的进程进入对应Mount Namespace 。这里需要借助C来实现这个功能
 		// 参考： https://www.cnblogs.com/YaoDD/p/6225803.html
-		if (setns(fd, 0) == -1) {
-			//fprintf(stderr, "setns on %s namespace failed: %s\n", namespaces[i], strerror(errno));
-		} else {
-			//fprintf(stdout, "setns on %s namespace succeeded\n", namespaces[i]);
+		// 加入任何一个命名空间失败都直接退出，不能在宿主机上执行用户指令
+		if (setns(fds[i], 0) == -1) {
+			fprintf(stderr, "nsenter: setns on %s namespace failed: %s\n", namespaces[i], strerror(errno));
+			exit(EXIT_CODE_RUNTIME);
 		}
-		close(fd);
+		close(fds[i]);
+	}
+
+	// 加入 pid 命名空间只对之后创建的子进程生效，而且 go runtime 无法在这种状态下创建线程
+	// 所以再 fork 一次，子进程才真正在容器的 pid 命名空间中，由它继续执行 go 代码
+	child_pid = fork();
+	if (child_pid == -1) {
+		fprintf(stderr, "nsenter: fork failed: %s\n", strerror(errno));
+		exit(EXIT_CODE_RUNTIME);
+	}
+	if (child_pid > 0) {
+		wait_child();
 	}
-	int res = system(mydocker_cmd);
-	exit(0);
-	return;
 }
 */
 import "C"
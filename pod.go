@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/xianlubird/mydocker/cgroups"
+	"github.com/xianlubird/mydocker/cgroups/subsystems"
+	"github.com/xianlubird/mydocker/container"
+	"github.com/xianlubird/mydocker/network"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// 删除 pod 时等待容器退出的时间，超时后强制结束
+const podStopTimeout = 10 * time.Second
+
+// pod create 的参数
+type podOptions struct {
+	name        string                     // pod 名
+	hostname    string                     // 主机名，为空时使用 pod 名
+	network     string                     // 网络，host、none 或者 mydocker network create 创建的网络
+	portMapping []string                   // 端口映射
+	shmSize     int64                      // /dev/shm 的大小，为 0 时使用默认值
+	resConf     *subsystems.ResourceConfig // pod 中所有容器共同的资源限制
+}
+
+// 创建 pod: 启动持有命名空间的 infra 进程，创建 pod 的 cgroup，连接网络
+func CreatePod(opts *podOptions) error {
+	dirURL := fmt.Sprintf(container.DefaultPodLocation, opts.name)
+	if _, err := os.Stat(dirURL); err == nil {
+		return fmt.Errorf("Pod %s already exists", opts.name)
+	}
+	if opts.hostname == "" {
+		opts.hostname = opts.name
+	}
+	podID := randStringBytes(10)
+	pod := &container.PodInfo{
+		Id:           podID,
+		Name:         opts.name,
+		CreatedTime:  time.Now().Format("2006-01-02 15:04:05"),
+		Hostname:     opts.hostname,
+		Network:      opts.network,
+		PortMapping:  opts.portMapping,
+		ShmSize:      opts.shmSize,
+		CgroupParent: "pod-" + podID,
+	}
+	if err := os.MkdirAll(dirURL, 0700); err != nil {
+		return fmt.Errorf("Mkdir %s error %v", dirURL, err)
+	}
+	cleanup := func() {
+		container.UnmountShm(container.PodShmPath(opts.name))
+		os.RemoveAll(dirURL)
+	}
+	// pod 中的容器共享同一个 /dev/shm
+	if err := container.MountShm(container.PodShmPath(opts.name), opts.shmSize); err != nil {
+		cleanup()
+		return err
+	}
+
+	infra, syncPipe, err := container.NewPodInfraProcess(opts.hostname, opts.network == network.HostNetwork)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	if err := infra.Start(); err != nil {
+		cleanup()
+		return fmt.Errorf("Start pod infra process error %v", err)
+	}
+	for _, f := range infra.ExtraFiles {
+		f.Close()
+	}
+	pod.Pid = strconv.Itoa(infra.Process.Pid)
+	if err := container.ReadInitError(syncPipe); err != nil {
+		infra.Process.Kill()
+		infra.Wait()
+		cleanup()
+		return err
+	}
+	kill := func() {
+		infra.Process.Kill()
+		infra.Wait()
+		releasePodNetwork(pod)
+		cgroups.NewCgroupManager(pod.CgroupParent).Destroy()
+		cleanup()
+	}
+
+	// pod 的 cgroup 作为容器 cgroup 的父目录，infra 进程也放在里面
+	cgroupManager := cgroups.NewCgroupManager(pod.CgroupParent)
+	if err := cgroupManager.Set(opts.resConf); err != nil {
+		kill()
+		return fmt.Errorf("Set pod %s resource limits error %v", opts.name, err)
+	}
+	if err := cgroupManager.Apply(infra.Process.Pid); err != nil {
+		kill()
+		return fmt.Errorf("Apply pod %s cgroup error %v", opts.name, err)
+	}
+
+	// 网络端点属于 pod，pod 中的容器使用同一个 IP
+	if bridgeNetwork(opts.network) {
+		network.Init()
+		ep, err := network.Connect(opts.network, &container.ContainerInfo{
+			Id:          podID,
+			Pid:         pod.Pid,
+			Name:        opts.name,
+			PortMapping: opts.portMapping,
+		})
+		if err != nil {
+			kill()
+			return fmt.Errorf("Error Connect Network %v", err)
+		}
+		// 之后的失败由 kill 释放网络端点
+		pod.IPAddress = ep.IPAddress
+		pod.Gateway = ep.Network.IpRange.IP
+	}
+
+	if err := writePodInfo(pod); err != nil {
+		kill()
+		return err
+	}
+	fmt.Println(podID)
+	return nil
+}
+
+// 删除 pod: 先停止并删除 pod 中的容器，再结束 infra 进程，最后释放网络端点，删除 pod 的 cgroup 和信息
+func RemovePod(podName string) error {
+	pod, err := getPodInfoByName(podName)
+	if err != nil {
+		return fmt.Errorf("No such pod %s", podName)
+	}
+	members, err := podContainers(podName)
+	if err != nil {
+		return err
+	}
+	// 先给所有容器发送停止信号，再一起等待它们退出
+	var pids []int
+	for _, c := range members {
+		if c.Status != container.RUNNING {
+			continue
+		}
+		stopContainer(c.Name)
+		if pid, err := strconv.Atoi(c.Pid); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	waitOrKill(pids, podStopTimeout)
+	for _, c := range members {
+		removeContainer(c.Name)
+		cgroups.NewCgroupManager(container.PodCgroupPath(pod, c.Id)).Destroy()
+	}
+
+	if pid, err := strconv.Atoi(pod.Pid); err == nil {
+		syscall.Kill(pid, syscall.SIGTERM)
+		waitOrKill([]int{pid}, podStopTimeout)
+	}
+	releasePodNetwork(pod)
+	cgroups.NewCgroupManager(pod.CgroupParent).Destroy()
+	container.UnmountShm(container.PodShmPath(podName))
+	dirURL := fmt.Sprintf(container.DefaultPodLocation, podName)
+	if err := os.RemoveAll(dirURL); err != nil {
+		return fmt.Errorf("Remove dir %s error %v", dirURL, err)
+	}
+	return nil
+}
+
+// 释放 pod 的网络端点: 端口映射的 DNAT 规则、veth 和分配的 IP，没有连接网络时什么都不做
+func releasePodNetwork(pod *container.PodInfo) {
+	if pod.IPAddress == nil {
+		return
+	}
+	network.Init()
+	cinfo := &container.ContainerInfo{Id: pod.Id, PortMapping: pod.PortMapping}
+	if err := network.Disconnect(pod.Network, cinfo, pod.IPAddress); err != nil {
+		log.Warnf("Disconnect pod %s from network %s error %v", pod.Name, pod.Network, err)
+	}
+}
+
+// 等待进程退出，超时后给还没有退出的进程发送 SIGKILL
+func waitOrKill(pids []int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, pid := range pids {
+		for syscall.Kill(pid, 0) != syscall.ESRCH {
+			if time.Now().After(deadline) {
+				log.Warnf("Process %d did not exit in %v, killing it", pid, timeout)
+				syscall.Kill(pid, syscall.SIGKILL)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// 列出所有 pod
+func ListPods() error {
+	dirURL := fmt.Sprintf(container.DefaultPodLocation, "")
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Read dir %s error %v", dirURL, err)
+	}
+	containers, err := listContainerInfos()
+	if err != nil {
+		return err
+	}
+	count := map[string]int{}
+	for _, c := range containers {
+		if c.Pod != "" {
+			count[c.Pod]++
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "POD ID\tNAME\tSTATUS\tCONTAINERS\tCREATED\n")
+	for _, file := range files {
+		pod, err := getPodInfoByName(file.Name())
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+			pod.Id,
+			pod.Name,
+			podStatus(pod),
+			count[pod.Name],
+			pod.CreatedTime)
+	}
+	return w.Flush()
+}
+
+// pod inspect 输出的信息，包括 pod 中的容器
+type podInspect struct {
+	*container.PodInfo
+	Status     string   `json:"status"`
+	Containers []string `json:"containers"`
+}
+
+// 输出 pod 的详细信息
+func InspectPod(podName string) error {
+	pod, err := getPodInfoByName(podName)
+	if err != nil {
+		return fmt.Errorf("No such pod %s", podName)
+	}
+	members, err := podContainers(podName)
+	if err != nil {
+		return err
+	}
+	info := &podInspect{PodInfo: pod, Status: podStatus(pod), Containers: []string{}}
+	for _, c := range members {
+		info.Containers = append(info.Containers, c.Name)
+	}
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// infra 进程还在时 pod 为 running
+func podStatus(pod *container.PodInfo) string {
+	pid, err := strconv.Atoi(pod.Pid)
+	if err == nil && syscall.Kill(pid, 0) != syscall.ESRCH {
+		return container.RUNNING
+	}
+	return container.Exit
+}
+
+// run --pod 使用的 pod，infra 进程需要还在运行
+func getRunningPod(podName string) (*container.PodInfo, error) {
+	pod, err := getPodInfoByName(podName)
+	if err != nil {
+		return nil, fmt.Errorf("No such pod %s", podName)
+	}
+	if podStatus(pod) != container.RUNNING {
+		return nil, fmt.Errorf("Pod %s is not running", podName)
+	}
+	return pod, nil
+}
+
+// pod 中的所有容器
+func podContainers(podName string) ([]*container.ContainerInfo, error) {
+	containers, err := listContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	var members []*container.ContainerInfo
+	for _, c := range containers {
+		if c.Pod == podName {
+			members = append(members, c)
+		}
+	}
+	return members, nil
+}
+
+func getPodInfoByName(podName string) (*container.PodInfo, error) {
+	configFilePath := fmt.Sprintf(container.DefaultPodLocation, podName) + container.ConfigName
+	contentBytes, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var pod container.PodInfo
+	if err := json.Unmarshal(contentBytes, &pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+func writePodInfo(pod *container.PodInfo) error {
+	content, err := json.Marshal(pod)
+	if err != nil {
+		return err
+	}
+	configFilePath := fmt.Sprintf(container.DefaultPodLocation, pod.Name) + container.ConfigName
+	if err := ioutil.WriteFile(configFilePath, content, 0600); err != nil {
+		return fmt.Errorf("Write file %s error %v", configFilePath, err)
+	}
+	return nil
+}
@@ -4,133 +4,687 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
 	"github.com/xianlubird/mydocker/cgroups"
 	"github.com/xianlubird/mydocker/cgroups/subsystems"
 	"github.com/xianlubird/mydocker/container"
 	"github.com/xianlubird/mydocker/network"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-/*
-createTty       是否前台运行
-cmdArray        需要执行的指令
-resConf         资源限制设置
-containerName   指定创建的容器名字
-volume          挂载信息
-imageName       指定镜像文件名字
-envSlice        环境变量
-network         网络配置信息
-portmapping     端口映射
-*/
-func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, containerName, volume, imageName string,
-	envSlice []string, nw string, portmapping []string) {
+// run 命令的参数
+type runOptions struct {
+	tty           bool                       // 是否前台运行
+	args          []string                   // 需要执行的指令，为空时使用镜像的 Cmd
+	entrypoint    *string                    // --entrypoint，为 nil 表示没有指定
+	workdir       string                     // 工作目录，为空时使用镜像的 WorkingDir
+	init          bool                       // 是否使用 mydocker 自带的 init 作为 1 号进程
+	user          string                     // 运行用户，为空时使用镜像的 User
+	rlimits       []container.Rlimit         // --ulimit 资源限制
+	hostname      string                     // 主机名，为空时使用容器 ID
+	domainname    string                     // NIS 域名
+	dns           []string                   // DNS 服务器，为空时使用宿主机的
+	dnsSearch     []string                   // DNS 搜索域
+	dnsOptions    []string                   // resolv.conf 的 options
+	extraHosts    []string                   // 添加到 /etc/hosts 中的记录 name:ip
+	shmSize       int64                      // /dev/shm 的大小，为 0 时使用默认值
+	securityOpt   []string                   // --security-opt 原始参数，记录在容器信息中
+	security      *container.SecurityOptions // --security-opt 解析后的结果
+	maskedPaths   []string                   // 容器内屏蔽的路径，默认值去掉 unmask 指定的路径
+	readonlyPaths []string                   // 容器内只读的路径，默认值去掉 unmask 指定的路径
+	readonly      bool                       // --read-only，根目录只读
+	tmpfs         []string                   // --tmpfs 挂载，<容器内路径>[:<参数>]
+	// --secret 挂载到 /run/secrets 的 secret
+	secrets       []container.SecretReference
+	devices       []container.Device         // --device 添加的设备
+	deviceRules   []string                   // --device-cgroup-rule，已经加入了 resConf 中
+	capabilities  []string                   // 容器进程的能力
+	privileged    bool                       // --privileged，拥有所有能力、所有设备，不屏蔽任何路径
+	seccomp       *container.SeccompProfile  // seccomp 配置，为 nil 时不使用
+	noNewPrivs    bool                       // no-new-privileges
+	userns        string                     // --userns
+	uidMaps       []container.IDMap          // user 命名空间的 uid 映射，为空时不使用 user 命名空间
+	gidMaps       []container.IDMap          // user 命名空间的 gid 映射
+	resConf       *subsystems.ResourceConfig // 资源限制设置
+	containerName string                     // 指定创建的容器名字
+	volume        string                     // 挂载信息
+	imageName     string                     // 指定镜像文件名字
+	env           []string                   // 环境变量，--env-file 和 -e 解析后的结果
+	network       string                     // 网络配置信息
+	namespaces    *container.Namespaces      // --pid、--ipc、--uts、--cgroupns、--time-offset
+	pod           string                     // --pod，加入 pod 的网络、IPC、UTS 命名空间
+	portMapping   []string                   // 端口映射
+	labels        map[string]string          // 容器标签
+	logConfig     *container.LogConfig       // 日志驱动配置
+}
+
+func Run(opts *runOptions) error {
+	// 合并镜像配置和命令行参数，得到容器实际执行的指令、环境变量和工作目录
+	imageConfig, err := container.LoadImageConfig(opts.imageName)
+	if err != nil {
+		return fmt.Errorf("Load image %s config error %v", opts.imageName, err)
+	}
+	config := container.MergeImageConfig(imageConfig, opts.entrypoint, opts.args, opts.workdir)
+	if opts.user != "" {
+		config.User = opts.user
+	}
+	config.Env = container.MergeEnv(config.Env, opts.env)
+	comArray := config.Args()
+	if len(comArray) == 0 {
+		return fmt.Errorf("No command specified, image %s has no entrypoint or cmd", opts.imageName)
+	}
+	if config.WorkingDir != "" && !filepath.IsAbs(config.WorkingDir) {
+		return fmt.Errorf("The working directory %s is invalid, it needs to be an absolute path", config.WorkingDir)
+	}
+	if config.StopSignal != "" {
+		if _, err := container.ParseSignal(config.StopSignal); err != nil {
+			return fmt.Errorf("Invalid stop signal in image %s: %v", opts.imageName, err)
+		}
+	}
+
+	// rootless 模式下不能创建 veth 设备和 iptables 规则，bridge 网络退化为 none，端口映射不生效
+	if container.Rootless() {
+		if bridgeNetwork(opts.network) {
+			log.Warnf("Network %s is not available in rootless mode, using %s", opts.network, network.NoneNetwork)
+			opts.network = network.NoneNetwork
+		}
+		if len(opts.portMapping) > 0 {
+			log.Warnf("Port mappings are ignored in rootless mode")
+			opts.portMapping = nil
+		}
+	}
+	// pod 中的容器使用 pod 的网络、主机名和 /dev/shm
+	var pod *container.PodInfo
+	if opts.pod != "" {
+		if pod, err = getRunningPod(opts.pod); err != nil {
+			return err
+		}
+		opts.network = pod.Network
+	}
+	// host-gateway 解析为容器所在网络的网关地址，没有网络时无法使用
+	for _, host := range opts.extraHosts {
+		if _, ip, _ := container.ParseExtraHost(host); ip == container.HostGateway && !bridgeNetwork(opts.network) {
+			return fmt.Errorf("add-host %s: %s requires --net", host, container.HostGateway)
+		}
+	}
+
+	// --net host 时使用宿主机的网络命名空间
+	switch {
+	case pod != nil:
+		mode := container.NamespacePodPrefix + pod.Name
+		opts.namespaces.Net, opts.namespaces.Ipc, opts.namespaces.Uts = mode, mode, mode
+	case opts.network == network.HostNetwork:
+		opts.namespaces.Net = container.NamespaceHost
+	default:
+		opts.namespaces.Net = container.NamespacePrivate
+	}
+	// container:<name> 模式需要加入的其它容器的命名空间
+	joins, targets, err := namespaceJoins(opts.namespaces)
+	if err != nil {
+		return err
+	}
+	if pod != nil {
+		joins = append(joins, container.PodNamespaceJoins(pod)...)
+	}
+
 	// 如果容器名字没有指定，则使用随机数
 	containerID := randStringBytes(10)
-	if containerName == "" {
-		containerName = containerID
+	if opts.containerName == "" {
+		opts.containerName = containerID
+	}
+	// 主机名默认为容器 ID，共享宿主机或者其它容器的 UTS 命名空间时使用对方的主机名
+	switch {
+	case pod != nil:
+		opts.hostname = pod.Hostname
+	case opts.namespaces.Uts == container.NamespaceHost:
+		if opts.hostname, err = os.Hostname(); err != nil {
+			return fmt.Errorf("Get hostname error %v", err)
+		}
+	case targets["uts"] != nil:
+		opts.hostname = targets["uts"].Hostname
+	case opts.hostname == "":
+		opts.hostname = containerID
+	}
+	opts.maskedPaths = container.FilterPaths(container.DefaultMaskedPaths, opts.security.Unmask)
+	opts.readonlyPaths = container.FilterPaths(container.DefaultReadonlyPaths, opts.security.Unmask)
+
+	// 容器的挂载点、可写层、/dev/shm 和 secret 的 tmpfs 都以容器名命名，先创建容器信息目录占用容器名
+	// 容器名已经被使用时直接报错，不会挂载到正在运行的同名容器上，出错清理时也不会删除它的信息
+	if err := reserveContainerName(opts.containerName); err != nil {
+		return err
 	}
+
+	// 容器的环境变量: 默认环境变量 + 镜像的 Env + --env-file + -e，不继承宿主机的环境变量
+	env := container.MergeEnv(container.DefaultEnv(opts.hostname, opts.tty), config.Env)
 	// 创建容器进程
-	parent, writePipe := container.NewParentProcess(tty, containerName, volume, imageName, envSlice)
-	if parent == nil {
-		log.Errorf("New parent process error")
-		return
+	// 镜像解压、挂载失败时工作空间已经清理，只需要删除容器信息
+	parent, writePipe, syncPipe, err := container.NewParentProcess(opts.tty, opts.containerName, opts.volume, opts.imageName, opts.namespaces, opts.uidMaps, opts.gidMaps)
+	if err != nil {
+		deleteContainerInfo(opts.containerName)
+		return err
+	}
+
+	// 使用日志驱动时，容器的 stdout/stderr 通过管道交给 log-forward 进程转发
+	var logPipes []*os.File
+	if opts.logConfig != nil {
+		var err error
+		if logPipes, err = setLogPipes(parent); err != nil {
+			deleteContainerInfo(opts.containerName)
+			container.DeleteWorkSpace(opts.volume, opts.containerName, opts.uidMaps, opts.gidMaps)
+			return fmt.Errorf("Create log pipes error %v", err)
+		}
+	}
+
+	// 共享 IPC 命名空间时 /dev/shm 也要共享，POSIX 共享内存放在 /dev/shm 下
+	// 可以共享的 /dev/shm 要在容器进程复制 mount 命名空间之前挂载，容器中才能看到
+	var shm string
+	switch {
+	case opts.namespaces.Ipc == container.NamespaceHost:
+		shm = "/dev/shm"
+	case opts.namespaces.Ipc == container.NamespaceShareable:
+		shm = container.ShareableShmPath(opts.containerName)
+		if err := container.MountShm(shm, opts.shmSize); err != nil {
+			deleteContainerInfo(opts.containerName)
+			container.DeleteWorkSpace(opts.volume, opts.containerName, opts.uidMaps, opts.gidMaps)
+			return err
+		}
+	case targets["ipc"] != nil:
+		shm = container.ShareableShmPath(targets["ipc"].Name)
+	case pod != nil:
+		shm = container.PodShmPath(pod.Name)
+	}
+
+	// secret 写在宿主机上的 tmpfs 中，同样要在容器进程复制 mount 命名空间之前挂载
+	var secretsMount *container.Mount
+	if len(opts.secrets) > 0 {
+		m, err := container.MountSecrets(opts.containerName, opts.secrets, opts.uidMaps, opts.gidMaps)
+		if err != nil {
+			deleteContainerInfo(opts.containerName)
+			container.DeleteWorkSpace(opts.volume, opts.containerName, opts.uidMaps, opts.gidMaps)
+			return err
+		}
+		secretsMount = &m
 	}
 
 	// 实际启动容器进程，进行了初始化
-	if err := parent.Start(); err != nil {
-		log.Error(err)
+	if err := container.StartInNamespaces(parent, joins); err != nil {
+		deleteContainerInfo(opts.containerName)
+		container.DeleteWorkSpace(opts.volume, opts.containerName, opts.uidMaps, opts.gidMaps)
+		return fmt.Errorf("Start container process error %v", err)
+	}
+	// 管道的另一端已经交给了容器进程，父进程中需要关闭，否则读不到 EOF
+	for _, f := range parent.ExtraFiles {
+		f.Close()
+	}
+
+	// 启动过程中出错时，结束容器进程并清理已经创建的资源，连接了网络时还要释放网络端点
+	var endpoint *network.Endpoint
+	cleanup := func() {
+		parent.Process.Kill()
+		parent.Wait()
+		releaseContainerNetwork(endpoint, opts.network, containerID, opts.portMapping)
+		deleteContainerInfo(opts.containerName)
+		container.DeleteWorkSpace(opts.volume, opts.containerName, opts.uidMaps, opts.gidMaps)
 	}
 
 	//record container info
 	// 记录容器信息，例如 ps读取容器信息
-	containerName, err := recordContainerInfo(parent.Process.Pid, comArray, containerName, containerID, volume)
-	if err != nil {
-		log.Errorf("Record container info error %v", err)
-		return
+	if err := recordContainerInfo(parent.Process.Pid, containerID, opts, config, env); err != nil {
+		cleanup()
+		return fmt.Errorf("Record container info error %v", err)
+	}
+
+	if opts.logConfig != nil {
+		if err := startLogForwarder(opts.containerName, logPipes, parent); err != nil {
+			log.Errorf("Start log forwarder error %v", err)
+		}
 	}
 
 	// 资源限制逻辑
 	// use containerID as cgroup name
 	cgroupManager := cgroups.NewCgroupManager(containerID)
+	if pod != nil {
+		cgroupManager = cgroups.NewCgroupManager(container.PodCgroupPath(pod, containerID))
+	}
+	cgroupManager.Rootless = container.Rootless()
 	defer cgroupManager.Destroy()
-	cgroupManager.Set(res)                  // 创建子cgroup，并写入限制数值
-	cgroupManager.Apply(parent.Process.Pid) // 生效，把容器进程id写入对应的tasks文件
+	// 限制没有生效时不能继续运行，否则 --device 的白名单等于没有设置
+	// rootless 模式下只能使用委派的 cgroup，设置失败时只给出警告
+	if err := cgroupManager.Set(opts.resConf); err != nil { // 创建子cgroup，并写入限制数值
+		if !container.Rootless() {
+			cleanup()
+			return fmt.Errorf("Set container %s resource limits error %v", opts.containerName, err)
+		}
+		log.Warnf("Set container %s resource limits error %v", opts.containerName, err)
+	}
+	if err := cgroupManager.Apply(parent.Process.Pid); err != nil { // 生效，把容器进程id写入对应的tasks文件
+		if !container.Rootless() {
+			cleanup()
+			return fmt.Errorf("Apply container %s cgroup error %v", opts.containerName, err)
+		}
+		log.Warnf("Apply container %s cgroup error %v", opts.containerName, err)
+	}
 
 	// 配置网络信息
-	if nw != "" {
+	var containerIP, gateway net.IP
+	if pod != nil {
+		// 网络端点属于 pod，已经在 pod create 时连接
+		containerIP, gateway = pod.IPAddress, pod.Gateway
+	} else if bridgeNetwork(opts.network) {
 		// config container network
 		network.Init() // 初始化网络配置
 		containerInfo := &container.ContainerInfo{
 			Id:          containerID,
 			Pid:         strconv.Itoa(parent.Process.Pid),
-			Name:        containerName,
-			PortMapping: portmapping,
+			Name:        opts.containerName,
+			PortMapping: opts.portMapping,
 		}
 		// 连接到网络
-		if err := network.Connect(nw, containerInfo); err != nil {
-			log.Errorf("Error Connect Network %v", err)
-			return
+		ep, err := network.Connect(opts.network, containerInfo)
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("Error Connect Network %v", err)
+		}
+		endpoint = ep
+		if err := recordContainerNetwork(opts.containerName, opts.network, ep.IPAddress); err != nil {
+			cleanup()
+			return err
 		}
+		containerIP = ep.IPAddress
+		gateway = ep.Network.IpRange.IP
 	}
 
-	// 最终执行指令
-	sendInitCommand(comArray, writePipe)
+	// --tmpfs 在容器的 mount namespace 中挂载，先于 /etc 下的文件，这样 --tmpfs /etc 时这些文件依然存在
+	var mounts []container.Mount
+	if shm != "" {
+		mounts = append(mounts, container.Mount{Source: shm, Destination: "/dev/shm", Flags: syscall.MS_BIND})
+	}
+	for _, value := range opts.tmpfs {
+		m, err := container.ParseTmpfs(value)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		mounts = append(mounts, m)
+	}
+	// 在 --tmpfs 之后挂载，--tmpfs /run 时 /run/secrets 依然存在
+	if secretsMount != nil {
+		mounts = append(mounts, *secretsMount)
+	}
+	// 生成 /etc/hostname、/etc/hosts、/etc/resolv.conf，hosts 中需要容器的 IP，所以在连接网络之后
+	etcMounts, err := setupEtcFiles(opts, containerIP, gateway)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	mounts = append(mounts, etcMounts...)
+
+	// 共享 UTS 命名空间时不修改主机名
+	hostname, domainname := opts.hostname, opts.domainname
+	if opts.namespaces.Uts != container.NamespacePrivate {
+		hostname, domainname = "", ""
+	}
+	// 最终执行指令，通过管道把 init 配置发给容器进程
+	spec := &container.InitSpec{
+		Args:            comArray,
+		Env:             env,
+		Cwd:             config.WorkingDir,
+		User:            config.User,
+		Init:            opts.init,
+		Tty:             opts.tty,
+		Hostname:        hostname,
+		Domainname:      domainname,
+		Rlimits:         opts.rlimits,
+		Mounts:          mounts,
+		ShmSize:         opts.shmSize,
+		MaskedPaths:     opts.maskedPaths,
+		ReadonlyPaths:   opts.readonlyPaths,
+		ReadonlyRootfs:  opts.readonly,
+		Devices:         opts.devices,
+		Capabilities:    opts.capabilities,
+		Seccomp:         opts.seccomp,
+		NoNewPrivileges: opts.noNewPrivs,
+		CgroupNS:        opts.namespaces.Cgroup == container.NamespacePrivate,
+		TimeOffsets:     opts.namespaces.TimeOffsets,
+	}
+	if err := container.SendInitSpec(spec, writePipe); err != nil {
+		cleanup()
+		return fmt.Errorf("Send init spec error %v", err)
+	}
+	// 等待 init 完成初始化并 exec 用户指令，失败时返回 init 报告的错误
+	if err := container.ReadInitError(syncPipe); err != nil {
+		cleanup()
+		return err
+	}
 
 	//如果 detach 创建了容器 就不能再去等待，创建容器之后 父进程就已经退出了。
 	//因此 这里只是将容器内的 init 进程启动起来 就己经完成工作，
 	//紧接着就可以退出，然后由操作系统进程 ID为1 的init 进程去接管容器进程。
-	if tty { // 如果设置了前台运行
-		parent.Wait()
-		deleteContainerInfo(containerName)               // 删除容器信息
-		container.DeleteWorkSpace(volume, containerName) // 删除NewWorkSpace创建的工作空间
+	if opts.tty { // 如果设置了前台运行
+		err := parent.Wait()
+		// 容器退出后释放网络端点，IP 可以分配给其它容器
+		releaseContainerNetwork(endpoint, opts.network, containerID, opts.portMapping)
+		cleanupExecs(opts.containerName)                                                       // 结束并清理 exec 会话
+		deleteContainerInfo(opts.containerName)                                                // 删除容器信息
+		container.DeleteWorkSpace(opts.volume, opts.containerName, opts.uidMaps, opts.gidMaps) // 删除NewWorkSpace创建的工作空间
+		// 前台运行时使用容器进程的退出码退出
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return &containerExitError{status: status}
+			}
+		}
+	}
+	return nil
+}
+
+// 解析 container:<name> 模式，返回需要加入的命名空间和对应的容器信息，目标容器需要正在运行
+// 只有 --ipc shareable 的容器的 IPC 命名空间可以被其它容器加入
+func namespaceJoins(ns *container.Namespaces) ([]container.NamespaceJoin, map[string]*container.ContainerInfo, error) {
+	var joins []container.NamespaceJoin
+	targets := map[string]*container.ContainerInfo{}
+	for _, item := range []struct {
+		kind string
+		mode string
+	}{{"pid", ns.Pid}, {"ipc", ns.Ipc}, {"uts", ns.Uts}, {"cgroup", ns.Cgroup}} {
+		name := container.NamespaceContainer(item.mode)
+		if name == "" {
+			continue
+		}
+		info, err := getContainerInfoByName(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Get container %s info error %v", name, err)
+		}
+		if info.Status != container.RUNNING {
+			return nil, nil, fmt.Errorf("Container %s is not running", name)
+		}
+		if item.kind == "ipc" && (info.Namespaces == nil || info.Namespaces.Ipc != container.NamespaceShareable) {
+			return nil, nil, fmt.Errorf("IPC namespace of container %s is not shareable", name)
+		}
+		joins = append(joins, container.NamespaceJoin{
+			Type: item.kind,
+			Path: fmt.Sprintf("/proc/%s/ns/%s", info.Pid, item.kind),
+		})
+		targets[item.kind] = info
+	}
+	return joins, targets, nil
+}
+
+// 是否需要连接到 mydocker network create 创建的网络，host 和 none 不需要
+func bridgeNetwork(name string) bool {
+	return name != "" && name != network.HostNetwork && name != network.NoneNetwork
+}
+
+// 前台运行的容器以非 0 状态退出
+type containerExitError struct {
+	status syscall.WaitStatus
+}
+
+func (e *containerExitError) Error() string {
+	if e.status.Signaled() {
+		return fmt.Sprintf("container killed by signal %v", e.status.Signal())
+	}
+	return fmt.Sprintf("container exited with code %d", e.status.ExitStatus())
+}
+
+// 和 shell 一样，被信号结束时退出码为 128+信号值
+func (e *containerExitError) ExitCode() int {
+	if e.status.Signaled() {
+		return 128 + int(e.status.Signal())
+	}
+	return e.status.ExitStatus()
+}
+
+// 把 run 的错误转换成带退出码的错误: 125 运行时错误，126 指令不可执行，127 找不到指令
+func runExitError(err error) error {
+	switch e := err.(type) {
+	case *container.InitError:
+		return cli.NewExitError(e.Message, e.Code)
+	case *containerExitError:
+		// 容器自己的退出不需要再输出错误信息
+		return cli.NewExitError("", e.ExitCode())
+	default:
+		return cli.NewExitError(err.Error(), container.ExitCodeRuntime)
+	}
+}
+
+// 生成容器的 /etc/hostname、/etc/hosts、/etc/resolv.conf，放在容器信息目录下，bind mount 到容器中
+// 容器里修改这些文件不会影响镜像，删除容器时一起删除
+func setupEtcFiles(opts *runOptions, containerIP, gateway net.IP) ([]container.Mount, error) {
+	var extraHosts []string
+	for _, host := range opts.extraHosts {
+		name, ip, err := container.ParseExtraHost(host)
+		if err != nil {
+			return nil, err
+		}
+		if ip == container.HostGateway {
+			ip = gateway.String()
+		}
+		extraHosts = append(extraHosts, name+":"+ip)
+	}
+	hostResolvConf, err := container.ReadHostResolvConf()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read host resolv.conf error %v", err)
 	}
 
+	dir := fmt.Sprintf(container.DefaultInfoLocation, opts.containerName)
+	files := []struct {
+		name    string
+		dest    string
+		content []byte
+	}{
+		{container.HostnameFile, "/etc/hostname", []byte(opts.hostname + "\n")},
+		{container.HostsFile, "/etc/hosts", container.BuildHosts(opts.hostname, opts.domainname, containerIP, extraHosts)},
+		{container.ResolvConfFile, "/etc/resolv.conf", container.BuildResolvConf(hostResolvConf, opts.dns, opts.dnsSearch, opts.dnsOptions)},
+	}
+	var mounts []container.Mount
+	for _, f := range files {
+		m, err := container.WriteBindFile(dir, f.name, f.dest, f.content)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	// 使用 user 命名空间时，容器内的 root 需要能进入容器信息目录，并且可以修改这些文件
+	if len(opts.uidMaps) > 0 {
+		uid, gid := container.RemappedRoot(opts.uidMaps, opts.gidMaps)
+		for _, m := range mounts {
+			if err := os.Chown(m.Source, uid, gid); err != nil {
+				return nil, fmt.Errorf("chown %s error %v", m.Source, err)
+			}
+		}
+		dir = filepath.Clean(dir)
+		if err := container.AllowTraverse(filepath.Dir(dir), dir); err != nil {
+			return nil, err
+		}
+	}
+	return mounts, nil
 }
 
-// 将指令通过管道发给容器进进程
-func sendInitCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ")
-	log.Infof("command all is %s", command)
-	writePipe.WriteString(command) // 将指令通过管道发给容器进进程
-	writePipe.Close()
+// 解析 --ulimit，同一种资源指定多次时使用最后一次的值
+func parseUlimits(values []string) ([]container.Rlimit, error) {
+	var rlimits []container.Rlimit
+	index := map[string]int{}
+	for _, value := range values {
+		r, err := container.ParseRlimit(value)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[r.Type]; ok {
+			rlimits[i] = r
+			continue
+		}
+		index[r.Type] = len(rlimits)
+		rlimits = append(rlimits, r)
+	}
+	return rlimits, nil
+}
+
+// 解析 --pid、--ipc、--uts、--cgroupns 和 --time-offset，网络命名空间由 --net 决定
+func parseNamespaceOptions(context *cli.Context) (*container.Namespaces, error) {
+	namespaces := &container.Namespaces{}
+	for _, item := range []struct {
+		kind string
+		flag string
+		mode *string
+	}{
+		{"pid", "pid", &namespaces.Pid},
+		{"ipc", "ipc", &namespaces.Ipc},
+		{"uts", "uts", &namespaces.Uts},
+		{"cgroup", "cgroupns", &namespaces.Cgroup},
+	} {
+		mode, err := container.ParseNamespaceMode(item.kind, context.String(item.flag))
+		if err != nil {
+			return nil, err
+		}
+		*item.mode = mode
+	}
+	for _, value := range context.StringSlice("time-offset") {
+		offset, err := container.ParseTimeOffset(value)
+		if err != nil {
+			return nil, err
+		}
+		namespaces.TimeOffsets = append(namespaces.TimeOffsets, offset)
+	}
+	return namespaces, nil
+}
+
+// 解析 --device 和 --device-cgroup-rule，返回需要创建的设备和 devices cgroup 中允许访问的设备
+// 允许访问的设备: 默认的设备 + --device 添加的设备 + --device-cgroup-rule
+func parseDeviceOptions(deviceValues, ruleValues []string) ([]container.Device, []subsystems.DeviceRule, error) {
+	var devices []container.Device
+	rules := append([]subsystems.DeviceRule{}, subsystems.DefaultDeviceRules...)
+	for _, value := range deviceValues {
+		ds, err := container.ParseDevice(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range ds {
+			rule := subsystems.DeviceRule{Type: 'c', Major: d.Major, Minor: d.Minor, Access: d.Permissions}
+			if d.Type == syscall.S_IFBLK {
+				rule.Type = 'b'
+			}
+			rules = append(rules, rule)
+		}
+		devices = append(devices, ds...)
+	}
+	for _, value := range ruleValues {
+		rule, err := subsystems.ParseDeviceRule(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return devices, rules, nil
+}
+
+// 根据 --security-opt seccomp= 得到容器使用的 seccomp 配置
+// 特权容器和 seccomp=unconfined 不使用 seccomp，没有指定时使用默认配置
+func loadSeccompProfile(value string, privileged bool, capabilities []string) (*container.SeccompProfile, error) {
+	if value == container.SeccompUnconfined || (privileged && value == "") {
+		return nil, nil
+	}
+	profile := container.DefaultSeccompProfile()
+	if value != "" {
+		var err error
+		if profile, err = container.LoadSeccompProfile(value); err != nil {
+			return nil, err
+		}
+	}
+	return profile.Resolve(capabilities)
+}
+
+// 解析 --env-file 和 -e，-e 中的同名变量覆盖 --env-file 中的
+func parseEnvOptions(envFiles, envs []string) ([]string, error) {
+	var result []string
+	for _, file := range envFiles {
+		env, err := container.ReadEnvFile(file, os.LookupEnv)
+		if err != nil {
+			return nil, fmt.Errorf("read env file error %v", err)
+		}
+		result = container.MergeEnv(result, env)
+	}
+	env, err := container.ParseEnv(envs, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	return container.MergeEnv(result, env), nil
 }
 
 // 记录容器信息，例如 ps读取容器信息
-func recordContainerInfo(containerPID int, commandArray []string, containerName, id, volume string) (string, error) {
+func recordContainerInfo(containerPID int, id string, opts *runOptions, config *container.ImageConfig, env []string) error {
 	/*
 		containerPID: 容器进程id
-		commandArray: 执行的指令
-		containerName: 容器名字
 		id: 容器id,是一个随机数
-		volume: 挂载信息
+		opts: run 命令的参数
+		config: 容器实际使用的配置（镜像配置合并命令行参数后的结果）
+		env: 容器进程的全部环境变量，exec 时复用
 	*/
 	createTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(commandArray, "")
+	command := strings.Join(config.Args(), " ")
 	containerInfo := &container.ContainerInfo{
-		Id:          id,
-		Pid:         strconv.Itoa(containerPID),
-		Command:     command,
-		CreatedTime: createTime,
-		Status:      container.RUNNING,
-		Name:        containerName,
-		Volume:      volume,
+		Id:                id,
+		Pid:               strconv.Itoa(containerPID),
+		Command:           command,
+		CreatedTime:       createTime,
+		Status:            container.RUNNING,
+		Name:              opts.containerName,
+		Volume:            opts.volume,
+		Image:             opts.imageName,
+		Labels:            opts.labels,
+		LogConfig:         opts.logConfig,
+		Config:            config,
+		Env:               env,
+		Rlimits:           opts.rlimits,
+		Hostname:          opts.hostname,
+		Domainname:        opts.domainname,
+		Dns:               opts.dns,
+		DnsSearch:         opts.dnsSearch,
+		DnsOptions:        opts.dnsOptions,
+		ExtraHosts:        opts.extraHosts,
+		ShmSize:           opts.shmSize,
+		SecurityOpt:       opts.securityOpt,
+		MaskedPaths:       opts.maskedPaths,
+		ReadonlyPaths:     opts.readonlyPaths,
+		ReadonlyRootfs:    opts.readonly,
+		Tmpfs:             opts.tmpfs,
+		Devices:           opts.devices,
+		DeviceCgroupRules: opts.deviceRules,
+		Capabilities:      opts.capabilities,
+		Privileged:        opts.privileged,
+		Seccomp:           opts.seccomp,
+		NoNewPrivileges:   opts.noNewPrivs,
+		Userns:            opts.userns,
+		UidMaps:           opts.uidMaps,
+		GidMaps:           opts.gidMaps,
+		Namespaces:        opts.namespaces,
+		Pod:               opts.pod,
+		Secrets:           opts.secrets,
+	}
+	// rootless 模式下记录 rootless 的 user 命名空间的映射，commit 时用来还原文件属主
+	if container.Rootless() {
+		containerInfo.UidMaps, containerInfo.GidMaps = container.RootlessIDMaps()
 	}
 
 	jsonBytes, err := json.Marshal(containerInfo)
 	if err != nil {
 		log.Errorf("Record container info error %v", err)
-		return "", err
+		return err
 	}
 	jsonStr := string(jsonBytes) // 将容器信息序列化
 
-	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, containerName) // 存放容器信息的路径
-	if err := os.MkdirAll(dirUrl, 0622); err != nil {
+	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, opts.containerName) // 存放容器信息的路径
+	if err := os.MkdirAll(dirUrl, 0700); err != nil {
 		log.Errorf("Mkdir error %s error %v", dirUrl, err)
-		return "", err
+		return err
 	}
 	// 创建存放容器信息的文件，并写入
 	fileName := dirUrl + "/" + container.ConfigName
@@ -138,18 +692,66 @@ func recordContainerInfo(containerPID int, commandArray []string, containerName,
 	defer file.Close()
 	if err != nil {
 		log.Errorf("Create file %s error %v", fileName, err)
-		return "", err
+		return err
 	}
 	if _, err := file.WriteString(jsonStr); err != nil {
 		log.Errorf("File write string error %v", err)
-		return "", err
+		return err
 	}
 
-	return containerName, nil
+	return nil
+}
+
+// 连接网络之后把网络和 IP 记录到容器信息中，后台运行的容器 rm 时用来释放网络端点
+func recordContainerNetwork(containerName, networkName string, ip net.IP) error {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("Get container %s info error %v", containerName, err)
+	}
+	containerInfo.Network = networkName
+	containerInfo.IPAddress = ip
+	jsonBytes, err := json.Marshal(containerInfo)
+	if err != nil {
+		return fmt.Errorf("Json marshal %s error %v", containerName, err)
+	}
+	configFilePath := fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ConfigName
+	if err := ioutil.WriteFile(configFilePath, jsonBytes, 0622); err != nil {
+		return fmt.Errorf("Write file %s error %v", configFilePath, err)
+	}
+	return nil
+}
+
+// 删除端口映射的 DNAT 规则和 veth，释放容器的 IP，没有连接网络时 ep 为空
+func releaseContainerNetwork(ep *network.Endpoint, networkName, containerID string, portMapping []string) {
+	if ep == nil {
+		return
+	}
+	cinfo := &container.ContainerInfo{Id: containerID, PortMapping: portMapping}
+	if err := network.Disconnect(networkName, cinfo, ep.IPAddress); err != nil {
+		log.Warnf("Disconnect container %s from network %s error %v", containerID, networkName, err)
+	}
+}
+
+// 创建容器信息目录，目录已经存在说明容器名已经被使用
+func reserveContainerName(containerName string) error {
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
+	parent := filepath.Dir(filepath.Clean(dirURL))
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return fmt.Errorf("Mkdir %s error %v", parent, err)
+	}
+	if err := os.Mkdir(dirURL, 0700); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("Container name %s is already in use", containerName)
+		}
+		return fmt.Errorf("Mkdir %s error %v", dirURL, err)
+	}
+	return nil
 }
 
 func deleteContainerInfo(containerId string) {
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerId)
+	container.UnmountShm(container.ShareableShmPath(containerId))
+	container.UnmountSecrets(containerId)
 	if err := os.RemoveAll(dirURL); err != nil {
 		log.Errorf("Remove dir %s error %v", dirURL, err)
 	}
@@ -164,3 +766,16 @@ func randStringBytes(n int) string {
 	}
 	return string(b)
 }
+
+// 解析 key=value 格式的参数列表，例如 --label 和 --log-opt
+func parseKeyValues(values []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s is not in key=value format", value)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/xianlubird/mydocker/container"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 创建 secret，file 为 - 时从标准输入读取内容
+// 先写到临时目录再改名，不会留下只有一部分内容的 secret
+func CreateSecret(name, file string) error {
+	if err := container.ValidateSecretName(name); err != nil {
+		return err
+	}
+	dirURL := container.SecretPath(name)
+	if _, err := os.Stat(dirURL); err == nil {
+		return fmt.Errorf("Secret %s already exists", name)
+	}
+	data, err := readSecretData(file)
+	if err != nil {
+		return err
+	}
+
+	secretID := randStringBytes(10)
+	secret := &container.SecretInfo{
+		Id:          secretID,
+		Name:        name,
+		CreatedTime: time.Now().Format("2006-01-02 15:04:05"),
+		Size:        len(data),
+		Digest:      fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+	}
+	content, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	// secret 目录只有 root 可以访问
+	parent := filepath.Dir(filepath.Clean(dirURL))
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return fmt.Errorf("Mkdir %s error %v", parent, err)
+	}
+	tmpDir, err := ioutil.TempDir(parent, "."+name+"-")
+	if err != nil {
+		return fmt.Errorf("Create temp dir in %s error %v", parent, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, container.SecretDataFile), data, 0600); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("Write secret %s error %v", name, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, container.ConfigName), content, 0600); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("Write secret %s error %v", name, err)
+	}
+	if err := os.Rename(tmpDir, dirURL); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("Secret %s already exists", name)
+	}
+	fmt.Println(secretID)
+	return nil
+}
+
+// secret 的内容不能为空，也不能超过 500KB
+func readSecretData(file string) ([]byte, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("Open secret file %s error %v", file, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, container.MaxSecretSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Read secret data error %v", err)
+	}
+	if len(data) == 0 || len(data) > container.MaxSecretSize {
+		return nil, fmt.Errorf("Secret data must be larger than 0 and less than %d bytes", container.MaxSecretSize)
+	}
+	return data, nil
+}
+
+// 删除 secret，还有容器在使用时不能删除
+func RemoveSecret(name string) error {
+	if err := container.ValidateSecretName(name); err != nil {
+		return err
+	}
+	if _, err := container.LoadSecretInfo(name); err != nil {
+		return fmt.Errorf("No such secret %s", name)
+	}
+	users, err := secretUsers(name)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("Secret %s is in use by container %s", name, strings.Join(users, ", "))
+	}
+	dirURL := container.SecretPath(name)
+	if err := os.RemoveAll(dirURL); err != nil {
+		return fmt.Errorf("Remove dir %s error %v", dirURL, err)
+	}
+	return nil
+}
+
+// 列出所有 secret，不输出内容
+func ListSecrets() error {
+	dirURL := container.SecretPath("")
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Read dir %s error %v", dirURL, err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tNAME\tSIZE\tCREATED\n")
+	for _, file := range files {
+		// 创建中的临时目录以 . 开头
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		secret, err := container.LoadSecretInfo(file.Name())
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n",
+			secret.Id,
+			secret.Name,
+			secret.Size,
+			secret.CreatedTime)
+	}
+	return w.Flush()
+}
+
+// secret inspect 输出的信息，包括使用它的容器
+type secretInspect struct {
+	*container.SecretInfo
+	Containers []string `json:"containers"`
+}
+
+// 输出 secret 的详细信息，不包含内容
+func InspectSecret(name string) error {
+	if err := container.ValidateSecretName(name); err != nil {
+		return err
+	}
+	secret, err := container.LoadSecretInfo(name)
+	if err != nil {
+		return fmt.Errorf("No such secret %s", name)
+	}
+	users, err := secretUsers(name)
+	if err != nil {
+		return err
+	}
+	info := &secretInspect{SecretInfo: secret, Containers: append([]string{}, users...)}
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// 使用 secret 的容器，包括已经停止但还没有删除的
+func secretUsers(name string) ([]string, error) {
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
+	if _, err := os.Stat(dirURL); os.IsNotExist(err) {
+		return nil, nil
+	}
+	containers, err := listContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, c := range containers {
+		for _, ref := range c.Secrets {
+			if ref.Name == name {
+				users = append(users, c.Name)
+				break
+			}
+		}
+	}
+	return users, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/xianlubird/mydocker/container"
+	"github.com/xianlubird/mydocker/network"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -24,17 +25,25 @@ func stopContainer(containerName string) {
 		log.Errorf("Conver pid from string to int error %v", err)
 		return
 	}
-	// 发送系统退出信号
-	if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil {
-		log.Errorf("Stop container %s error %v", containerName, err)
-		return
-	}
 	// 读容器信息
 	containerInfo, err := getContainerInfoByName(containerName)
 	if err != nil {
 		log.Errorf("Get container %s info error %v", containerName, err)
 		return
 	}
+	// 发送系统退出信号，镜像配置了 StopSignal 时使用镜像的
+	stopSignal := syscall.SIGTERM
+	if containerInfo.Config != nil && containerInfo.Config.StopSignal != "" {
+		if sig, err := container.ParseSignal(containerInfo.Config.StopSignal); err == nil {
+			stopSignal = sig
+		}
+	}
+	if err := syscall.Kill(pidInt, stopSignal); err != nil {
+		log.Errorf("Stop container %s error %v", containerName, err)
+		return
+	}
+	// 结束并清理 exec 会话
+	cleanupExecs(containerName)
 	// 修改状态
 	containerInfo.Status = container.STOP
 	containerInfo.Pid = " "
@@ -47,7 +56,7 @@ func stopContainer(containerName string) {
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
 	configFilePath := dirURL + container.ConfigName
 	if err := ioutil.WriteFile(configFilePath, newContentBytes, 0622); err != nil {
-		log.Errorf("Write file %s error", configFilePath, err)
+		log.Errorf("Write file %s error %v", configFilePath, err)
 	}
 }
 
@@ -81,12 +90,22 @@ func removeContainer(containerName string) {
 		return
 	}
 
-	// 删除容器信息
+	// 释放容器的网络端点: 端口映射的 DNAT 规则、veth 和分配的 IP
+	if containerInfo.IPAddress != nil {
+		network.Init()
+		if err := network.Disconnect(containerInfo.Network, containerInfo, containerInfo.IPAddress); err != nil {
+			log.Warnf("Disconnect container %s from network %s error %v", containerName, containerInfo.Network, err)
+		}
+	}
+
+	// 删除容器信息，先卸载宿主机上 --ipc shareable 的 /dev/shm 和 secret 的 tmpfs
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
+	container.UnmountShm(container.ShareableShmPath(containerName))
+	container.UnmountSecrets(containerName)
 	if err := os.RemoveAll(dirURL); err != nil {
 		log.Errorf("Remove file %s error %v", dirURL, err)
 		return
 	}
 	// 删除容器工作空间
-	container.DeleteWorkSpace(containerInfo.Volume, containerName)
+	container.DeleteWorkSpace(containerInfo.Volume, containerName, containerInfo.UidMaps, containerInfo.GidMaps)
 }